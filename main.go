@@ -5,62 +5,145 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
 	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/hkdf"
+	_ "modernc.org/sqlite"
 )
 
+// 内置的数据库迁移文件，按数据库类型分目录存放
+//
+//go:embed sql/migrations
+var migrationsFS embed.FS
+
 type Config struct {
 	Server struct {
 		Port int    `toml:"port"`
 		Host string `toml:"host"`
+
+		VerifyIPRate    int `toml:"verify_ip_rate"`    // 每个IP每分钟允许的验证请求数，0或不填为60，负数表示不限制
+		VerifyIPBurst   int `toml:"verify_ip_burst"`   // 每个IP允许的突发请求数，0或不填为20
+		VerifyUserRate  int `toml:"verify_user_rate"`  // 每个用户每分钟允许的验证请求数，0或不填为120，负数表示不限制
+		VerifyUserBurst int `toml:"verify_user_burst"` // 每个用户允许的突发请求数，0或不填为30
+
+		TrustedProxies []string `toml:"trusted_proxies"` // 可信反向代理的IP或CIDR，只有来自这些地址的请求才读取转发头
+		ProxyHeader    string   `toml:"proxy_header"`    // 读取真实IP的转发头：none（默认）、xff、cloudflare、real-ip
 	} `toml:"server"`
 	Bot struct {
 		AdminIDs []int64 `toml:"admin_ids"`
 		Token    string  `toml:"token"`
 	} `toml:"bot"`
 	Database struct {
+		Driver   string `toml:"driver"` // mysql（默认）、sqlite 或 postgres
+		Path     string `toml:"path"`   // SQLite数据库文件路径
 		Host     string `toml:"host"`
 		Port     int    `toml:"port"`
 		User     string `toml:"user"`
 		Password string `toml:"password"`
 		DBName   string `toml:"db_name"`
+		SSLMode  string `toml:"ssl_mode"` // PostgreSQL sslmode，默认 disable
 	} `toml:"database"`
 	Limits struct {
 		DefaultLimit int `toml:"default_limit"`
 		KeyAddLimit  int `toml:"key_add_limit"`
+		TokenTTLDays int `toml:"token_ttl_days"` // Token有效天数，0表示永不过期
+
+		BindIPv4Prefix int `toml:"bind_ipv4_prefix"` // 绑定IPv4网段允许的最短前缀，默认24（最大 /24），32表示只能绑定单个IP
+		BindIPv6Prefix int `toml:"bind_ipv6_prefix"` // 绑定IPv6网段允许的最短前缀，默认64（最大 /64），128表示只能绑定单个IP
+		IPSlots        int `toml:"ip_slots"`         // 免费IP槽位数（含主绑定IP），默认1
+		MaxIPSlots     int `toml:"max_ip_slots"`     // 购买后最多可拥有的IP槽位数，默认5
+		MaxTokens      int `toml:"max_tokens"`       // 每个用户最多可拥有的Token数（含默认Token），默认5
+
+		KeyFreeFailures   int `toml:"key_free_failures"`   // 卡密连续输错多少次后开始锁定
+		KeyLockoutMinutes int `toml:"key_lockout_minutes"` // 首次锁定分钟数，之后每次失败翻倍
+		KeyAlertFailures  int `toml:"key_alert_failures"`  // 单个用户连续输错达到该次数时通知管理员
+		KeyGlobalFailures int `toml:"key_global_failures"` // 全部用户10分钟内输错达到该次数时通知管理员（不暂停兑换）
 	} `toml:"limits"`
 	Payment struct {
-		BaseURL     string  `toml:"base_url"`
-		MchID       string  `toml:"mch_id"`
-		Secret      string  `toml:"secret"`
-		PricePerUse float64 `toml:"price_per_use"`
-		NotifyURL   string  `toml:"notify_url"`
-		ReturnURL   string  `toml:"return_url"`
+		BaseURL       string  `toml:"base_url"`
+		MchID         string  `toml:"mch_id"`
+		Secret        string  `toml:"secret"`
+		PricePerUse   float64 `toml:"price_per_use"`
+		IPSlotPrice   float64 `toml:"ip_slot_price"`   // 每个附加IP槽位的价格（元），默认1
+		ChangeIPPrice float64 `toml:"change_ip_price"` // 换绑IP的价格（元），默认1
+		NotifyURL     string  `toml:"notify_url"`
+		ReturnURL     string  `toml:"return_url"`
 	} `toml:"payment"`
+	Crypto struct {
+		MasterSecret      string      `toml:"master_secret"`       // 默认主密钥，用于不带密钥ID的Token
+		LegacyTokensUntil string      `toml:"legacy_tokens_until"` // 旧版Token兼容截止日期 (YYYY-MM-DD)，为空则不再接受旧版Token
+		ActiveKey         string      `toml:"active_key"`          // 签发新Token使用的密钥ID，为空则使用默认主密钥
+		KeyFile           string      `toml:"key_file"`            // 密钥文件路径（可选）
+		Keys              []KeyConfig `toml:"keys"`
+	} `toml:"crypto"`
+	Products []ProductConfig `toml:"products"` // 产品列表，每个产品有独立的次数余额
+}
+
+// 默认产品ID，默认产品的次数保存在 users 表中
+const defaultProductID = "default"
+
+// ProductConfig 产品配置
+type ProductConfig struct {
+	ID           string  `toml:"id"`            // 产品ID，/verify 请求中的 product 字段
+	Name         string  `toml:"name"`          // 显示名称
+	DefaultLimit int     `toml:"default_limit"` // 用户首次使用、兑换或充值该产品时获得的次数
+	PricePerUse  float64 `toml:"price_per_use"` // 每次价格（元）
+}
+
+// KeyConfig 密钥配置
+type KeyConfig struct {
+	ID     string `toml:"id"`
+	Secret string `toml:"secret"`
+}
+
+// KeyFile 密钥文件结构
+type KeyFile struct {
+	ActiveKey string      `toml:"active_key"`
+	Keys      []KeyConfig `toml:"keys"`
+}
+
+// Keyring 主密钥环
+type Keyring struct {
+	keys     map[string][]byte
+	activeID string
 }
 
 type Payload struct {
 	UserID    string `json:"user_id"`
-	IP        string `json:"ip"`
+	IP        string `json:"ip"` // 绑定的IP或CIDR网段
 	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // 过期时间（毫秒时间戳），0表示永不过期
+	NotBefore int64  `json:"not_before,omitempty"` // 生效时间（毫秒时间戳），0表示立即生效
 }
 
 type UserRecord struct {
@@ -76,29 +159,141 @@ type UserDatabase struct {
 	Records []UserRecord `json:"records"`
 }
 
+// TokenRecord 用户额外创建的命名Token，默认Token保存在 UserRecord 中
+type TokenRecord struct {
+	ID        int64  `json:"id"`
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	Token     string `json:"token"`
+	Timestamp int64  `json:"timestamp"`
+	OwnQuota  bool   `json:"own_quota"` // true 使用独立次数，false 共享账户次数
+	Limit     int    `json:"limit"`     // 独立次数余额，共享账户次数时为0
+	CreatedAt string `json:"created_at"`
+}
+
+// UserIP 用户IP白名单中的附加IP或网段
+type UserIP struct {
+	IP        string `json:"ip"`
+	CreatedAt string `json:"created_at"`
+}
+
 type KeyRecord struct {
 	Key       string `json:"key"`
+	BatchID   string `json:"batch_id"`
 	AddLimit  int    `json:"add_limit"`
 	Used      bool   `json:"used"`
 	UsedBy    string `json:"used_by"`
 	CreatedBy string `json:"created_by"`
 	CreatedAt string `json:"created_at"`
 	UsedAt    string `json:"used_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Channel   string `json:"channel,omitempty"` // 渠道/代理标签
+	Disabled  bool   `json:"disabled"`
+	MaxUses   int    `json:"max_uses"`   // 最多可被多少个用户使用
+	UsesCount int    `json:"uses_count"` // 已使用次数
+	Product   string `json:"product"`    // 卡密所属产品
+}
+
+// KeyRedemption 卡密兑换记录
+type KeyRedemption struct {
+	UserID     string `json:"user_id"`
+	RedeemedAt string `json:"redeemed_at"`
+}
+
+// 卡密列表筛选状态
+const (
+	keyStatusAll    = "all"
+	keyStatusUnused = "unused" // 尚未被兑换过
+	keyStatusUsed   = "used"   // 至少被兑换过一次
+)
+
+// KeyFilter 卡密列表筛选条件
+type KeyFilter struct {
+	Status  string
+	BatchID string
+}
+
+// 生成筛选条件对应的WHERE子句
+func (f KeyFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	switch f.Status {
+	case keyStatusUnused:
+		conds = append(conds, "uses_count = 0")
+	case keyStatusUsed:
+		conds = append(conds, "uses_count > 0")
+	}
+	if f.BatchID != "" {
+		conds = append(conds, "batch_id = ?")
+		args = append(args, f.BatchID)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// 卡密是否符合筛选条件
+func (f KeyFilter) matches(record *KeyRecord) bool {
+	switch f.Status {
+	case keyStatusUnused:
+		if record.UsesCount > 0 {
+			return false
+		}
+	case keyStatusUsed:
+		if record.UsesCount == 0 {
+			return false
+		}
+	}
+	return f.BatchID == "" || record.BatchID == f.BatchID
+}
+
+// KeyAttempt 卡密兑换失败计数
+type KeyAttempt struct {
+	Scope       string    // user:<用户ID> 或 global
+	Failures    int       // 连续失败次数
+	LastFailure time.Time // 最近一次失败时间
+	LockedUntil time.Time // 锁定截止时间，零值表示未锁定
+	AlertSent   bool      // 本轮连续失败是否已通知管理员，重新计数时清除
 }
 
-type KeyDatabase struct {
-	Keys []KeyRecord `json:"keys"`
+// KeyBatchOptions 批量生成卡密参数
+type KeyBatchOptions struct {
+	Count     int
+	AddLimit  int
+	ExpiresAt *time.Time // 为空表示永不过期
+	Channel   string
+	MaxUses   int    // 每张卡密最多可被多少个用户使用，0按1处理
+	Product   string // 卡密所属产品，为空表示默认产品
+}
+
+// LedgerEntry 用户次数变动流水
+type LedgerEntry struct {
+	UserID    string `json:"user_id"`
+	Product   string `json:"product"`
+	Delta     int    `json:"delta"`
+	Balance   int    `json:"balance"`
+	Source    string `json:"source"` // card_key 等
+	Ref       string `json:"ref"`
+	CreatedAt string `json:"created_at"`
 }
 
 type VerifyRequest struct {
-	Token string `json:"token"`
+	Token   string `json:"token"`
+	Product string `json:"product"` // 产品ID，为空表示默认产品
 }
 
 type VerifyResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	UserID  string `json:"user_id,omitempty"`
-	Limit   int    `json:"limit,omitempty"`
+	Success   bool   `json:"success"`
+	Code      string `json:"code,omitempty"` // 错误码，便于客户端区分失败原因
+	Message   string `json:"message"`
+	UserID    string `json:"user_id,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	TokenName string `json:"token_name,omitempty"` // 命名Token的名称，默认Token为空
+	Product   string `json:"product,omitempty"`    // 扣除次数的产品
 }
 
 // 简化的IP信息结构体
@@ -212,8 +407,133 @@ type Order struct {
 	OrderID     string     `json:"orderId,omitempty"`   // 易支付订单号
 	ChatID      int64      `json:"chatId,omitempty"`    // 聊天ID
 	MessageID   int        `json:"messageId,omitempty"` // 消息ID
+	Product     string     `json:"product,omitempty"`   // 充值的产品，为空表示默认产品
+}
+
+// UserStore 用户数据访问
+type UserStore interface {
+	LoadUsers() (*UserDatabase, error)
+	UserExists(userID string) (bool, error)
+	GetUser(userID string) (*UserRecord, error)
+	GetUserByToken(userID string, timestamp int64) (*UserRecord, error)
+	IPOverlaps(binding, excludeUserID string) (bool, string, error)
+	AddUser(userID, ip, token string, limit int, timestamp int64) error
+	UpdateUserLimit(userID string, addLimit int) error
+	ConsumeUserLimit(userID string) (int, error)
+	GetUserBalances(userID string) (map[string]int, error)
+	ConsumeProductLimit(userID, product string) (int, error)
+	CreditProductLimit(userID, product string, delta int, source, ref string) (int, error)
+	UpdateUserIPAndToken(userID, newIP, newToken string, timestamp int64) error
+	RevokeToken(userID string, timestamp int64, revokedBy, reason string) error
+	RotateUserToken(userID string, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error
+	ListUserIPs(userID string) (ips []UserIP, purchasedSlots int, err error)
+	AddUserIP(userID, ip string, baseSlots int) error
+	RemoveUserIP(userID, ip string) (bool, error)
+	AddIPSlots(userID string, slots, maxPurchased int) error
+	IsTokenRevoked(userID string, timestamp int64) (bool, error)
+}
+
+// KeyStore 卡密数据访问
+type KeyStore interface {
+	AddKeys(opts KeyBatchOptions, adminID int64) (batchID string, keys []KeyRecord, err error)
+	ListKeys(filter KeyFilter, offset, limit int) (keys []KeyRecord, total int, err error)
+	GetKey(key string) (*KeyRecord, error)
+	GetKeyRedemptions(key string) ([]KeyRedemption, error)
+	DisableBatch(batchID string) (int, error)
+	GetKeyAttempt(scope string) (*KeyAttempt, error)
+	SaveKeyAttempt(attempt *KeyAttempt) error
+	RecordKeyFailure(scope string, now time.Time, policy keyLockoutPolicy) (attempt *KeyAttempt, locked bool, err error)
+	MarkKeyAlertSent(scope string) (bool, error)
+	UseKey(key, userID string) (product string, addLimit int, newLimit int, err error)
+}
+
+// TokenStore 命名Token数据访问
+type TokenStore interface {
+	LoadTokens() ([]TokenRecord, error)
+	ListTokens(userID string) ([]TokenRecord, error)
+	GetToken(userID string, id int64) (*TokenRecord, error)
+	GetTokenByTimestamp(userID string, timestamp int64) (*TokenRecord, error)
+	AddToken(record *TokenRecord, maxTokens int) error
+	DeleteToken(userID string, id int64) (*TokenRecord, error)
+	UpdateTokenValue(id int64, token string, timestamp int64) error
+	RotateTokenValue(userID string, id int64, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error
+	ConsumeTokenLimit(id int64) (int, error)
+}
+
+// OrderStore 订单数据访问
+type OrderStore interface {
+	SaveOrder(order *Order) error
+	UpdateOrderStatus(payID string, status string, reallyPrice float64, payType int) error
+	UpdateOrderWithEpayInfo(payID string, epayOrderID string, reallyPrice float64, payType int) error
+	GetOrderByPayID(payID string) (*Order, error)
+	GetOrderByEpayOrderID(orderID string) (*Order, error)
+}
+
+// App 处理器依赖
+type App struct {
+	Users  UserStore
+	Keys   KeyStore
+	Tokens TokenStore
+	Orders OrderStore
+
+	IPLimiter   *rateLimiter // /verify 按客户端IP限流，nil表示不限制
+	UserLimiter *rateLimiter // /verify 按Token用户ID限流，nil表示不限制
+}
+
+// sqlDialect 不同数据库之间的SQL差异
+type sqlDialect struct {
+	forUpdate      string // 行锁子句，SQLite写事务本身互斥，无需行锁
+	numberedParams bool   // 占位符使用 $1, $2...（PostgreSQL）而非 ?
+	insertIgnore   string // 唯一键冲突时忽略的INSERT语句开头
+	onConflictSkip string // 唯一键冲突时忽略的INSERT语句结尾（PostgreSQL）
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"mysql":    {forUpdate: " FOR UPDATE", insertIgnore: "INSERT IGNORE"},
+	"sqlite":   {forUpdate: "", insertIgnore: "INSERT OR IGNORE"},
+	"postgres": {forUpdate: " FOR UPDATE", numberedParams: true, insertIgnore: "INSERT", onConflictSkip: " ON CONFLICT DO NOTHING"},
+}
+
+// 将查询中的 ? 占位符转换为当前数据库的占位符格式
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
+
+// sqlStore 基于database/sql的数据访问实现（MySQL / SQLite / PostgreSQL）
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
 }
 
+func newSQLStore(db *sql.DB, driver string) *sqlStore {
+	return &sqlStore{db: db, dialect: sqlDialects[driver]}
+}
+
+var (
+	_ UserStore  = (*sqlStore)(nil)
+	_ KeyStore   = (*sqlStore)(nil)
+	_ TokenStore = (*sqlStore)(nil)
+	_ OrderStore = (*sqlStore)(nil)
+	_ UserStore  = (*memoryStore)(nil)
+	_ KeyStore   = (*memoryStore)(nil)
+	_ TokenStore = (*memoryStore)(nil)
+	_ OrderStore = (*memoryStore)(nil)
+)
+
 var (
 	config          Config
 	userKeys        = make(map[int64][]byte)     // 缓存用户 AES 密钥
@@ -222,9 +542,71 @@ var (
 	messageTimeouts = make(map[string]*MessageTimeout) // 消息超时管理
 	epayClient      *EpayClient                        // 易支付客户端
 	orderDB         = make(map[string]*Order)          // 订单数据库 (临时，将迁移到MySQL)
-	db              *sql.DB                            // MySQL数据库连接
+	legacyTokenEnd  time.Time                          // 旧版Token兼容截止时间
+	keyring         *Keyring                           // Token主密钥环
+	trustedProxies  []*net.IPNet                       // 可信反向代理网段
+)
+
+// 读取客户端真实IP的转发头模式
+const (
+	proxyHeaderNone       = "none"
+	proxyHeaderXFF        = "xff"
+	proxyHeaderCloudflare = "cloudflare"
+	proxyHeaderRealIP     = "real-ip"
+)
+
+// Token版本
+const (
+	tokenVersionLegacy byte = 0x00 // v1: 无版本字节（首字节为时间戳最高字节），密钥由MD5(用户ID_时间戳)生成
+	tokenVersionKeyID  byte = 0x04 // v4: 版本字节 + 算法标识 + 主密钥ID，头部作为GCM附加认证数据（0x02、0x03为未发布的过渡格式）
+)
+
+// Token算法标识
+const (
+	tokenAlgLegacyMD5  byte = 0x00 // MD5密钥 + AES-256-GCM（仅v1）
+	tokenAlgHKDFAESGCM byte = 0x01 // HKDF-SHA256密钥 + AES-256-GCM
+)
+
+// 每个Token版本唯一允许的算法，算法字节来自客户端，不能用它选择密钥派生方式
+var tokenVersionAlgs = map[byte]byte{
+	tokenVersionLegacy: tokenAlgLegacyMD5,
+	tokenVersionKeyID:  tokenAlgHKDFAESGCM,
+}
+
+// 当前签发Token使用的版本和算法
+const (
+	currentTokenVersion = tokenVersionKeyID
+	currentTokenAlg     = tokenAlgHKDFAESGCM
+)
+
+// HKDF盐值，修改会导致所有已签发Token失效
+const tokenKeySalt = "BotTokenAuth/token-key/v2"
+
+// 验证错误码
+const (
+	verifyCodeTokenExpired     = "token_expired"
+	verifyCodeTokenNotYetValid = "token_not_yet_valid"
+	verifyCodeTokenRevoked     = "token_revoked"
+	verifyCodeRateLimited      = "rate_limited"
+	verifyCodeUnknownProduct   = "unknown_product"
+)
+
+var (
+	errTokenExpired     = errors.New("Token已过期")
+	errTokenNotYetValid = errors.New("Token尚未生效")
+	errTokenRevoked     = errors.New("Token已被吊销")
+	errLimitExhausted   = errors.New("使用次数不足")
+	errKeyNotFound      = errors.New("卡密不存在")
+	errIPSlotsFull      = errors.New("IP槽位已满")
+	errIPSlotsMax       = errors.New("IP槽位已达到上限")
+	errTooManyTokens    = errors.New("Token数量已达上限")
+	errTokenNameTaken   = errors.New("Token名称已存在")
+	errIPOverlap        = errors.New("IP地址与其他用户绑定的地址重叠")
 )
 
+// 主密钥最小长度
+const minMasterSecretLen = 32
+
 func init() {
 	var err error
 	chinaLocation, err = time.LoadLocation("Asia/Shanghai")
@@ -233,8 +615,214 @@ func init() {
 	}
 }
 
+// 初始化数据库连接并执行迁移
+func initDatabase() (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+
+	switch config.Database.Driver {
+	case "mysql":
+		db, err = initMySQL()
+	case "sqlite":
+		db, err = initSQLite()
+	case "postgres":
+		db, err = initPostgres()
+	default:
+		return nil, fmt.Errorf("不支持的数据库类型: %s", config.Database.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrateDatabase(db, config.Database.Driver); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// migration 一个版本化的数据库迁移
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// 迁移版本记录表，语法在所有支持的数据库中通用
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER NOT NULL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  applied_at TIMESTAMP NOT NULL
+)`
+
+// 读取内置的迁移文件（sql/migrations/<driver>/NNNN_name.sql），按版本号排序
+func loadMigrations(driver string) ([]migration, error) {
+	dir := "sql/migrations/" + driver
+	entries, err := migrationsFS.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取迁移文件失败: %v", err)
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(fileName, ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 || len(parts) != 2 {
+			return nil, fmt.Errorf("迁移文件名格式错误: %s", fileName)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("迁移版本号重复: %s, %s", other, fileName)
+		}
+		seen[version] = fileName
+
+		content, err := migrationsFS.ReadFile(dir + "/" + fileName)
+		if err != nil {
+			return nil, fmt.Errorf("读取迁移文件失败: %v", err)
+		}
+
+		migrations = append(migrations, migration{version: version, name: parts[1], sql: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// 将迁移文件拆分为单条语句并去掉注释行，语句以分号结尾，注释中不要出现分号
+func splitSQLStatements(script string) []string {
+	var statements []string
+	for _, chunk := range strings.Split(script, ";") {
+		var lines []string
+		for _, line := range strings.Split(chunk, "\n") {
+			trimmed := strings.TrimSpace(line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			statements = append(statements, strings.TrimSpace(strings.Join(lines, "\n")))
+		}
+	}
+	return statements
+}
+
+// MySQL不支持 ADD COLUMN IF NOT EXISTS 和 CREATE INDEX IF NOT EXISTS，
+// 迁移中的每条 ALTER TABLE 只能添加一列，索引用单独的 CREATE INDEX 创建
+var (
+	mysqlAddColumnRe   = regexp.MustCompile("(?i)^ALTER\\s+TABLE\\s+`?(\\w+)`?\\s+ADD\\s+COLUMN\\s+`?(\\w+)`?")
+	mysqlCreateIndexRe = regexp.MustCompile("(?i)^CREATE\\s+(?:UNIQUE\\s+)?INDEX\\s+`?(\\w+)`?\\s+ON\\s+`?(\\w+)`?")
+)
+
+// 检查MySQL迁移语句要添加的列或索引是否已存在。
+// MySQL的DDL会隐式提交，迁移中途失败时前面的DDL已经生效，重启重跑时需要跳过这些语句
+func mysqlSchemaExists(tx *sql.Tx, stmt string) (bool, error) {
+	var query string
+	var args []interface{}
+	if m := mysqlAddColumnRe.FindStringSubmatch(stmt); m != nil {
+		query = `SELECT COUNT(*) FROM information_schema.COLUMNS 
+		         WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`
+		args = []interface{}{m[1], m[2]}
+	} else if m := mysqlCreateIndexRe.FindStringSubmatch(stmt); m != nil {
+		query = `SELECT COUNT(*) FROM information_schema.STATISTICS 
+		         WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`
+		args = []interface{}{m[2], m[1]}
+	} else {
+		return false, nil
+	}
+
+	var count int
+	if err := tx.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("查询表结构失败: %v", err)
+	}
+	return count > 0, nil
+}
+
+// 执行未应用的数据库迁移；数据库结构版本高于程序支持的版本时拒绝启动
+func migrateDatabase(db *sql.DB, driver string) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return err
+	}
+
+	if _, err = db.Exec(schemaMigrationsTable); err != nil {
+		return fmt.Errorf("创建迁移记录表失败: %v", err)
+	}
+
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("查询数据库结构版本失败: %v", err)
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	if current > latest {
+		return fmt.Errorf("数据库结构版本 %d 高于程序支持的版本 %d，请升级程序后再启动", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err = applyMigration(db, driver, m); err != nil {
+			return err
+		}
+		log.Printf("[INFO] 已应用数据库迁移: %04d_%s", m.version, m.name)
+	}
+
+	log.Printf("[INFO] 数据库结构版本: %d", latest)
+	return nil
+}
+
+// 在事务中执行单个迁移并记录版本。
+// MySQL的DDL会隐式提交无法回滚，已存在的列和索引会被跳过，其余语句（建表、回填数据）需写成可重复执行
+func applyMigration(db *sql.DB, driver string, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitSQLStatements(m.sql) {
+		if driver == "mysql" {
+			exists, err := mysqlSchemaExists(tx, stmt)
+			if err != nil {
+				return fmt.Errorf("执行迁移 %04d_%s 失败: %v", m.version, m.name, err)
+			}
+			if exists {
+				log.Printf("[INFO] 迁移 %04d_%s 的结构变更已存在，跳过: %s", m.version, m.name, strings.SplitN(stmt, "\n", 2)[0])
+				continue
+			}
+		}
+		if _, err = tx.Exec(stmt); err != nil {
+			return fmt.Errorf("执行迁移 %04d_%s 失败: %v", m.version, m.name, err)
+		}
+	}
+
+	query := "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"
+	if _, err = tx.Exec(sqlDialects[driver].rebind(query), m.version, m.name, time.Now()); err != nil {
+		return fmt.Errorf("记录迁移版本失败: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+	return nil
+}
+
 // 初始化MySQL数据库连接
-func initDatabase() error {
+func initMySQL() (*sql.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
 		config.Database.User,
 		config.Database.Password,
@@ -242,15 +830,15 @@ func initDatabase() error {
 		config.Database.Port,
 		config.Database.DBName)
 
-	var err error
-	db, err = sql.Open("mysql", dsn)
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return fmt.Errorf("连接数据库失败: %v", err)
+		return nil, fmt.Errorf("连接数据库失败: %v", err)
 	}
 
 	// 测试连接
 	if err = db.Ping(); err != nil {
-		return fmt.Errorf("数据库连接测试失败: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("数据库连接测试失败: %v", err)
 	}
 
 	// 设置连接池参数
@@ -260,13 +848,72 @@ func initDatabase() error {
 
 	log.Printf("[INFO] MySQL数据库连接成功: %s:%d/%s", config.Database.Host, config.Database.Port, config.Database.DBName)
 
-	return nil
+	return db, nil
+}
+
+// 初始化SQLite数据库连接
+func initSQLite() (*sql.DB, error) {
+	if config.Database.Path == "" {
+		return nil, fmt.Errorf("未配置SQLite数据库文件路径 database.path")
+	}
+
+	// WAL模式允许读写并发；写事务以IMMEDIATE方式开始，避免并发写入时死锁
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate&_time_format=sqlite",
+		config.Database.Path)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("连接数据库失败: %v", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("数据库连接测试失败: %v", err)
+	}
+
+	log.Printf("[INFO] SQLite数据库连接成功: %s", config.Database.Path)
+
+	return db, nil
+}
+
+// 初始化PostgreSQL数据库连接
+func initPostgres() (*sql.DB, error) {
+	sslMode := config.Database.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.Database.User, config.Database.Password),
+		Host:     net.JoinHostPort(config.Database.Host, strconv.Itoa(config.Database.Port)),
+		Path:     "/" + config.Database.DBName,
+		RawQuery: url.Values{"sslmode": {sslMode}}.Encode(),
+	}
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("连接数据库失败: %v", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("数据库连接测试失败: %v", err)
+	}
+
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(25)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	log.Printf("[INFO] PostgreSQL数据库连接成功: %s:%d/%s", config.Database.Host, config.Database.Port, config.Database.DBName)
+
+	return db, nil
 }
 
-// 加载用户数据库 - 替换为MySQL版本
-func loadDatabase() (*UserDatabase, error) {
+// 加载用户数据库
+func (s *sqlStore) LoadUsers() (*UserDatabase, error) {
 	query := "SELECT user_id, ip, token, limit_count, timestamp, created_at FROM users"
-	rows, err := db.Query(query)
+	rows, err := s.db.Query(s.dialect.rebind(query))
 	if err != nil {
 		return nil, fmt.Errorf("查询用户数据失败: %v", err)
 	}
@@ -292,24 +939,24 @@ func loadDatabase() (*UserDatabase, error) {
 	return userDB, nil
 }
 
-// 检查用户是否存在 - MySQL版本
-func userExists(userID string) (bool, error) {
+// 检查用户是否存在
+func (s *sqlStore) UserExists(userID string) (bool, error) {
 	query := "SELECT COUNT(*) FROM users WHERE user_id = ?"
 	var count int
-	err := db.QueryRow(query, userID).Scan(&count)
+	err := s.db.QueryRow(s.dialect.rebind(query), userID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-// 获取用户信息 - MySQL版本
-func getUserInfo(userID string) (*UserRecord, error) {
+// 获取用户信息
+func (s *sqlStore) GetUser(userID string) (*UserRecord, error) {
 	query := "SELECT user_id, ip, token, limit_count, timestamp, created_at FROM users WHERE user_id = ?"
 	var record UserRecord
 	var createdAt time.Time
 
-	err := db.QueryRow(query, userID).Scan(&record.UserID, &record.IP, &record.Token,
+	err := s.db.QueryRow(s.dialect.rebind(query), userID).Scan(&record.UserID, &record.IP, &record.Token,
 		&record.Limit, &record.Timestamp, &createdAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -322,756 +969,3624 @@ func getUserInfo(userID string) (*UserRecord, error) {
 	return &record, nil
 }
 
-// 检查IP是否已被使用 - MySQL版本
-func ipExists(ip string) (bool, string, error) {
-	query := "SELECT user_id FROM users WHERE ip = ?"
-	var userID string
-	err := db.QueryRow(query, ip).Scan(&userID)
+// 根据Token中的用户ID和时间戳获取用户信息
+func (s *sqlStore) GetUserByToken(userID string, timestamp int64) (*UserRecord, error) {
+	query := "SELECT user_id, ip, token, limit_count, timestamp, created_at FROM users WHERE user_id = ? AND timestamp = ?"
+	var record UserRecord
+	var createdAt time.Time
+
+	err := s.db.QueryRow(s.dialect.rebind(query), userID, timestamp).Scan(&record.UserID, &record.IP, &record.Token,
+		&record.Limit, &record.Timestamp, &createdAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, "", nil
+			return nil, nil
 		}
-		return false, "", err
+		return nil, err
 	}
-	return true, userID, nil
+
+	record.CreatedAt = createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	return &record, nil
 }
 
-// 添加用户记录 - MySQL版本
-func addUserRecord(userID, ip, token string, limit int, timestamp int64) error {
-	query := `INSERT INTO users (user_id, ip, token, limit_count, timestamp, created_at) 
-			  VALUES (?, ?, ?, ?, ?, ?)`
+// 检查IP或网段是否与其他用户的绑定（含IP白名单和命名Token）重叠，返回重叠的用户ID
+func (s *sqlStore) IPOverlaps(binding, excludeUserID string) (bool, string, error) {
+	return s.ipOverlaps(s.db, binding, excludeUserID)
+}
 
-	createdAt := time.Now().In(chinaLocation)
-	_, err := db.Exec(query, userID, ip, token, limit, timestamp, createdAt)
+// *sql.DB 和 *sql.Tx 共有的查询接口
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// 逐条比较其他用户的默认Token、IP白名单和命名Token绑定的地址。网段重叠无法用索引查询，
+// 耗时随绑定总数线性增长；只在绑定和换绑IP时调用，不在验证路径上
+func (s *sqlStore) ipOverlaps(q sqlQueryer, binding, excludeUserID string) (bool, string, error) {
+	query := `SELECT user_id, ip FROM users WHERE user_id <> ?
+			  UNION ALL SELECT user_id, ip FROM user_ips WHERE user_id <> ?
+			  UNION ALL SELECT user_id, ip FROM tokens WHERE user_id <> ?`
+	rows, err := q.Query(s.dialect.rebind(query), excludeUserID, excludeUserID, excludeUserID)
 	if err != nil {
-		return fmt.Errorf("插入用户记录失败: %v", err)
+		return false, "", err
 	}
+	defer rows.Close()
 
-	log.Printf("[INFO] 用户记录已保存到MySQL: %s", userID)
-	return nil
+	for rows.Next() {
+		var userID, ip string
+		if err := rows.Scan(&userID, &ip); err != nil {
+			return false, "", err
+		}
+		if ipBindingsOverlap(binding, ip) {
+			return true, userID, nil
+		}
+	}
+	return false, "", rows.Err()
 }
 
-// 更新用户次数 - MySQL版本
-func updateUserLimit(userID string, addLimit int) error {
-	query := "UPDATE users SET limit_count = limit_count + ?, updated_at = ? WHERE user_id = ?"
-	result, err := db.Exec(query, addLimit, time.Now(), userID)
+// IP绑定锁在 app_locks 表中的名称
+const ipBindLockName = "ip_bind"
+
+// 在事务中获取IP绑定锁，串行化IP绑定的写入，避免并发的重叠绑定都通过检查。
+// 锁是数据库中的一行，事务结束时释放，多个进程共用同一数据库时同样有效；
+// 必须是事务中的第一条语句，保证所有绑定事务按相同顺序加锁
+func (s *sqlStore) lockIPBindingsTx(tx *sql.Tx) error {
+	query := "UPDATE app_locks SET locked_at = ? WHERE name = ?"
+	result, err := tx.Exec(s.dialect.rebind(query), time.Now().In(chinaLocation), ipBindLockName)
 	if err != nil {
-		return fmt.Errorf("更新用户次数失败: %v", err)
+		return fmt.Errorf("获取IP绑定锁失败: %v", err)
 	}
-
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("获取影响行数失败: %v", err)
 	}
-
 	if rowsAffected == 0 {
-		return fmt.Errorf("用户不存在")
+		return fmt.Errorf("IP绑定锁不存在，请检查数据库迁移")
 	}
+	return nil
+}
 
-	log.Printf("[INFO] 用户 %s 次数已更新: %+d", userID, addLimit)
+// 在写入绑定的事务中重新检查重叠，调用方需已通过 lockIPBindingsTx 加锁
+func (s *sqlStore) checkIPOverlapTx(tx *sql.Tx, binding, userID string) error {
+	overlap, otherUserID, err := s.ipOverlaps(tx, binding, userID)
+	if err != nil {
+		return fmt.Errorf("检查IP重叠失败: %v", err)
+	}
+	if overlap {
+		log.Printf("[WARN] 用户 %s 绑定的 %s 与用户 %s 的地址重叠", userID, binding, otherUserID)
+		return errIPOverlap
+	}
 	return nil
 }
 
-// 加载卡密数据库 - MySQL版本
-func loadKeyDatabase() (*KeyDatabase, error) {
-	query := `SELECT key_code, add_limit, used, COALESCE(used_by, ''), created_by, 
-			  created_at, COALESCE(used_at, '1970-01-01 00:00:00') 
-			  FROM card_keys ORDER BY created_at DESC`
+// 获取用户IP白名单和已购买的IP槽位数
+func (s *sqlStore) ListUserIPs(userID string) ([]UserIP, int, error) {
+	var purchased int
+	err := s.db.QueryRow(s.dialect.rebind("SELECT ip_slots FROM users WHERE user_id = ?"), userID).Scan(&purchased)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("查询IP槽位失败: %v", err)
+	}
 
-	rows, err := db.Query(query)
+	query := "SELECT ip, created_at FROM user_ips WHERE user_id = ? ORDER BY id"
+	rows, err := s.db.Query(s.dialect.rebind(query), userID)
 	if err != nil {
-		return nil, fmt.Errorf("查询卡密数据失败: %v", err)
+		return nil, 0, fmt.Errorf("查询IP白名单失败: %v", err)
 	}
 	defer rows.Close()
 
-	keyDB := &KeyDatabase{Keys: []KeyRecord{}}
-
+	var ips []UserIP
 	for rows.Next() {
-		var record KeyRecord
-		var createdAt, usedAt time.Time
-
-		err := rows.Scan(&record.Key, &record.AddLimit, &record.Used,
-			&record.UsedBy, &record.CreatedBy, &createdAt, &usedAt)
-		if err != nil {
-			log.Printf("[WARN] 扫描卡密记录失败: %v", err)
-			continue
-		}
-
-		record.CreatedAt = createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
-		if !usedAt.IsZero() && usedAt.Year() > 1970 {
-			record.UsedAt = usedAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+		var ip UserIP
+		var createdAt time.Time
+		if err := rows.Scan(&ip.IP, &createdAt); err != nil {
+			return nil, 0, fmt.Errorf("扫描IP白名单失败: %v", err)
 		}
-
-		keyDB.Keys = append(keyDB.Keys, record)
+		ip.CreatedAt = createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+		ips = append(ips, ip)
 	}
-
-	return keyDB, nil
+	return ips, purchased, rows.Err()
 }
 
-// 添加卡密 - MySQL版本
-func addKey(addLimit int, adminID int64) (string, error) {
-	key := generateKey(adminID)
-	query := `INSERT INTO card_keys (key_code, add_limit, created_by, created_at) 
-			  VALUES (?, ?, ?, ?)`
-
-	createdAt := time.Now().In(chinaLocation)
-	_, err := db.Exec(query, key, addLimit, fmt.Sprintf("%d", adminID), createdAt)
+// 添加IP白名单，主绑定IP占用一个槽位，槽位总数为 baseSlots 加上已购买的槽位
+func (s *sqlStore) AddUserIP(userID, ip string, baseSlots int) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("插入卡密失败: %v", err)
+		return fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	log.Printf("[INFO] 卡密已保存到MySQL: %s", key)
-	return key, nil
-}
+	if err := s.lockIPBindingsTx(tx); err != nil {
+		return err
+	}
 
-// 使用卡密 - MySQL版本
-func useKey(key, userID string) (int, error) {
-	// 开始事务
-	tx, err := db.Begin()
+	// 锁定用户行，避免并发添加超出槽位
+	var purchased int
+	query := "SELECT ip_slots FROM users WHERE user_id = ?" + s.dialect.forUpdate
+	err = tx.QueryRow(s.dialect.rebind(query), userID).Scan(&purchased)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("用户不存在")
+	}
 	if err != nil {
-		return 0, fmt.Errorf("开始事务失败: %v", err)
+		return fmt.Errorf("查询IP槽位失败: %v", err)
 	}
-	defer tx.Rollback()
 
-	// 查询卡密
-	var addLimit int
-	var used bool
-	query := "SELECT add_limit, used FROM card_keys WHERE key_code = ? FOR UPDATE"
-	err = tx.QueryRow(query, key).Scan(&addLimit, &used)
+	var count int
+	err = tx.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM user_ips WHERE user_id = ?"), userID).Scan(&count)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("卡密不存在")
-		}
-		return 0, fmt.Errorf("查询卡密失败: %v", err)
+		return fmt.Errorf("查询IP白名单失败: %v", err)
 	}
-
-	if used {
-		return 0, fmt.Errorf("卡密已被使用")
+	if 1+count >= baseSlots+purchased {
+		return errIPSlotsFull
+	}
+	if err := s.checkIPOverlapTx(tx, ip, userID); err != nil {
+		return err
 	}
 
-	// 更新卡密状态
-	updateQuery := "UPDATE card_keys SET used = TRUE, used_by = ?, used_at = ? WHERE key_code = ?"
-	usedAt := time.Now().In(chinaLocation)
-	_, err = tx.Exec(updateQuery, userID, usedAt, key)
-	if err != nil {
-		return 0, fmt.Errorf("更新卡密状态失败: %v", err)
+	query = "INSERT INTO user_ips (user_id, ip, created_at) VALUES (?, ?, ?)"
+	if _, err := tx.Exec(s.dialect.rebind(query), userID, ip, time.Now().In(chinaLocation)); err != nil {
+		return fmt.Errorf("添加IP白名单失败: %v", err)
 	}
 
-	// 提交事务
-	if err = tx.Commit(); err != nil {
-		return 0, fmt.Errorf("提交事务失败: %v", err)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	log.Printf("[INFO] 卡密使用成功: %s -> 用户 %s", key, userID)
-	return addLimit, nil
+	log.Printf("[INFO] 用户 %s 添加IP白名单: %s", userID, ip)
+	return nil
 }
 
-// 保存订单到数据库
-func saveOrderToDB(order *Order) error {
-	query := `INSERT INTO orders (pay_id, order_id, user_id, count, goods_name, price, 
-			  really_price, status, pay_type, pay_time, created_at, chat_id, message_id) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-	var payTime *time.Time
-	if order.PayTime != nil {
-		payTime = order.PayTime
+// 删除IP白名单
+func (s *sqlStore) RemoveUserIP(userID, ip string) (bool, error) {
+	result, err := s.db.Exec(s.dialect.rebind("DELETE FROM user_ips WHERE user_id = ? AND ip = ?"), userID, ip)
+	if err != nil {
+		return false, fmt.Errorf("删除IP白名单失败: %v", err)
 	}
 
-	_, err := db.Exec(query, order.PayID, order.OrderID, order.UserID, order.Count,
-		order.GoodsName, order.Price, order.ReallyPrice, order.Status, order.PayType,
-		payTime, order.CreateTime, order.ChatID, order.MessageID)
-
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("保存订单失败: %v", err)
+		return false, fmt.Errorf("获取影响行数失败: %v", err)
 	}
 
-	log.Printf("[INFO] 订单已保存到MySQL: %s", order.PayID)
-	return nil
+	if rowsAffected > 0 {
+		log.Printf("[INFO] 用户 %s 删除IP白名单: %s", userID, ip)
+	}
+	return rowsAffected > 0, nil
 }
 
-// 更新订单状态
-func updateOrderStatus(payID string, status string, reallyPrice float64, payType int) error {
-	query := `UPDATE orders SET status = ?, really_price = ?, pay_type = ?, 
-			  pay_time = ?, updated_at = ? WHERE pay_id = ?`
-
-	payTime := time.Now()
-	_, err := db.Exec(query, status, reallyPrice, payType, payTime, payTime, payID)
+// 增加购买的IP槽位
+func (s *sqlStore) AddIPSlots(userID string, slots, maxPurchased int) error {
+	// 条件更新保证并发完成的多个订单不会超过上限
+	query := "UPDATE users SET ip_slots = ip_slots + ?, updated_at = ? WHERE user_id = ? AND ip_slots + ? <= ?"
+	result, err := s.db.Exec(s.dialect.rebind(query), slots, time.Now(), userID, slots, maxPurchased)
 	if err != nil {
-		return fmt.Errorf("更新订单状态失败: %v", err)
+		return fmt.Errorf("更新IP槽位失败: %v", err)
 	}
 
-	log.Printf("[INFO] 订单状态已更新: %s -> %s", payID, status)
-	return nil
-}
-
-// 更新订单的易支付信息
-func updateOrderWithEpayInfo(payID string, epayOrderID string, reallyPrice float64, payType int) error {
-	query := `UPDATE orders SET order_id = ?, really_price = ?, pay_type = ?, 
-			  updated_at = ? WHERE pay_id = ?`
-
-	_, err := db.Exec(query, epayOrderID, reallyPrice, payType, time.Now(), payID)
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("更新订单易支付信息失败: %v", err)
+		return fmt.Errorf("获取影响行数失败: %v", err)
 	}
 
-	log.Printf("[INFO] 订单易支付信息已更新: %s -> OrderID: %s", payID, epayOrderID)
+	if rowsAffected == 0 {
+		exists, err := s.UserExists(userID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("用户不存在")
+		}
+		return errIPSlotsMax
+	}
+
+	log.Printf("[INFO] 用户 %s IP槽位已更新: %+d", userID, slots)
 	return nil
 }
 
-// 根据PayID获取订单
-func getOrderByPayID(payID string) (*Order, error) {
-	query := `SELECT pay_id, COALESCE(order_id, ''), user_id, count, goods_name, 
-			  price, COALESCE(really_price, 0), status, COALESCE(pay_type, 0), 
-			  created_at, pay_time, COALESCE(chat_id, 0), COALESCE(message_id, 0) 
-			  FROM orders WHERE pay_id = ?`
-
-	var order Order
-	var payTime sql.NullTime
-
-	err := db.QueryRow(query, payID).Scan(&order.PayID, &order.OrderID, &order.UserID,
-		&order.Count, &order.GoodsName, &order.Price, &order.ReallyPrice, &order.Status,
-		&order.PayType, &order.CreateTime, &payTime, &order.ChatID, &order.MessageID)
-
+// 添加用户记录
+func (s *sqlStore) AddUser(userID, ip, token string, limit int, timestamp int64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("查询订单失败: %v", err)
+		return fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	if payTime.Valid {
-		order.PayTime = &payTime.Time
+	if err := s.lockIPBindingsTx(tx); err != nil {
+		return err
 	}
 
-	return &order, nil
-}
-
-// 根据易支付OrderID获取订单
-func getOrderByEpayOrderID(orderID string) (*Order, error) {
-	query := `SELECT pay_id, COALESCE(order_id, ''), user_id, count, goods_name, 
-			  price, COALESCE(really_price, 0), status, COALESCE(pay_type, 0), 
-			  created_at, pay_time, COALESCE(chat_id, 0), COALESCE(message_id, 0) 
-			  FROM orders WHERE order_id = ?`
-
-	var order Order
-	var payTime sql.NullTime
+	if err := s.checkIPOverlapTx(tx, ip, userID); err != nil {
+		return err
+	}
 
-	err := db.QueryRow(query, orderID).Scan(&order.PayID, &order.OrderID, &order.UserID,
-		&order.Count, &order.GoodsName, &order.Price, &order.ReallyPrice, &order.Status,
-		&order.PayType, &order.CreateTime, &payTime, &order.ChatID, &order.MessageID)
+	query := `INSERT INTO users (user_id, ip, token, limit_count, timestamp, created_at) 
+			  VALUES (?, ?, ?, ?, ?, ?)`
 
+	createdAt := time.Now().In(chinaLocation)
+	_, err = tx.Exec(s.dialect.rebind(query), userID, ip, token, limit, timestamp, createdAt)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("查询订单失败: %v", err)
+		return fmt.Errorf("插入用户记录失败: %v", err)
 	}
 
-	if payTime.Valid {
-		order.PayTime = &payTime.Time
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	return &order, nil
+	log.Printf("[INFO] 用户记录已保存到数据库: %s", userID)
+	return nil
 }
 
-// 根据用户ID获取最新的待支付订单
-func getLatestPendingOrderByUserID(userID string) (*Order, error) {
-	query := `SELECT pay_id, COALESCE(order_id, ''), user_id, count, goods_name, 
-			  price, COALESCE(really_price, 0), status, COALESCE(pay_type, 0), 
-			  created_at, pay_time, COALESCE(chat_id, 0), COALESCE(message_id, 0) 
-			  FROM orders 
-			  WHERE user_id = ? AND status = 'pending' 
-			  ORDER BY created_at DESC LIMIT 1`
-
-	var order Order
-	var payTime sql.NullTime
-
-	err := db.QueryRow(query, userID).Scan(&order.PayID, &order.OrderID, &order.UserID,
-		&order.Count, &order.GoodsName, &order.Price, &order.ReallyPrice, &order.Status,
-		&order.PayType, &order.CreateTime, &payTime, &order.ChatID, &order.MessageID)
-
+// 更新用户次数
+func (s *sqlStore) UpdateUserLimit(userID string, addLimit int) error {
+	query := "UPDATE users SET limit_count = limit_count + ?, updated_at = ? WHERE user_id = ?"
+	result, err := s.db.Exec(s.dialect.rebind(query), addLimit, time.Now(), userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("查询用户最新待支付订单失败: %v", err)
+		return fmt.Errorf("更新用户次数失败: %v", err)
 	}
 
-	if payTime.Valid {
-		order.PayTime = &payTime.Time
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %v", err)
 	}
 
-	return &order, nil
-}
-
-func loadConfig() error {
-	if _, err := toml.DecodeFile("config.toml", &config); err != nil {
-		return err
+	if rowsAffected == 0 {
+		return fmt.Errorf("用户不存在")
 	}
-	log.Printf("[INFO] 配置加载成功: 端口=%d, 管理员数量=%d", config.Server.Port, len(config.Bot.AdminIDs))
-	return nil
-}
-
-func generateAESKey() ([]byte, error) {
-	key := make([]byte, 32)
-	_, err := cryptorand.Read(key)
-	return key, err
-}
 
-func generateNonce() ([]byte, error) {
-	nonce := make([]byte, 12)
-	_, err := io.ReadFull(cryptorand.Reader, nonce)
-	return nonce, err
+	log.Printf("[INFO] 用户 %s 次数已更新: %+d", userID, addLimit)
+	return nil
 }
 
-func encryptPayload(payload Payload, key []byte) (string, error) {
-	plaintext, err := json.Marshal(payload)
+// 原子扣除一次使用次数，返回扣除后的剩余次数
+func (s *sqlStore) ConsumeUserLimit(userID string) (int, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	block, err := aes.NewCipher(key)
+	// 条件更新保证次数不会被扣成负数，并发请求由行锁串行化
+	query := "UPDATE users SET limit_count = limit_count - 1, updated_at = ? WHERE user_id = ? AND limit_count > 0"
+	result, err := tx.Exec(s.dialect.rebind(query), time.Now(), userID)
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("扣除用户次数失败: %v", err)
 	}
 
-	nonce, err := generateNonce()
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		return 0, errLimitExhausted
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	var remaining int
+	err = tx.QueryRow(s.dialect.rebind("SELECT limit_count FROM users WHERE user_id = ?"), userID).Scan(&remaining)
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("查询剩余次数失败: %v", err)
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, plaintext, nil)
-
-	// 在Token前面加上时间戳（8字节）和用户ID长度信息
-	timestampBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(timestampBytes, uint64(payload.Timestamp))
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %v", err)
+	}
 
-	userIDBytes := []byte(payload.UserID)
-	userIDLen := byte(len(userIDBytes))
+	return remaining, nil
+}
 
-	// 最终格式: [timestamp(8)] + [userID_len(1)] + [userID] + [nonce(12)] + [ciphertext]
-	final := append(timestampBytes, userIDLen)
-	final = append(final, userIDBytes...)
-	final = append(final, nonce...)
-	final = append(final, ciphertext...)
+// 获取用户各产品的剩余次数，包含默认产品
+func (s *sqlStore) GetUserBalances(userID string) (map[string]int, error) {
+	balances := make(map[string]int)
 
-	return hex.EncodeToString(final), nil
-}
+	var limit int
+	err := s.db.QueryRow(s.dialect.rebind("SELECT limit_count FROM users WHERE user_id = ?"), userID).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return balances, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询用户次数失败: %v", err)
+	}
+	balances[defaultProductID] = limit
 
-func decryptToken(tokenHex string, key []byte) (*Payload, error) {
-	data, err := hex.DecodeString(tokenHex)
+	rows, err := s.db.Query(s.dialect.rebind("SELECT product, limit_count FROM user_balances WHERE user_id = ?"), userID)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("查询产品余额失败: %v", err)
 	}
+	defer rows.Close()
 
-	if len(data) < 12 {
-		return nil, fmt.Errorf("token太短")
+	for rows.Next() {
+		var product string
+		if err := rows.Scan(&product, &limit); err != nil {
+			return nil, fmt.Errorf("扫描产品余额失败: %v", err)
+		}
+		balances[product] = limit
 	}
+	return balances, rows.Err()
+}
 
-	nonce := data[:12]
-	ciphertext := data[12:]
+// 原子扣除指定产品的一次使用次数，返回扣除后的剩余次数
+// 用户首次使用产品时先在同一事务中按产品默认次数开通余额，与兑换、充值走同一创建路径
+func (s *sqlStore) ConsumeProductLimit(userID, product string) (int, error) {
+	if product == defaultProductID {
+		return s.ConsumeUserLimit(userID)
+	}
 
-	block, err := aes.NewCipher(key)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	aesgcm, err := cipher.NewGCM(block)
+	now := time.Now().In(chinaLocation)
+	query := "UPDATE user_balances SET limit_count = limit_count - 1, updated_at = ? WHERE user_id = ? AND product = ? AND limit_count > 0"
+	result, err := tx.Exec(s.dialect.rebind(query), now, userID, product)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("扣除产品次数失败: %v", err)
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		var exists int
+		err = tx.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM user_balances WHERE user_id = ? AND product = ?"), userID, product).Scan(&exists)
+		if err != nil {
+			return 0, fmt.Errorf("查询产品余额失败: %v", err)
+		}
+		if exists > 0 || productDefaultLimit(product) <= 0 {
+			return 0, errLimitExhausted
+		}
+		if _, err = s.creditProductTx(tx, userID, product, 0, "default_grant", "", now); err != nil {
+			return 0, err
+		}
+		if result, err = tx.Exec(s.dialect.rebind(query), now, userID, product); err != nil {
+			return 0, fmt.Errorf("扣除产品次数失败: %v", err)
+		}
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("获取影响行数失败: %v", err)
+		}
+		if rowsAffected == 0 {
+			return 0, errLimitExhausted
+		}
 	}
 
-	var payload Payload
-	err = json.Unmarshal(plaintext, &payload)
-	return &payload, err
+	var remaining int
+	err = tx.QueryRow(s.dialect.rebind("SELECT limit_count FROM user_balances WHERE user_id = ? AND product = ?"), userID, product).Scan(&remaining)
+	if err != nil {
+		return 0, fmt.Errorf("查询剩余次数失败: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	return remaining, nil
 }
 
-// 检查是否为局域网地址
-func isPrivateIP(ip string) bool {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return false
+// 增加用户指定产品的次数并记录流水，返回增加后的余额
+func (s *sqlStore) CreditProductLimit(userID, product string, delta int, source, ref string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	// 检查常见的私有网络地址段
-	privateRanges := []string{
-		"10.0.0.0/8",     // 10.0.0.0 - 10.255.255.255
-		"172.16.0.0/12",  // 172.16.0.0 - 172.31.255.255
-		"192.168.0.0/16", // 192.168.0.0 - 192.168.255.255
-		"127.0.0.0/8",    // 127.0.0.0 - 127.255.255.255 (localhost)
+	balance, err := s.creditProductTx(tx, userID, product, delta, source, ref, time.Now().In(chinaLocation))
+	if err != nil {
+		return 0, err
 	}
 
-	for _, cidr := range privateRanges {
-		_, network, err := net.ParseCIDR(cidr)
-		if err != nil {
-			continue
-		}
-		if network.Contains(parsedIP) {
-			return true
-		}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %v", err)
 	}
-	return false
+
+	log.Printf("[INFO] 用户 %s 产品 %s 次数已更新: %+d", userID, product, delta)
+	return balance, nil
 }
 
-// 验证IP地址（必须是有效的公网IP）
-func isValidPublicIP(ip string) bool {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return false
-	}
-	return !isPrivateIP(ip)
+// 卡密查询列，与 scanKeyRecord 对应
+const keyColumns = `key_code, COALESCE(batch_id, ''), add_limit, used, COALESCE(used_by, ''), created_by, 
+			  created_at, used_at, expires_at, COALESCE(channel, ''), disabled, max_uses, uses_count, product`
+
+// *sql.Row 和 *sql.Rows 共有的扫描接口
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-// 获取客户端真实IP
-func getRealIP(c *gin.Context) string {
-	// 优先从 X-Forwarded-For 获取
-	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			clientIP := strings.TrimSpace(ips[0])
-			log.Printf("[DEBUG] 从X-Forwarded-For获取IP: %s", clientIP)
-			return clientIP
-		}
-	}
+// 扫描一行卡密记录
+func scanKeyRecord(row rowScanner) (KeyRecord, error) {
+	var record KeyRecord
+	var createdAt time.Time
+	var usedAt, expiresAt sql.NullTime
 
-	// 从 X-Real-IP 获取
-	if xri := c.GetHeader("X-Real-IP"); xri != "" {
-		clientIP := strings.TrimSpace(xri)
-		log.Printf("[DEBUG] 从X-Real-IP获取IP: %s", clientIP)
-		return clientIP
+	err := row.Scan(&record.Key, &record.BatchID, &record.AddLimit, &record.Used,
+		&record.UsedBy, &record.CreatedBy, &createdAt, &usedAt, &expiresAt,
+		&record.Channel, &record.Disabled, &record.MaxUses, &record.UsesCount, &record.Product)
+	if err != nil {
+		return record, err
 	}
 
-	// 从 CF-Connecting-IP 获取（Cloudflare）
-	if cfIP := c.GetHeader("CF-Connecting-IP"); cfIP != "" {
-		clientIP := strings.TrimSpace(cfIP)
-		log.Printf("[DEBUG] 从CF-Connecting-IP获取IP: %s", clientIP)
-		return clientIP
+	record.CreatedAt = createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	if usedAt.Valid {
+		record.UsedAt = usedAt.Time.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
 	}
-
-	// 最后从 RemoteAddr 获取
-	if ip, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
-		log.Printf("[DEBUG] 从RemoteAddr获取IP: %s", ip)
-		return ip
+	if expiresAt.Valid {
+		record.ExpiresAt = expiresAt.Time.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
 	}
-
-	clientIP := c.ClientIP()
-	log.Printf("[DEBUG] 从ClientIP()获取IP: %s", clientIP)
-	return clientIP
+	return record, nil
 }
 
-// 修改验证处理函数，确保剩余次数为0时也正确返回
-func verifyHandler(c *gin.Context) {
-	log.Printf("[DEBUG] 验证接口被调用: %s %s", c.Request.Method, c.Request.URL.Path)
+// 分页查询卡密，返回当前页卡密和符合条件的总数
+func (s *sqlStore) ListKeys(filter KeyFilter, offset, limit int) ([]KeyRecord, int, error) {
+	where, args := filter.where()
 
-	var req VerifyRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		log.Printf("[WARN] 验证请求格式错误: %v", err)
-		c.JSON(http.StatusBadRequest, VerifyResponse{
-			Success: false,
-			Message: "请求格式错误: " + err.Error(),
-		})
-		return
-	}
-
-	log.Printf("[DEBUG] 解析请求成功，Token长度: %d", len(req.Token))
-
-	// 获取请求者真实IP
-	clientIP := getRealIP(c)
-	log.Printf("[INFO] 收到验证请求: 客户端IP=%s", clientIP)
-
-	// 验证IP是否为有效的公网IP
-	if !isValidPublicIP(clientIP) {
-		log.Printf("[WARN] 客户端IP无效或为内网IP: %s", clientIP)
-		c.JSON(http.StatusBadRequest, VerifyResponse{
-			Success: false,
-			Message: "无法获取有效的公网IP",
-		})
-		return
+	var total int
+	err := s.db.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM card_keys"+where), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("查询卡密数量失败: %v", err)
 	}
 
-	// 验证Token格式
-	if _, err := hex.DecodeString(req.Token); err != nil {
-		log.Printf("[WARN] Token格式无效: %v", err)
-		c.JSON(http.StatusBadRequest, VerifyResponse{
-			Success: false,
-			Message: "Token格式无效",
-		})
-		return
+	query := "SELECT " + keyColumns + " FROM card_keys" + where + " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	rows, err := s.db.Query(s.dialect.rebind(query), append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("查询卡密数据失败: %v", err)
 	}
+	defer rows.Close()
 
-	// 解密和验证Token
-	payload, matchedRecord, err := decryptAndValidateToken(req.Token, clientIP)
-	if err != nil {
-		log.Printf("[WARN] Token验证失败: %v", err)
-		c.JSON(http.StatusUnauthorized, VerifyResponse{
-			Success: false,
-			Message: "Token无效或IP不匹配",
-		})
-		return
+	keys := []KeyRecord{}
+	for rows.Next() {
+		record, err := scanKeyRecord(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("扫描卡密记录失败: %v", err)
+		}
+		keys = append(keys, record)
 	}
 
-	log.Printf("[INFO] Token验证成功: 用户ID=%s, IP匹配", payload.UserID)
+	return keys, total, rows.Err()
+}
 
-	// 检查用户剩余次数
-	if matchedRecord.Limit <= 0 {
-		log.Printf("[WARN] 用户 %s 次数不足，剩余: %d", matchedRecord.UserID, matchedRecord.Limit)
-		c.JSON(http.StatusForbidden, VerifyResponse{
-			Success: false,
-			Message: "使用次数不足",
-			UserID:  matchedRecord.UserID,
-			Limit:   0, // 明确设置为0，而不是使用matchedRecord.Limit
-		})
-		return
+// 根据卡密获取卡密记录
+func (s *sqlStore) GetKey(key string) (*KeyRecord, error) {
+	query := "SELECT " + keyColumns + " FROM card_keys WHERE key_code = ?"
+	record, err := scanKeyRecord(s.db.QueryRow(s.dialect.rebind(query), key))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("查询卡密失败: %v", err)
 	}
+	return &record, nil
+}
 
-	// 验证成功，扣除一次使用次数
-	err = updateUserLimit(matchedRecord.UserID, -1)
+// 获取卡密的兑换记录
+func (s *sqlStore) GetKeyRedemptions(key string) ([]KeyRedemption, error) {
+	query := "SELECT user_id, redeemed_at FROM key_redemptions WHERE key_code = ? ORDER BY redeemed_at"
+	rows, err := s.db.Query(s.dialect.rebind(query), key)
 	if err != nil {
-		log.Printf("[ERROR] 更新用户次数失败: %v", err)
-		c.JSON(http.StatusInternalServerError, VerifyResponse{
-			Success: false,
-			Message: "系统错误",
-		})
-		return
+		return nil, fmt.Errorf("查询兑换记录失败: %v", err)
 	}
+	defer rows.Close()
 
-	// 计算扣费后的剩余次数
-	newLimit := matchedRecord.Limit - 1
-
-	log.Printf("[INFO] 验证完全成功: 用户=%s, 解密IP=%s, 请求IP=%s, 剩余次数=%d",
-		matchedRecord.UserID, payload.IP, clientIP, newLimit)
+	redemptions := []KeyRedemption{}
+	for rows.Next() {
+		var redemption KeyRedemption
+		var redeemedAt time.Time
+		if err := rows.Scan(&redemption.UserID, &redeemedAt); err != nil {
+			return nil, fmt.Errorf("扫描兑换记录失败: %v", err)
+		}
+		redemption.RedeemedAt = redeemedAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+		redemptions = append(redemptions, redemption)
+	}
 
-	c.JSON(http.StatusOK, VerifyResponse{
-		Success: true,
-		Message: "验证成功",
-		UserID:  matchedRecord.UserID,
-		Limit:   newLimit,
-	})
+	return redemptions, rows.Err()
 }
 
-// 新的解密和验证函数
-func decryptAndValidateToken(tokenHex string, clientIP string) (*Payload, *UserRecord, error) {
-	// 解码十六进制
-	data, err := hex.DecodeString(tokenHex)
+// 在一个事务中批量添加卡密，返回批次ID和生成的卡密
+func (s *sqlStore) AddKeys(opts KeyBatchOptions, adminID int64) (string, []KeyRecord, error) {
+	batchID, err := generateBatchID()
 	if err != nil {
-		return nil, nil, fmt.Errorf("十六进制解码失败: %v", err)
+		return "", nil, err
 	}
 
-	if len(data) < 21 { // timestamp(8) + userID_len(1) + userID(>=1) + nonce(12)
-		return nil, nil, fmt.Errorf("token太短")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	// 解析Token结构: [timestamp(8)] + [userID_len(1)] + [userID] + [nonce(12)] + [ciphertext]
-	timestamp := int64(binary.BigEndian.Uint64(data[0:8]))
-	userIDLen := int(data[8])
+	query := `INSERT INTO card_keys (key_code, batch_id, add_limit, created_by, created_at, expires_at, channel, max_uses, product) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	if len(data) < 9+userIDLen+12 {
-		return nil, nil, fmt.Errorf("token格式无效")
+	createdAt := time.Now().In(chinaLocation)
+	createdBy := fmt.Sprintf("%d", adminID)
+	var channel sql.NullString
+	if opts.Channel != "" {
+		channel = sql.NullString{String: opts.Channel, Valid: true}
 	}
 
-	userID := string(data[9 : 9+userIDLen])
-	nonce := data[9+userIDLen : 9+userIDLen+12]
-	ciphertext := data[9+userIDLen+12:]
+	keys := make([]KeyRecord, 0, opts.Count)
+	for i := 0; i < opts.Count; i++ {
+		key, err := generateKey()
+		if err != nil {
+			return "", nil, err
+		}
+
+		_, err = tx.Exec(s.dialect.rebind(query), key, batchID, opts.AddLimit, createdBy, createdAt,
+			opts.ExpiresAt, channel, opts.maxUses(), opts.product())
+		if err != nil {
+			return "", nil, fmt.Errorf("插入卡密失败: %v", err)
+		}
 
-	log.Printf("[DEBUG] 从Token解析: 用户ID=%s, 时间戳=%d", userID, timestamp)
+		keys = append(keys, newKeyRecord(key, batchID, createdBy, createdAt, opts))
+	}
 
-	// 使用解析出的用户ID和时间戳生成密钥
-	key, err := generateDeterministicKey(userID, timestamp)
-	if err != nil {
-		return nil, nil, fmt.Errorf("生成密钥失败: %v", err)
+	if err = tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	// 解密数据
-	block, err := aes.NewCipher(key)
+	log.Printf("[INFO] 卡密已保存到数据库: 批次 %s, 数量 %d", batchID, opts.Count)
+	return batchID, keys, nil
+}
+
+// 使用卡密，在同一事务中标记卡密、增加用户次数并记录流水，返回增加的次数和增加后的总次数
+func (s *sqlStore) UseKey(key, userID string) (string, int, int, error) {
+	// 开始事务
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, nil, fmt.Errorf("创建密码块失败: %v", err)
+		return "", 0, 0, fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	aesgcm, err := cipher.NewGCM(block)
+	// 查询卡密
+	var addLimit, maxUses, usesCount int
+	var used, disabled bool
+	var expiresAt sql.NullTime
+	var product string
+	query := "SELECT add_limit, used, disabled, expires_at, max_uses, uses_count, product FROM card_keys WHERE key_code = ?" + s.dialect.forUpdate
+	err = tx.QueryRow(s.dialect.rebind(query), key).Scan(&addLimit, &used, &disabled, &expiresAt, &maxUses, &usesCount, &product)
 	if err != nil {
-		return nil, nil, fmt.Errorf("创建GCM失败: %v", err)
+		if err == sql.ErrNoRows {
+			return "", 0, 0, errKeyNotFound
+		}
+		return "", 0, 0, fmt.Errorf("查询卡密失败: %v", err)
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	// 卡密行已被锁定，同一卡密的兑换在此串行执行
+	var redeemed int
+	err = tx.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM key_redemptions WHERE key_code = ? AND user_id = ?"), key, userID).Scan(&redeemed)
 	if err != nil {
-		return nil, nil, fmt.Errorf("解密失败: %v", err)
+		return "", 0, 0, fmt.Errorf("查询兑换记录失败: %v", err)
 	}
 
-	var payload Payload
-	if err := json.Unmarshal(plaintext, &payload); err != nil {
-		return nil, nil, fmt.Errorf("解析Payload失败: %v", err)
+	now := time.Now().In(chinaLocation)
+	if err = checkKeyRedeemable(used, disabled, expiresAt, maxUses, usesCount, redeemed > 0, now); err != nil {
+		return "", 0, 0, err
 	}
 
-	log.Printf("[DEBUG] 解密成功: 用户ID=%s, IP=%s, 时间戳=%d", payload.UserID, payload.IP, payload.Timestamp)
+	// 更新卡密状态，达到最大使用次数后标记为已使用
+	updateQuery := `UPDATE card_keys SET uses_count = uses_count + 1, used = ?, used_by = ?, used_at = ? 
+			  WHERE key_code = ?`
+	_, err = tx.Exec(s.dialect.rebind(updateQuery), usesCount+1 >= maxUses, userID, now, key)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("更新卡密状态失败: %v", err)
+	}
 
-	// 验证IP是否匹配
-	if payload.IP != clientIP {
-		return nil, nil, fmt.Errorf("IP不匹配: Token中IP=%s, 请求IP=%s", payload.IP, clientIP)
+	redeemQuery := "INSERT INTO key_redemptions (key_code, user_id, redeemed_at) VALUES (?, ?, ?)"
+	if _, err = tx.Exec(s.dialect.rebind(redeemQuery), key, userID, now); err != nil {
+		return "", 0, 0, fmt.Errorf("写入兑换记录失败: %v", err)
 	}
 
-	// 从数据库获取用户记录（用于检查剩余次数）
-	db, err := loadDatabase()
+	// 增加用户在卡密所属产品下的次数
+	newLimit, err := s.creditProductTx(tx, userID, product, addLimit, "card_key", key, now)
 	if err != nil {
-		return nil, nil, fmt.Errorf("加载数据库失败: %v", err)
+		return "", 0, 0, err
 	}
 
-	for _, record := range db.Records {
-		if record.UserID == userID && record.Timestamp == timestamp {
-			log.Printf("[DEBUG] 找到匹配的数据库记录")
-			return &payload, &record, nil
-		}
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		return "", 0, 0, fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	return nil, nil, fmt.Errorf("数据库中未找到匹配的记录")
+	log.Printf("[INFO] 卡密使用成功: %s -> 用户 %s, 产品 %s, 增加次数: %d", key, userID, product, addLimit)
+	return product, addLimit, newLimit, nil
 }
 
-// 生成确定性密钥（基于用户ID和时间戳）
-func generateDeterministicKey(userID string, timestamp int64) ([]byte, error) {
-	// 使用用户ID和时间戳生成确定性密钥
-	data := fmt.Sprintf("%s_%d", userID, timestamp)
-
-	hash := md5.Sum([]byte(data))
-	// 扩展到32字节
-	key := make([]byte, 32)
-	copy(key, hash[:])
-	copy(key[16:], hash[:])
-
-	return key, nil
-}
+// 作废批次中所有未使用的卡密，返回作废数量
+func (s *sqlStore) DisableBatch(batchID string) (int, error) {
+	query := "UPDATE card_keys SET disabled = TRUE WHERE batch_id = ? AND used = FALSE AND disabled = FALSE"
+	result, err := s.db.Exec(s.dialect.rebind(query), batchID)
+	if err != nil {
+		return 0, fmt.Errorf("作废卡密批次失败: %v", err)
+	}
 
-func min(a, b int) int {
-	if a < b {
-		return a
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
 	}
-	return b
+
+	log.Printf("[INFO] 卡密批次已作废: %s, 数量 %d", batchID, rowsAffected)
+	return int(rowsAffected), nil
 }
 
-// 生成卡密（基于时间戳和管理员ID的MD5）
-func generateKey(adminID int64) string {
-	now := time.Now().In(chinaLocation)
-	timestamp := now.Unix()
+// 获取卡密兑换失败计数，不存在时返回空计数
+func (s *sqlStore) GetKeyAttempt(scope string) (*KeyAttempt, error) {
+	attempt := &KeyAttempt{Scope: scope}
+	var lockedUntil sql.NullTime
 
-	// 组合时间戳和管理员ID
-	data := fmt.Sprintf("%d_%d", timestamp, adminID)
+	query := "SELECT failures, last_failure, locked_until, alert_sent FROM key_attempts WHERE scope = ?"
+	err := s.db.QueryRow(s.dialect.rebind(query), scope).Scan(&attempt.Failures, &attempt.LastFailure, &lockedUntil, &attempt.AlertSent)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return attempt, nil
+		}
+		return nil, fmt.Errorf("查询卡密失败计数失败: %v", err)
+	}
 
-	// 计算MD5
-	hash := md5.Sum([]byte(data))
-	return hex.EncodeToString(hash[:])
+	if lockedUntil.Valid {
+		attempt.LockedUntil = lockedUntil.Time
+	}
+	return attempt, nil
 }
 
-// 检查是否为管理员
-func isAdmin(userID int64) bool {
-	for _, adminID := range config.Bot.AdminIDs {
-		if adminID == userID {
-			return true
-		}
+// 原子地记录一次卡密兑换失败，返回更新后的计数和本次是否触发锁定。
+// 计数在数据库中自增，并发的失败请求不会互相覆盖
+func (s *sqlStore) RecordKeyFailure(scope string, now time.Time, policy keyLockoutPolicy) (*KeyAttempt, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("开始事务失败: %v", err)
 	}
-	return false
-}
+	defer tx.Rollback()
 
-// 创建主菜单键盘（移除取消按钮）
-func createMainMenuKeyboard(userID int64) tgbotapi.InlineKeyboardMarkup {
-	var keyboard [][]tgbotapi.InlineKeyboardButton
+	insertQuery := s.dialect.insertIgnore + " INTO key_attempts (scope, failures, last_failure) VALUES (?, 0, ?)" + s.dialect.onConflictSkip
+	if _, err = tx.Exec(s.dialect.rebind(insertQuery), scope, now); err != nil {
+		return nil, false, fmt.Errorf("插入卡密失败计数失败: %v", err)
+	}
 
-	// 普通用户按钮
-	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("🐳 获取Token", "get_token"),
-		tgbotapi.NewInlineKeyboardButtonData("🛳️ 账户信息", "account_info"),
-	))
+	// 距上次失败（或锁定结束）超过重置时长时重新计数
+	cutoff := now.Add(-policy.resetAfter)
+	resetQuery := `UPDATE key_attempts SET failures = 0, locked_until = NULL, alert_sent = ? 
+	               WHERE scope = ? AND last_failure < ? AND (locked_until IS NULL OR locked_until < ?)`
+	if _, err = tx.Exec(s.dialect.rebind(resetQuery), false, scope, cutoff, cutoff); err != nil {
+		return nil, false, fmt.Errorf("重置卡密失败计数失败: %v", err)
+	}
 
-	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("💻 使用卡密", "use_key"),
-		tgbotapi.NewInlineKeyboardButtonData("💰 充值次数", "recharge"),
-	))
+	incrQuery := "UPDATE key_attempts SET failures = failures + 1, last_failure = ? WHERE scope = ?"
+	if _, err = tx.Exec(s.dialect.rebind(incrQuery), now, scope); err != nil {
+		return nil, false, fmt.Errorf("更新卡密失败计数失败: %v", err)
+	}
 
-	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("🔥 换绑IP", "change_ip"),
-	))
+	attempt := &KeyAttempt{Scope: scope, LastFailure: now}
+	var lockedUntil sql.NullTime
+	query := "SELECT failures, locked_until, alert_sent FROM key_attempts WHERE scope = ?"
+	err = tx.QueryRow(s.dialect.rebind(query), scope).Scan(&attempt.Failures, &lockedUntil, &attempt.AlertSent)
+	if err != nil {
+		return nil, false, fmt.Errorf("查询卡密失败计数失败: %v", err)
+	}
+	if lockedUntil.Valid {
+		attempt.LockedUntil = lockedUntil.Time
+	}
 
-	// 管理员按钮
-	if isAdmin(userID) {
-		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🛠️ 管理员功能", "admin_menu"),
-		))
+	locked := false
+	if lockout, ok := policy.lockout(attempt.Failures); ok {
+		locked = true
+		attempt.LockedUntil = now.Add(lockout)
+		lockQuery := "UPDATE key_attempts SET locked_until = ? WHERE scope = ?"
+		if _, err = tx.Exec(s.dialect.rebind(lockQuery), attempt.LockedUntil, scope); err != nil {
+			return nil, false, fmt.Errorf("更新锁定时间失败: %v", err)
+		}
 	}
 
-	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	if err = tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("提交事务失败: %v", err)
+	}
+	return attempt, locked, nil
 }
 
-// 创建管理员菜单键盘（移除取消按钮）
-func createAdminMenuKeyboard() tgbotapi.InlineKeyboardMarkup {
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🎉 生成卡密", "gen_key"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-		),
+// 标记本轮连续失败已通知管理员，只有第一个标记成功的调用返回true
+func (s *sqlStore) MarkKeyAlertSent(scope string) (bool, error) {
+	query := "UPDATE key_attempts SET alert_sent = ? WHERE scope = ? AND alert_sent = ?"
+	result, err := s.db.Exec(s.dialect.rebind(query), true, scope, false)
+	if err != nil {
+		return false, fmt.Errorf("更新告警标记失败: %v", err)
 	}
 
-	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	return rowsAffected > 0, nil
 }
 
-// 创建确认键盘（移除取消按钮）
-func createConfirmKeyboard(action string) tgbotapi.InlineKeyboardMarkup {
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("✅ 确认", "confirm_"+action),
-		),
+// 保存卡密兑换失败计数
+func (s *sqlStore) SaveKeyAttempt(attempt *KeyAttempt) error {
+	var lockedUntil sql.NullTime
+	if !attempt.LockedUntil.IsZero() {
+		lockedUntil = sql.NullTime{Time: attempt.LockedUntil, Valid: true}
 	}
 
-	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
-}
-
-// 设置消息超时
-func setMessageTimeout(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	// 清除之前的超时
-	clearMessageTimeout(userID, chatID, messageID)
+	query := "UPDATE key_attempts SET failures = ?, last_failure = ?, locked_until = ?, alert_sent = ? WHERE scope = ?"
+	result, err := s.db.Exec(s.dialect.rebind(query), attempt.Failures, attempt.LastFailure, lockedUntil, attempt.AlertSent, attempt.Scope)
+	if err != nil {
+		return fmt.Errorf("更新卡密失败计数失败: %v", err)
+	}
 
-	timeoutKey := fmt.Sprintf("%d_%d_%d", userID, chatID, messageID)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
 
-	timer := time.AfterFunc(5*time.Minute, func() {
-		// 5分钟后删除消息
-		deleteMsg := tgbotapi.NewDeleteMessage(chatID, messageID)
-		bot.Request(deleteMsg)
+	insertQuery := "INSERT INTO key_attempts (scope, failures, last_failure, locked_until, alert_sent) VALUES (?, ?, ?, ?, ?)"
+	_, err = s.db.Exec(s.dialect.rebind(insertQuery), attempt.Scope, attempt.Failures, attempt.LastFailure, lockedUntil, attempt.AlertSent)
+	if err != nil {
+		return fmt.Errorf("插入卡密失败计数失败: %v", err)
+	}
+	return nil
+}
 
-		// 清理状态
-		clearUserState(userID)
-		delete(messageTimeouts, timeoutKey)
+// 在事务中增加用户次数并写入次数流水，返回变动后的总次数
+func (s *sqlStore) creditUserTx(tx *sql.Tx, userID string, delta int, source, ref string, now time.Time) (int, error) {
+	query := "UPDATE users SET limit_count = limit_count + ?, updated_at = ? WHERE user_id = ?"
+	result, err := tx.Exec(s.dialect.rebind(query), delta, now, userID)
+	if err != nil {
+		return 0, fmt.Errorf("更新用户次数失败: %v", err)
+	}
 
-		log.Printf("[INFO] 用户 %d 的消息 %d 因超时被删除", userID, messageID)
-	})
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		return 0, fmt.Errorf("用户不存在")
+	}
 
-	messageTimeouts[timeoutKey] = &MessageTimeout{
-		UserID:    userID,
-		ChatID:    chatID,
-		MessageID: messageID,
-		Timer:     timer,
+	var balance int
+	err = tx.QueryRow(s.dialect.rebind("SELECT limit_count FROM users WHERE user_id = ?"), userID).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("查询用户次数失败: %v", err)
 	}
-}
 
-// 清除消息超时
-func clearMessageTimeout(userID int64, chatID int64, messageID int) {
-	timeoutKey := fmt.Sprintf("%d_%d_%d", userID, chatID, messageID)
-	if timeout, exists := messageTimeouts[timeoutKey]; exists {
-		timeout.Timer.Stop()
-		delete(messageTimeouts, timeoutKey)
+	ledgerQuery := `INSERT INTO limit_ledger (user_id, delta, balance, source, ref, created_at) 
+			  VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(s.dialect.rebind(ledgerQuery), userID, delta, balance, source, ref, now)
+	if err != nil {
+		return 0, fmt.Errorf("写入次数流水失败: %v", err)
 	}
-}
 
-// 重置消息超时（用户有操作时调用）
-func resetMessageTimeout(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	setMessageTimeout(bot, userID, chatID, messageID)
+	return balance, nil
+}
+
+// 在事务中调整用户指定产品的次数并写入流水，默认产品使用 users 表中的次数
+func (s *sqlStore) creditProductTx(tx *sql.Tx, userID, product string, delta int, source, ref string, now time.Time) (int, error) {
+	if product == defaultProductID {
+		return s.creditUserTx(tx, userID, delta, source, ref, now)
+	}
+
+	query := "UPDATE user_balances SET limit_count = limit_count + ?, updated_at = ? WHERE user_id = ? AND product = ?"
+	result, err := tx.Exec(s.dialect.rebind(query), delta, now, userID, product)
+	if err != nil {
+		return 0, fmt.Errorf("更新产品次数失败: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		// 首次兑换或充值该产品时按产品默认次数创建余额
+		var exists int
+		err = tx.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM users WHERE user_id = ?"), userID).Scan(&exists)
+		if err != nil {
+			return 0, fmt.Errorf("查询用户失败: %v", err)
+		}
+		if exists == 0 {
+			return 0, fmt.Errorf("用户不存在")
+		}
+
+		insertQuery := s.dialect.insertIgnore + ` INTO user_balances (user_id, product, limit_count, created_at) 
+			  VALUES (?, ?, ?, ?)` + s.dialect.onConflictSkip
+		result, err = tx.Exec(s.dialect.rebind(insertQuery), userID, product, productDefaultLimit(product)+delta, now)
+		if err != nil {
+			return 0, fmt.Errorf("创建产品余额失败: %v", err)
+		}
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("获取影响行数失败: %v", err)
+		}
+		// 并发创建时余额已存在，重新累加
+		if rowsAffected == 0 {
+			if _, err = tx.Exec(s.dialect.rebind(query), delta, now, userID, product); err != nil {
+				return 0, fmt.Errorf("更新产品次数失败: %v", err)
+			}
+		}
+	}
+
+	var balance int
+	err = tx.QueryRow(s.dialect.rebind("SELECT limit_count FROM user_balances WHERE user_id = ? AND product = ?"), userID, product).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("查询产品次数失败: %v", err)
+	}
+
+	ledgerQuery := `INSERT INTO limit_ledger (user_id, product, delta, balance, source, ref, created_at) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(s.dialect.rebind(ledgerQuery), userID, product, delta, balance, source, ref, now)
+	if err != nil {
+		return 0, fmt.Errorf("写入次数流水失败: %v", err)
+	}
+
+	return balance, nil
+}
+
+// 吊销Token
+func (s *sqlStore) RevokeToken(userID string, timestamp int64, revokedBy, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.revokeTokenTx(tx, userID, timestamp, revokedBy, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	log.Printf("[INFO] 用户 %s 的Token已吊销: 时间戳=%d, 操作者=%s", userID, timestamp, revokedBy)
+	return nil
+}
+
+// 在事务中吊销Token，已吊销的Token直接视为成功
+func (s *sqlStore) revokeTokenTx(tx *sql.Tx, userID string, timestamp int64, revokedBy, reason string) error {
+	query := s.dialect.insertIgnore + ` INTO revoked_tokens (user_id, token_timestamp, revoked_by, reason, revoked_at) 
+			  VALUES (?, ?, ?, ?, ?)` + s.dialect.onConflictSkip
+
+	_, err := tx.Exec(s.dialect.rebind(query), userID, timestamp, revokedBy, reason, time.Now().In(chinaLocation))
+	if err != nil {
+		return fmt.Errorf("吊销Token失败: %v", err)
+	}
+	return nil
+}
+
+// 在一个事务中吊销用户当前Token并保存新Token，旧Token已变更时返回错误
+func (s *sqlStore) RotateUserToken(userID string, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.revokeTokenTx(tx, userID, oldTimestamp, revokedBy, reason); err != nil {
+		return err
+	}
+
+	query := "UPDATE users SET token = ?, timestamp = ?, updated_at = ? WHERE user_id = ? AND timestamp = ?"
+	result, err := tx.Exec(s.dialect.rebind(query), newToken, newTimestamp, time.Now(), userID, oldTimestamp)
+	if err != nil {
+		return fmt.Errorf("更新用户Token失败: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("用户不存在或Token已变更")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	log.Printf("[INFO] 用户 %s 的Token已重置: 旧时间戳=%d, 操作者=%s", userID, oldTimestamp, revokedBy)
+	return nil
+}
+
+// 检查Token是否已被吊销
+func (s *sqlStore) IsTokenRevoked(userID string, timestamp int64) (bool, error) {
+	query := "SELECT COUNT(*) FROM revoked_tokens WHERE user_id = ? AND token_timestamp = ?"
+	var count int
+	err := s.db.QueryRow(s.dialect.rebind(query), userID, timestamp).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// 命名Token查询列，与 scanTokenRecord 对应
+const tokenColumns = "id, user_id, name, ip, token, timestamp, own_quota, limit_count, created_at"
+
+// 扫描一行命名Token记录
+func scanTokenRecord(row rowScanner) (TokenRecord, error) {
+	var record TokenRecord
+	var createdAt time.Time
+
+	err := row.Scan(&record.ID, &record.UserID, &record.Name, &record.IP, &record.Token,
+		&record.Timestamp, &record.OwnQuota, &record.Limit, &createdAt)
+	if err != nil {
+		return record, err
+	}
+
+	record.CreatedAt = createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	return record, nil
+}
+
+// 查询命名Token列表
+func (s *sqlStore) queryTokens(query string, args ...interface{}) ([]TokenRecord, error) {
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("查询Token失败: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []TokenRecord
+	for rows.Next() {
+		record, err := scanTokenRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("扫描Token数据失败: %v", err)
+		}
+		tokens = append(tokens, record)
+	}
+	return tokens, rows.Err()
+}
+
+// 加载所有命名Token
+func (s *sqlStore) LoadTokens() ([]TokenRecord, error) {
+	return s.queryTokens("SELECT " + tokenColumns + " FROM tokens ORDER BY id")
+}
+
+// 获取用户的命名Token列表
+func (s *sqlStore) ListTokens(userID string) ([]TokenRecord, error) {
+	return s.queryTokens("SELECT "+tokenColumns+" FROM tokens WHERE user_id = ? ORDER BY id", userID)
+}
+
+// 获取用户的某个命名Token，不存在时返回nil
+func (s *sqlStore) GetToken(userID string, id int64) (*TokenRecord, error) {
+	query := "SELECT " + tokenColumns + " FROM tokens WHERE user_id = ? AND id = ?"
+	record, err := scanTokenRecord(s.db.QueryRow(s.dialect.rebind(query), userID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 根据Token中的用户ID和时间戳获取命名Token
+func (s *sqlStore) GetTokenByTimestamp(userID string, timestamp int64) (*TokenRecord, error) {
+	query := "SELECT " + tokenColumns + " FROM tokens WHERE user_id = ? AND timestamp = ?"
+	record, err := scanTokenRecord(s.db.QueryRow(s.dialect.rebind(query), userID, timestamp))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 添加命名Token，默认Token也占用一个名额；使用独立次数时从账户次数中划拨
+func (s *sqlStore) AddToken(record *TokenRecord, maxTokens int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.lockIPBindingsTx(tx); err != nil {
+		return err
+	}
+
+	// 锁定用户行，串行化同一用户的Token创建和次数划拨
+	var balance int
+	query := "SELECT limit_count FROM users WHERE user_id = ?" + s.dialect.forUpdate
+	err = tx.QueryRow(s.dialect.rebind(query), record.UserID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("用户不存在")
+	}
+	if err != nil {
+		return fmt.Errorf("查询用户次数失败: %v", err)
+	}
+
+	var count, sameName int
+	query = "SELECT COUNT(*), COALESCE(SUM(CASE WHEN name = ? THEN 1 ELSE 0 END), 0) FROM tokens WHERE user_id = ?"
+	err = tx.QueryRow(s.dialect.rebind(query), record.Name, record.UserID).Scan(&count, &sameName)
+	if err != nil {
+		return fmt.Errorf("查询Token数量失败: %v", err)
+	}
+	if sameName > 0 {
+		return errTokenNameTaken
+	}
+	if 1+count >= maxTokens {
+		return errTooManyTokens
+	}
+	if err := s.checkIPOverlapTx(tx, record.IP, record.UserID); err != nil {
+		return err
+	}
+
+	now := time.Now().In(chinaLocation)
+	if !record.OwnQuota {
+		record.Limit = 0
+	}
+	if record.Limit > 0 {
+		if balance < record.Limit {
+			return errLimitExhausted
+		}
+		if _, err := s.creditUserTx(tx, record.UserID, -record.Limit, "token_alloc", record.Name, now); err != nil {
+			return err
+		}
+	}
+
+	query = `INSERT INTO tokens (user_id, name, ip, token, timestamp, own_quota, limit_count, created_at) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(s.dialect.rebind(query), record.UserID, record.Name, record.IP, record.Token,
+		record.Timestamp, record.OwnQuota, record.Limit, now)
+	if err != nil {
+		return fmt.Errorf("插入Token记录失败: %v", err)
+	}
+
+	query = "SELECT id FROM tokens WHERE user_id = ? AND name = ?"
+	if err := tx.QueryRow(s.dialect.rebind(query), record.UserID, record.Name).Scan(&record.ID); err != nil {
+		return fmt.Errorf("查询Token记录失败: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	record.CreatedAt = now.Format("2006-01-02 15:04:05 CST")
+	log.Printf("[INFO] 用户 %s 创建Token: %s", record.UserID, record.Name)
+	return nil
+}
+
+// 删除命名Token，剩余的独立次数退回账户；不存在时返回nil
+func (s *sqlStore) DeleteToken(userID string, id int64) (*TokenRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := "SELECT " + tokenColumns + " FROM tokens WHERE user_id = ? AND id = ?" + s.dialect.forUpdate
+	record, err := scanTokenRecord(tx.QueryRow(s.dialect.rebind(query), userID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询Token记录失败: %v", err)
+	}
+
+	if _, err := tx.Exec(s.dialect.rebind("DELETE FROM tokens WHERE id = ?"), id); err != nil {
+		return nil, fmt.Errorf("删除Token记录失败: %v", err)
+	}
+
+	if record.OwnQuota && record.Limit > 0 {
+		now := time.Now().In(chinaLocation)
+		if _, err := s.creditUserTx(tx, userID, record.Limit, "token_refund", record.Name, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	log.Printf("[INFO] 用户 %s 删除Token: %s", userID, record.Name)
+	return &record, nil
+}
+
+// 更新命名Token的Token值（重新签发）
+func (s *sqlStore) UpdateTokenValue(id int64, token string, timestamp int64) error {
+	query := "UPDATE tokens SET token = ?, timestamp = ?, updated_at = ? WHERE id = ?"
+	result, err := s.db.Exec(s.dialect.rebind(query), token, timestamp, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("更新Token失败: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("Token不存在")
+	}
+	return nil
+}
+
+// 在一个事务中吊销命名Token的旧值并保存新值，旧Token已变更时返回错误
+func (s *sqlStore) RotateTokenValue(userID string, id int64, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.revokeTokenTx(tx, userID, oldTimestamp, revokedBy, reason); err != nil {
+		return err
+	}
+
+	query := "UPDATE tokens SET token = ?, timestamp = ?, updated_at = ? WHERE id = ? AND user_id = ? AND timestamp = ?"
+	result, err := tx.Exec(s.dialect.rebind(query), newToken, newTimestamp, time.Now(), id, userID, oldTimestamp)
+	if err != nil {
+		return fmt.Errorf("更新Token失败: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("Token不存在或已变更")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	log.Printf("[INFO] 用户 %s 的命名Token %d 已重置: 旧时间戳=%d, 操作者=%s", userID, id, oldTimestamp, revokedBy)
+	return nil
+}
+
+// 原子扣除命名Token的一次独立次数，返回扣除后的剩余次数
+func (s *sqlStore) ConsumeTokenLimit(id int64) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE tokens SET limit_count = limit_count - 1, updated_at = ? WHERE id = ? AND limit_count > 0"
+	result, err := tx.Exec(s.dialect.rebind(query), time.Now(), id)
+	if err != nil {
+		return 0, fmt.Errorf("扣除Token次数失败: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取影响行数失败: %v", err)
+	}
+	if rowsAffected == 0 {
+		return 0, errLimitExhausted
+	}
+
+	var remaining int
+	err = tx.QueryRow(s.dialect.rebind("SELECT limit_count FROM tokens WHERE id = ?"), id).Scan(&remaining)
+	if err != nil {
+		return 0, fmt.Errorf("查询剩余次数失败: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	return remaining, nil
+}
+
+// 保存订单到数据库
+func (s *sqlStore) SaveOrder(order *Order) error {
+	query := `INSERT INTO orders (pay_id, order_id, user_id, count, goods_name, price, 
+			  really_price, status, pay_type, pay_time, created_at, chat_id, message_id, product) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	var payTime *time.Time
+	if order.PayTime != nil {
+		payTime = order.PayTime
+	}
+	product := order.Product
+	if product == "" {
+		product = defaultProductID
+	}
+
+	_, err := s.db.Exec(s.dialect.rebind(query), order.PayID, order.OrderID, order.UserID, order.Count,
+		order.GoodsName, order.Price, order.ReallyPrice, order.Status, order.PayType,
+		payTime, order.CreateTime, order.ChatID, order.MessageID, product)
+
+	if err != nil {
+		return fmt.Errorf("保存订单失败: %v", err)
+	}
+
+	log.Printf("[INFO] 订单已保存到数据库: %s", order.PayID)
+	return nil
+}
+
+// 更新订单状态
+func (s *sqlStore) UpdateOrderStatus(payID string, status string, reallyPrice float64, payType int) error {
+	query := `UPDATE orders SET status = ?, really_price = ?, pay_type = ?, 
+			  pay_time = ?, updated_at = ? WHERE pay_id = ?`
+
+	payTime := time.Now()
+	_, err := s.db.Exec(s.dialect.rebind(query), status, reallyPrice, payType, payTime, payTime, payID)
+	if err != nil {
+		return fmt.Errorf("更新订单状态失败: %v", err)
+	}
+
+	log.Printf("[INFO] 订单状态已更新: %s -> %s", payID, status)
+	return nil
+}
+
+// 更新订单的易支付信息
+func (s *sqlStore) UpdateOrderWithEpayInfo(payID string, epayOrderID string, reallyPrice float64, payType int) error {
+	query := `UPDATE orders SET order_id = ?, really_price = ?, pay_type = ?, 
+			  updated_at = ? WHERE pay_id = ?`
+
+	_, err := s.db.Exec(s.dialect.rebind(query), epayOrderID, reallyPrice, payType, time.Now(), payID)
+	if err != nil {
+		return fmt.Errorf("更新订单易支付信息失败: %v", err)
+	}
+
+	log.Printf("[INFO] 订单易支付信息已更新: %s -> OrderID: %s", payID, epayOrderID)
+	return nil
+}
+
+// 根据PayID获取订单
+func (s *sqlStore) GetOrderByPayID(payID string) (*Order, error) {
+	query := `SELECT pay_id, COALESCE(order_id, ''), user_id, count, goods_name, 
+			  price, COALESCE(really_price, 0), status, COALESCE(pay_type, 0), 
+			  created_at, pay_time, COALESCE(chat_id, 0), COALESCE(message_id, 0), product 
+			  FROM orders WHERE pay_id = ?`
+
+	var order Order
+	var payTime sql.NullTime
+
+	err := s.db.QueryRow(s.dialect.rebind(query), payID).Scan(&order.PayID, &order.OrderID, &order.UserID,
+		&order.Count, &order.GoodsName, &order.Price, &order.ReallyPrice, &order.Status,
+		&order.PayType, &order.CreateTime, &payTime, &order.ChatID, &order.MessageID, &order.Product)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("查询订单失败: %v", err)
+	}
+
+	if payTime.Valid {
+		order.PayTime = &payTime.Time
+	}
+
+	return &order, nil
+}
+
+// 根据易支付OrderID获取订单
+func (s *sqlStore) GetOrderByEpayOrderID(orderID string) (*Order, error) {
+	query := `SELECT pay_id, COALESCE(order_id, ''), user_id, count, goods_name, 
+			  price, COALESCE(really_price, 0), status, COALESCE(pay_type, 0), 
+			  created_at, pay_time, COALESCE(chat_id, 0), COALESCE(message_id, 0), product 
+			  FROM orders WHERE order_id = ?`
+
+	var order Order
+	var payTime sql.NullTime
+
+	err := s.db.QueryRow(s.dialect.rebind(query), orderID).Scan(&order.PayID, &order.OrderID, &order.UserID,
+		&order.Count, &order.GoodsName, &order.Price, &order.ReallyPrice, &order.Status,
+		&order.PayType, &order.CreateTime, &payTime, &order.ChatID, &order.MessageID, &order.Product)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("查询订单失败: %v", err)
+	}
+
+	if payTime.Valid {
+		order.PayTime = &payTime.Time
+	}
+
+	return &order, nil
+}
+
+// memoryStore 内存数据访问实现（用于测试和无数据库运行）
+type memoryStore struct {
+	mu      sync.Mutex
+	users   map[string]*UserRecord
+	revoked map[string]bool
+	keys    map[string]*KeyRecord
+	orders  map[string]*Order
+	ledger  []LedgerEntry
+
+	redemptions map[string]bool
+	redeemLog   map[string][]KeyRedemption
+	attempts    map[string]KeyAttempt
+
+	userIPs map[string][]UserIP
+	ipSlots map[string]int
+
+	tokens      map[int64]*TokenRecord
+	nextTokenID int64
+
+	balances map[string]map[string]int // 用户ID -> 产品 -> 次数，不含默认产品
+
+	ledgerErr error // 不为nil时写入流水失败，用于测试次数变动的原子性
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:   make(map[string]*UserRecord),
+		revoked: make(map[string]bool),
+		keys:    make(map[string]*KeyRecord),
+		orders:  make(map[string]*Order),
+
+		redemptions: make(map[string]bool),
+		redeemLog:   make(map[string][]KeyRedemption),
+		attempts:    make(map[string]KeyAttempt),
+
+		userIPs: make(map[string][]UserIP),
+		ipSlots: make(map[string]int),
+
+		tokens: make(map[int64]*TokenRecord),
+
+		balances: make(map[string]map[string]int),
+	}
+}
+
+func (s *memoryStore) LoadUsers() (*UserDatabase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userDB := &UserDatabase{Records: []UserRecord{}}
+	for _, record := range s.users {
+		userDB.Records = append(userDB.Records, *record)
+	}
+	sort.Slice(userDB.Records, func(i, j int) bool {
+		return userDB.Records[i].Timestamp < userDB.Records[j].Timestamp
+	})
+	return userDB, nil
+}
+
+func (s *memoryStore) UserExists(userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.users[userID]
+	return ok, nil
+}
+
+func (s *memoryStore) GetUser(userID string) (*UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *memoryStore) GetUserByToken(userID string, timestamp int64) (*UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok || record.Timestamp != timestamp {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *memoryStore) IPOverlaps(binding, excludeUserID string) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	overlap, userID := s.ipOverlapsLocked(binding, excludeUserID)
+	return overlap, userID, nil
+}
+
+// 检查IP或网段是否与其他用户绑定的地址重叠，调用方需持有锁
+func (s *memoryStore) ipOverlapsLocked(binding, excludeUserID string) (bool, string) {
+	for _, record := range s.users {
+		if record.UserID != excludeUserID && ipBindingsOverlap(binding, record.IP) {
+			return true, record.UserID
+		}
+	}
+	for userID, ips := range s.userIPs {
+		if userID == excludeUserID {
+			continue
+		}
+		for _, ip := range ips {
+			if ipBindingsOverlap(binding, ip.IP) {
+				return true, userID
+			}
+		}
+	}
+	for _, token := range s.tokens {
+		if token.UserID != excludeUserID && ipBindingsOverlap(binding, token.IP) {
+			return true, token.UserID
+		}
+	}
+	return false, ""
+}
+
+func (s *memoryStore) ListUserIPs(userID string) ([]UserIP, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, 0, nil
+	}
+	ips := append([]UserIP(nil), s.userIPs[userID]...)
+	return ips, s.ipSlots[userID], nil
+}
+
+func (s *memoryStore) AddUserIP(userID, ip string, baseSlots int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("用户不存在")
+	}
+	if 1+len(s.userIPs[userID]) >= baseSlots+s.ipSlots[userID] {
+		return errIPSlotsFull
+	}
+	for _, existing := range s.userIPs[userID] {
+		if existing.IP == ip {
+			return fmt.Errorf("添加IP白名单失败: 已存在")
+		}
+	}
+	if overlap, _ := s.ipOverlapsLocked(ip, userID); overlap {
+		return errIPOverlap
+	}
+	s.userIPs[userID] = append(s.userIPs[userID], UserIP{
+		IP:        ip,
+		CreatedAt: time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST"),
+	})
+	return nil
+}
+
+func (s *memoryStore) RemoveUserIP(userID, ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := s.userIPs[userID]
+	for i, existing := range ips {
+		if existing.IP == ip {
+			s.userIPs[userID] = append(ips[:i:i], ips[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) AddIPSlots(userID string, slots, maxPurchased int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("用户不存在")
+	}
+	if s.ipSlots[userID]+slots > maxPurchased {
+		return errIPSlotsMax
+	}
+	s.ipSlots[userID] += slots
+	return nil
+}
+
+func (s *memoryStore) AddUser(userID, ip, token string, limit int, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; ok {
+		return fmt.Errorf("插入用户记录失败: 用户已存在")
+	}
+	if overlap, _ := s.ipOverlapsLocked(ip, userID); overlap {
+		return errIPOverlap
+	}
+
+	s.users[userID] = &UserRecord{
+		UserID:    userID,
+		IP:        ip,
+		Token:     token,
+		Limit:     limit,
+		Timestamp: timestamp,
+		CreatedAt: time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST"),
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateUserLimit(userID string, addLimit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("用户不存在")
+	}
+	record.Limit += addLimit
+	return nil
+}
+
+func (s *memoryStore) ConsumeUserLimit(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok || record.Limit <= 0 {
+		return 0, errLimitExhausted
+	}
+	record.Limit--
+	return record.Limit, nil
+}
+
+func (s *memoryStore) GetUserBalances(userID string) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	balances := make(map[string]int)
+	record, ok := s.users[userID]
+	if !ok {
+		return balances, nil
+	}
+	balances[defaultProductID] = record.Limit
+	for product, limit := range s.balances[userID] {
+		balances[product] = limit
+	}
+	return balances, nil
+}
+
+func (s *memoryStore) ConsumeProductLimit(userID, product string) (int, error) {
+	if product == defaultProductID {
+		return s.ConsumeUserLimit(userID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 用户首次使用产品时按产品默认次数开通余额，与兑换、充值走同一创建路径
+	limit, ok := s.balances[userID][product]
+	if !ok && productDefaultLimit(product) > 0 {
+		var err error
+		limit, err = s.creditProductLocked(userID, product, 0, "default_grant", "", time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST"))
+		if err != nil {
+			return 0, err
+		}
+	}
+	if limit <= 0 {
+		return 0, errLimitExhausted
+	}
+	s.balances[userID][product] = limit - 1
+	return limit - 1, nil
+}
+
+func (s *memoryStore) CreditProductLimit(userID, product string, delta int, source, ref string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.creditProductLocked(userID, product, delta, source, ref, time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST"))
+}
+
+// 调整用户指定产品的次数并记录流水，调用方需持有锁
+func (s *memoryStore) creditProductLocked(userID, product string, delta int, source, ref, now string) (int, error) {
+	if s.ledgerErr != nil {
+		return 0, fmt.Errorf("记录次数流水失败: %v", s.ledgerErr)
+	}
+
+	var balance int
+	if product == defaultProductID {
+		record, ok := s.users[userID]
+		if !ok {
+			return 0, fmt.Errorf("用户不存在")
+		}
+		record.Limit += delta
+		balance = record.Limit
+	} else {
+		if _, ok := s.users[userID]; !ok {
+			return 0, fmt.Errorf("用户不存在")
+		}
+		limit, ok := s.balances[userID][product]
+		if !ok {
+			limit = productDefaultLimit(product)
+		}
+		if s.balances[userID] == nil {
+			s.balances[userID] = make(map[string]int)
+		}
+		balance = limit + delta
+		s.balances[userID][product] = balance
+	}
+
+	s.ledger = append(s.ledger, LedgerEntry{
+		UserID:    userID,
+		Product:   product,
+		Delta:     delta,
+		Balance:   balance,
+		Source:    source,
+		Ref:       ref,
+		CreatedAt: now,
+	})
+	return balance, nil
+}
+
+func (s *memoryStore) UpdateUserIPAndToken(userID, newIP, newToken string, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("用户不存在")
+	}
+	if overlap, _ := s.ipOverlapsLocked(newIP, userID); newIP != record.IP && overlap {
+		return errIPOverlap
+	}
+	record.IP = newIP
+	record.Token = newToken
+	record.Timestamp = timestamp
+	return nil
+}
+
+func (s *memoryStore) RevokeToken(userID string, timestamp int64, revokedBy, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked[fmt.Sprintf("%s_%d", userID, timestamp)] = true
+	return nil
+}
+
+func (s *memoryStore) RotateUserToken(userID string, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.users[userID]
+	if !ok || record.Timestamp != oldTimestamp {
+		return fmt.Errorf("用户不存在或Token已变更")
+	}
+	s.revoked[fmt.Sprintf("%s_%d", userID, oldTimestamp)] = true
+	record.Token = newToken
+	record.Timestamp = newTimestamp
+	return nil
+}
+
+func (s *memoryStore) IsTokenRevoked(userID string, timestamp int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.revoked[fmt.Sprintf("%s_%d", userID, timestamp)], nil
+}
+
+// 按ID排序的命名Token副本
+func (s *memoryStore) sortedTokens(match func(*TokenRecord) bool) []TokenRecord {
+	var tokens []TokenRecord
+	for _, token := range s.tokens {
+		if match(token) {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens
+}
+
+func (s *memoryStore) LoadTokens() ([]TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedTokens(func(*TokenRecord) bool { return true }), nil
+}
+
+func (s *memoryStore) ListTokens(userID string) ([]TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedTokens(func(t *TokenRecord) bool { return t.UserID == userID }), nil
+}
+
+func (s *memoryStore) GetToken(userID string, id int64) (*TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.UserID != userID {
+		return nil, nil
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *memoryStore) GetTokenByTimestamp(userID string, timestamp int64) (*TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.Timestamp == timestamp {
+			copied := *token
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) AddToken(record *TokenRecord, maxTokens int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[record.UserID]
+	if !ok {
+		return fmt.Errorf("用户不存在")
+	}
+
+	count := 0
+	for _, token := range s.tokens {
+		if token.UserID != record.UserID {
+			continue
+		}
+		if token.Name == record.Name {
+			return errTokenNameTaken
+		}
+		count++
+	}
+	if 1+count >= maxTokens {
+		return errTooManyTokens
+	}
+	if overlap, _ := s.ipOverlapsLocked(record.IP, record.UserID); overlap {
+		return errIPOverlap
+	}
+
+	now := time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	if !record.OwnQuota {
+		record.Limit = 0
+	}
+	if record.Limit > 0 {
+		if user.Limit < record.Limit {
+			return errLimitExhausted
+		}
+		user.Limit -= record.Limit
+		s.ledger = append(s.ledger, LedgerEntry{
+			UserID:    record.UserID,
+			Product:   defaultProductID,
+			Delta:     -record.Limit,
+			Balance:   user.Limit,
+			Source:    "token_alloc",
+			Ref:       record.Name,
+			CreatedAt: now,
+		})
+	}
+
+	s.nextTokenID++
+	record.ID = s.nextTokenID
+	record.CreatedAt = now
+	copied := *record
+	s.tokens[record.ID] = &copied
+	return nil
+}
+
+func (s *memoryStore) DeleteToken(userID string, id int64) (*TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.UserID != userID {
+		return nil, nil
+	}
+	delete(s.tokens, id)
+
+	if user, ok := s.users[userID]; ok && token.OwnQuota && token.Limit > 0 {
+		user.Limit += token.Limit
+		s.ledger = append(s.ledger, LedgerEntry{
+			UserID:    userID,
+			Product:   defaultProductID,
+			Delta:     token.Limit,
+			Balance:   user.Limit,
+			Source:    "token_refund",
+			Ref:       token.Name,
+			CreatedAt: time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST"),
+		})
+	}
+	return token, nil
+}
+
+func (s *memoryStore) UpdateTokenValue(id int64, token string, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.tokens[id]
+	if !ok {
+		return fmt.Errorf("Token不存在")
+	}
+	record.Token = token
+	record.Timestamp = timestamp
+	return nil
+}
+
+func (s *memoryStore) RotateTokenValue(userID string, id int64, oldTimestamp int64, newToken string, newTimestamp int64, revokedBy, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.tokens[id]
+	if !ok || record.UserID != userID || record.Timestamp != oldTimestamp {
+		return fmt.Errorf("Token不存在或已变更")
+	}
+	s.revoked[fmt.Sprintf("%s_%d", userID, oldTimestamp)] = true
+	record.Token = newToken
+	record.Timestamp = newTimestamp
+	return nil
+}
+
+func (s *memoryStore) ConsumeTokenLimit(id int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.tokens[id]
+	if !ok || record.Limit <= 0 {
+		return 0, errLimitExhausted
+	}
+	record.Limit--
+	return record.Limit, nil
+}
+
+func (s *memoryStore) AddKeys(opts KeyBatchOptions, adminID int64) (string, []KeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batchID, err := generateBatchID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	createdAt := time.Now().In(chinaLocation)
+	keys := make([]KeyRecord, 0, opts.Count)
+	for i := 0; i < opts.Count; i++ {
+		key, err := generateKey()
+		if err != nil {
+			return "", nil, err
+		}
+		if _, ok := s.keys[key]; ok {
+			return "", nil, fmt.Errorf("插入卡密失败: 卡密已存在")
+		}
+		keys = append(keys, newKeyRecord(key, batchID, fmt.Sprintf("%d", adminID), createdAt, opts))
+	}
+
+	for i := range keys {
+		record := keys[i]
+		s.keys[record.Key] = &record
+	}
+	return batchID, keys, nil
+}
+
+func (s *memoryStore) ListKeys(filter KeyFilter, offset, limit int) ([]KeyRecord, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := []KeyRecord{}
+	for _, record := range s.keys {
+		if filter.matches(record) {
+			matched = append(matched, *record)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedAt != matched[j].CreatedAt {
+			return matched[i].CreatedAt > matched[j].CreatedAt
+		}
+		return matched[i].Key < matched[j].Key
+	})
+
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return matched[offset:end], total, nil
+}
+
+func (s *memoryStore) GetKey(key string) (*KeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *memoryStore) GetKeyRedemptions(key string) ([]KeyRedemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]KeyRedemption{}, s.redeemLog[key]...), nil
+}
+
+func (s *memoryStore) DisableBatch(batchID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	disabled := 0
+	for _, record := range s.keys {
+		if record.BatchID == batchID && !record.Used && !record.Disabled {
+			record.Disabled = true
+			disabled++
+		}
+	}
+	return disabled, nil
+}
+
+func (s *memoryStore) UseKey(key, userID string) (string, int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.keys[key]
+	if !ok {
+		return "", 0, 0, errKeyNotFound
+	}
+
+	expiresAt, err := keyExpiresAt(record)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	redemptionKey := fmt.Sprintf("%s_%s", key, userID)
+	err = checkKeyRedeemable(record.Used, record.Disabled, expiresAt, record.MaxUses, record.UsesCount,
+		s.redemptions[redemptionKey], time.Now())
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if _, ok := s.users[userID]; !ok {
+		return "", 0, 0, fmt.Errorf("用户不存在")
+	}
+
+	// 先增加次数，失败时卡密保持未使用
+	now := time.Now().In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	newLimit, err := s.creditProductLocked(userID, record.Product, record.AddLimit, "card_key", key, now)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	record.UsesCount++
+	record.Used = record.UsesCount >= record.MaxUses
+	record.UsedBy = userID
+	record.UsedAt = now
+	s.redemptions[redemptionKey] = true
+	s.redeemLog[key] = append(s.redeemLog[key], KeyRedemption{UserID: userID, RedeemedAt: now})
+	return record.Product, record.AddLimit, newLimit, nil
+}
+
+func (s *memoryStore) GetKeyAttempt(scope string) (*KeyAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, ok := s.attempts[scope]
+	if !ok {
+		attempt = KeyAttempt{Scope: scope}
+	}
+	return &attempt, nil
+}
+
+func (s *memoryStore) SaveKeyAttempt(attempt *KeyAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts[attempt.Scope] = *attempt
+	return nil
+}
+
+func (s *memoryStore) RecordKeyFailure(scope string, now time.Time, policy keyLockoutPolicy) (*KeyAttempt, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, ok := s.attempts[scope]
+	if !ok {
+		attempt = KeyAttempt{Scope: scope}
+	}
+	locked := attempt.recordFailure(now, policy)
+	s.attempts[scope] = attempt
+	return &attempt, locked, nil
+}
+
+func (s *memoryStore) MarkKeyAlertSent(scope string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, ok := s.attempts[scope]
+	if !ok || attempt.AlertSent {
+		return false, nil
+	}
+	attempt.AlertSent = true
+	s.attempts[scope] = attempt
+	return true, nil
+}
+
+func (s *memoryStore) SaveOrder(order *Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[order.PayID]; ok {
+		return fmt.Errorf("保存订单失败: 订单已存在")
+	}
+	copied := *order
+	if copied.Product == "" {
+		copied.Product = defaultProductID
+	}
+	s.orders[order.PayID] = &copied
+	return nil
+}
+
+func (s *memoryStore) UpdateOrderStatus(payID string, status string, reallyPrice float64, payType int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order, ok := s.orders[payID]; ok {
+		payTime := time.Now()
+		order.Status = status
+		order.ReallyPrice = reallyPrice
+		order.PayType = payType
+		order.PayTime = &payTime
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateOrderWithEpayInfo(payID string, epayOrderID string, reallyPrice float64, payType int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order, ok := s.orders[payID]; ok {
+		order.OrderID = epayOrderID
+		order.ReallyPrice = reallyPrice
+		order.PayType = payType
+	}
+	return nil
+}
+
+func (s *memoryStore) GetOrderByPayID(payID string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[payID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (s *memoryStore) GetOrderByEpayOrderID(orderID string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, order := range s.orders {
+		if order.OrderID == orderID {
+			copied := *order
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func loadConfig() error {
+	if _, err := toml.DecodeFile("config.toml", &config); err != nil {
+		return err
+	}
+
+	if config.Database.Driver == "" {
+		config.Database.Driver = "mysql"
+	}
+	// 限流速率只有未配置（0）时使用默认值，负数保留给 newRateLimiter 表示不限制
+	if config.Server.VerifyIPRate == 0 {
+		config.Server.VerifyIPRate = 60
+	}
+	if config.Server.VerifyIPBurst <= 0 {
+		config.Server.VerifyIPBurst = 20
+	}
+	if config.Server.VerifyUserRate == 0 {
+		config.Server.VerifyUserRate = 120
+	}
+	if config.Server.VerifyUserBurst <= 0 {
+		config.Server.VerifyUserBurst = 30
+	}
+	if config.Limits.BindIPv4Prefix <= 0 {
+		config.Limits.BindIPv4Prefix = 24
+	}
+	if config.Limits.BindIPv6Prefix <= 0 {
+		config.Limits.BindIPv6Prefix = 64
+	}
+	if config.Limits.IPSlots <= 0 {
+		config.Limits.IPSlots = 1
+	}
+	if config.Limits.MaxIPSlots <= 0 {
+		config.Limits.MaxIPSlots = 5
+	}
+	if config.Limits.MaxIPSlots < config.Limits.IPSlots {
+		config.Limits.MaxIPSlots = config.Limits.IPSlots
+	}
+	if config.Payment.IPSlotPrice <= 0 {
+		config.Payment.IPSlotPrice = 1.0
+	}
+	if config.Payment.ChangeIPPrice <= 0 {
+		config.Payment.ChangeIPPrice = 1.0
+	}
+	if config.Limits.MaxTokens <= 0 {
+		config.Limits.MaxTokens = 5
+	}
+	products, err := normalizeProducts(config.Products)
+	if err != nil {
+		return err
+	}
+	config.Products = products
+	if config.Limits.BindIPv4Prefix > 32 || config.Limits.BindIPv6Prefix > 128 {
+		return fmt.Errorf("limits.bind_ipv4_prefix 不能大于32，limits.bind_ipv6_prefix 不能大于128")
+	}
+	if config.Server.ProxyHeader == "" {
+		config.Server.ProxyHeader = proxyHeaderNone
+	}
+	switch config.Server.ProxyHeader {
+	case proxyHeaderNone, proxyHeaderXFF, proxyHeaderCloudflare, proxyHeaderRealIP:
+	default:
+		return fmt.Errorf("server.proxy_header 无效: %q", config.Server.ProxyHeader)
+	}
+	nets, err := parseTrustedProxies(config.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	if config.Limits.KeyFreeFailures <= 0 {
+		config.Limits.KeyFreeFailures = 5
+	}
+	if config.Limits.KeyLockoutMinutes <= 0 {
+		config.Limits.KeyLockoutMinutes = 1
+	}
+	if config.Limits.KeyAlertFailures <= 0 {
+		config.Limits.KeyAlertFailures = 10
+	}
+	if config.Limits.KeyGlobalFailures <= 0 {
+		config.Limits.KeyGlobalFailures = 100
+	}
+
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	keyring = kr
+
+	if config.Crypto.LegacyTokensUntil != "" {
+		until, err := time.ParseInLocation("2006-01-02", config.Crypto.LegacyTokensUntil, chinaLocation)
+		if err != nil {
+			return fmt.Errorf("crypto.legacy_tokens_until 格式错误: %v", err)
+		}
+		// 截止日期当天仍然有效
+		legacyTokenEnd = until.AddDate(0, 0, 1)
+		log.Printf("[INFO] 旧版Token兼容至: %s", config.Crypto.LegacyTokensUntil)
+	}
+	log.Printf("[INFO] 配置加载成功: 端口=%d, 管理员数量=%d", config.Server.Port, len(config.Bot.AdminIDs))
+	return nil
+}
+
+// 校验产品配置，未配置默认产品时使用 limits.default_limit 和 payment.price_per_use 生成，默认产品排在第一位
+func normalizeProducts(entries []ProductConfig) ([]ProductConfig, error) {
+	products := []ProductConfig{{
+		ID:           defaultProductID,
+		Name:         "默认",
+		DefaultLimit: config.Limits.DefaultLimit,
+		PricePerUse:  config.Payment.PricePerUse,
+	}}
+
+	seen := make(map[string]bool)
+	for _, p := range entries {
+		if !validProductID(p.ID) {
+			return nil, fmt.Errorf("products.id 无效: %q（只能包含小写字母、数字和 -，最多32个字符）", p.ID)
+		}
+		if seen[p.ID] {
+			return nil, fmt.Errorf("products.id 重复: %s", p.ID)
+		}
+		seen[p.ID] = true
+		if p.DefaultLimit < 0 || p.PricePerUse < 0 {
+			return nil, fmt.Errorf("产品 %s 的 default_limit 和 price_per_use 不能为负数", p.ID)
+		}
+		if p.Name == "" {
+			p.Name = p.ID
+		}
+
+		if p.ID == defaultProductID {
+			products[0] = p
+			continue
+		}
+		products = append(products, p)
+	}
+
+	// 默认产品的配置同步回原有字段，兼容只读取这两个字段的代码
+	config.Limits.DefaultLimit = products[0].DefaultLimit
+	config.Payment.PricePerUse = products[0].PricePerUse
+	return products, nil
+}
+
+func validProductID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// 按ID查找产品，空ID表示默认产品
+func findProduct(id string) *ProductConfig {
+	if id == "" {
+		id = defaultProductID
+	}
+	for i := range config.Products {
+		if config.Products[i].ID == id {
+			return &config.Products[i]
+		}
+	}
+	return nil
+}
+
+// 产品的默认次数，未配置的产品为0
+func productDefaultLimit(id string) int {
+	if p := findProduct(id); p != nil {
+		return p.DefaultLimit
+	}
+	return 0
+}
+
+// 产品显示名称，产品已从配置中删除时显示ID
+func productName(id string) string {
+	if p := findProduct(id); p != nil {
+		return p.Name
+	}
+	return id
+}
+
+// 配置了多个产品时显示的产品信息行
+func productLine(id string) string {
+	if len(config.Products) <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("📦 产品: %s\n", productName(id))
+}
+
+// 加载主密钥环（配置文件中的密钥 + 密钥文件中的密钥）
+func loadKeyring() (*Keyring, error) {
+	kr := &Keyring{
+		keys:     make(map[string][]byte),
+		activeID: config.Crypto.ActiveKey,
+	}
+
+	// 默认主密钥使用空ID，对应密钥ID为空的Token
+	if config.Crypto.MasterSecret != "" {
+		if len(config.Crypto.MasterSecret) < minMasterSecretLen {
+			return nil, fmt.Errorf("crypto.master_secret 长度不足 %d 个字符", minMasterSecretLen)
+		}
+		kr.keys[""] = []byte(config.Crypto.MasterSecret)
+	}
+
+	keys := config.Crypto.Keys
+	if config.Crypto.KeyFile != "" {
+		var kf KeyFile
+		if _, err := toml.DecodeFile(config.Crypto.KeyFile, &kf); err != nil {
+			return nil, fmt.Errorf("加载密钥文件失败: %v", err)
+		}
+		keys = append(keys, kf.Keys...)
+		if kf.ActiveKey != "" {
+			kr.activeID = kf.ActiveKey
+		}
+	}
+
+	for _, k := range keys {
+		if k.ID == "" || len(k.ID) > 255 {
+			return nil, fmt.Errorf("密钥ID无效: %q", k.ID)
+		}
+		if len(k.Secret) < minMasterSecretLen {
+			return nil, fmt.Errorf("密钥 %s 长度不足 %d 个字符", k.ID, minMasterSecretLen)
+		}
+		if _, exists := kr.keys[k.ID]; exists {
+			return nil, fmt.Errorf("密钥ID重复: %s", k.ID)
+		}
+		kr.keys[k.ID] = []byte(k.Secret)
+	}
+
+	if _, ok := kr.keys[kr.activeID]; !ok {
+		if kr.activeID == "" {
+			return nil, fmt.Errorf("crypto.master_secret 未配置且未指定 crypto.active_key")
+		}
+		return nil, fmt.Errorf("当前密钥 %s 不存在", kr.activeID)
+	}
+
+	log.Printf("[INFO] 密钥环加载成功: 密钥数量=%d, 当前密钥=%q", len(kr.keys), kr.activeID)
+	return kr, nil
+}
+
+// 获取指定ID的密钥
+func (kr *Keyring) Get(id string) ([]byte, bool) {
+	secret, ok := kr.keys[id]
+	return secret, ok
+}
+
+// 获取当前用于签发的密钥
+func (kr *Keyring) Active() (string, []byte) {
+	return kr.activeID, kr.keys[kr.activeID]
+}
+
+func generateAESKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := cryptorand.Read(key)
+	return key, err
+}
+
+func generateNonce() ([]byte, error) {
+	nonce := make([]byte, 12)
+	_, err := io.ReadFull(cryptorand.Reader, nonce)
+	return nonce, err
+}
+
+func encryptPayload(payload Payload, keyID string, key []byte) (string, error) {
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	userIDBytes := []byte(payload.UserID)
+	if len(userIDBytes) > 255 {
+		return "", fmt.Errorf("用户ID过长")
+	}
+
+	// 头部: [version(1)] + [alg(1)] + [keyID_len(1)] + [keyID] + [timestamp(8)] + [userID_len(1)] + [userID]
+	header := []byte{currentTokenVersion, currentTokenAlg, byte(len(keyID))}
+	header = append(header, keyID...)
+	timestampBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestampBytes, uint64(payload.Timestamp))
+	header = append(header, timestampBytes...)
+	header = append(header, byte(len(userIDBytes)))
+	header = append(header, userIDBytes...)
+
+	// 头部作为附加认证数据，篡改头部会导致解密失败
+	ciphertext := aesgcm.Seal(nil, nonce, plaintext, header)
+
+	// 最终格式: [header] + [nonce(12)] + [ciphertext]
+	final := append(header, nonce...)
+	final = append(final, ciphertext...)
+
+	return hex.EncodeToString(final), nil
+}
+
+// Token信封，即解析后的Token头部和密文
+type tokenEnvelope struct {
+	Version    byte
+	Alg        byte
+	KeyID      string // 主密钥ID，v1 Token为空
+	Timestamp  int64
+	UserID     string
+	AAD        []byte // 附加认证数据，旧版Token为nil
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Token解析器注册表（按版本字节）
+var tokenParsers = map[byte]func(data []byte) (*tokenEnvelope, error){
+	tokenVersionLegacy: parseLegacyToken,
+	tokenVersionKeyID:  parseV4Token,
+}
+
+// 解析Token信封
+func parseToken(data []byte) (*tokenEnvelope, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("token为空")
+	}
+
+	parser, ok := tokenParsers[data[0]]
+	if !ok {
+		return nil, fmt.Errorf("未知的Token版本: %d", data[0])
+	}
+	env, err := parser(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// 在派生密钥之前拒绝与版本不匹配的算法，防止降级到MD5密钥
+	if env.Alg != tokenVersionAlgs[env.Version] {
+		return nil, fmt.Errorf("Token版本 %d 不支持算法 %d", env.Version, env.Alg)
+	}
+	return env, nil
+}
+
+// 解析 [timestamp(8)] + [userID_len(1)] + [userID] + [nonce(12)] + [ciphertext]，返回头部长度
+func parseTokenBody(data []byte, env *tokenEnvelope) (int, error) {
+	if len(data) < 8+1+1+12 { // timestamp(8) + userID_len(1) + userID(>=1) + nonce(12)
+		return 0, fmt.Errorf("token太短")
+	}
+
+	env.Timestamp = int64(binary.BigEndian.Uint64(data[0:8]))
+	userIDLen := int(data[8])
+
+	if userIDLen == 0 || len(data) < 9+userIDLen+12 {
+		return 0, fmt.Errorf("token格式无效")
+	}
+
+	env.UserID = string(data[9 : 9+userIDLen])
+	env.Nonce = data[9+userIDLen : 9+userIDLen+12]
+	env.Ciphertext = data[9+userIDLen+12:]
+	return 9 + userIDLen, nil
+}
+
+// v1: [timestamp(8)] + [userID_len(1)] + [userID] + [nonce(12)] + [ciphertext]
+func parseLegacyToken(data []byte) (*tokenEnvelope, error) {
+	if legacyTokenEnd.IsZero() || !time.Now().Before(legacyTokenEnd) {
+		return nil, fmt.Errorf("旧版Token已停止支持")
+	}
+
+	env := &tokenEnvelope{Version: tokenVersionLegacy, Alg: tokenAlgLegacyMD5}
+	if _, err := parseTokenBody(data, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// v4: [version(1)] + [alg(1)] + [keyID_len(1)] + [keyID] + [timestamp(8)] + [userID_len(1)] + [userID] + [nonce(12)] + [ciphertext]
+func parseV4Token(data []byte) (*tokenEnvelope, error) {
+	if len(data) < 3 || len(data) < 3+int(data[2]) {
+		return nil, fmt.Errorf("token太短")
+	}
+
+	keyIDLen := int(data[2])
+	env := &tokenEnvelope{Version: tokenVersionKeyID, Alg: data[1], KeyID: string(data[3 : 3+keyIDLen])}
+	headerLen, err := parseTokenBody(data[3+keyIDLen:], env)
+	if err != nil {
+		return nil, err
+	}
+	env.AAD = data[:3+keyIDLen+headerLen]
+	return env, nil
+}
+
+func decryptToken(tokenHex string, key []byte) (*Payload, error) {
+	data, err := hex.DecodeString(tokenHex)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 12 {
+		return nil, fmt.Errorf("token太短")
+	}
+
+	nonce := data[:12]
+	ciphertext := data[12:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload Payload
+	err = json.Unmarshal(plaintext, &payload)
+	return &payload, err
+}
+
+// 不可作为公网客户端地址的特殊用途网段（IANA IPv4/IPv6 Special-Purpose Address Registry 等）
+// IPv4映射地址（::ffff:0:0/96）不在此列：parseIP 会先转换为IPv4再按IPv4网段检查，
+// 而 net.IPNet 会把该网段当作 0.0.0.0/0 匹配所有IPv4地址
+var specialIPRanges = mustParseCIDRs(
+	// IPv4
+	"0.0.0.0/8",       // 本网络
+	"10.0.0.0/8",      // 私有网络
+	"100.64.0.0/10",   // 运营商级NAT (CGNAT)
+	"127.0.0.0/8",     // 环回地址
+	"169.254.0.0/16",  // 链路本地
+	"172.16.0.0/12",   // 私有网络
+	"192.0.0.0/24",    // IETF协议分配
+	"192.0.2.0/24",    // 文档示例 TEST-NET-1
+	"192.88.99.0/24",  // 6to4中继任播（已废弃）
+	"192.168.0.0/16",  // 私有网络
+	"198.18.0.0/15",   // 基准测试
+	"198.51.100.0/24", // 文档示例 TEST-NET-2
+	"203.0.113.0/24",  // 文档示例 TEST-NET-3
+	"224.0.0.0/4",     // 组播
+	"240.0.0.0/4",     // 保留地址（含受限广播 255.255.255.255）
+	// IPv6
+	"::/128",         // 未指定地址
+	"::1/128",        // 环回地址
+	"::/96",          // IPv4兼容地址（已废弃）
+	"64:ff9b:1::/48", // 本地使用的IPv4/IPv6转换
+	"100::/64",       // 丢弃专用
+	"2001::/23",      // IETF协议分配（含Teredo、ORCHID）
+	"2001:db8::/32",  // 文档示例
+	"2002::/16",      // 6to4
+	"3fff::/20",      // 文档示例
+	"5f00::/16",      // SRv6 SID
+	"fc00::/7",       // 唯一本地地址 (ULA)
+	"fe80::/10",      // 链路本地
+	"fec0::/10",      // 站点本地（已废弃）
+	"ff00::/8",       // 组播
+)
+
+// 解析固定的CIDR列表，格式错误属于编码错误，直接panic
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// 解析IP地址，IPv4映射的IPv6地址（::ffff:a.b.c.d）转换为IPv4
+func parseIP(ip string) net.IP {
+	parsedIP := net.ParseIP(strings.TrimSpace(ip))
+	if parsedIP == nil {
+		return nil
+	}
+	if v4 := parsedIP.To4(); v4 != nil {
+		return v4
+	}
+	return parsedIP
+}
+
+// 检查是否为局域网或其他特殊用途地址
+func isPrivateIP(ip string) bool {
+	parsedIP := parseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, network := range specialIPRanges {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 验证IP地址（必须是有效的公网IP）
+func isValidPublicIP(ip string) bool {
+	parsedIP := parseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	return !isPrivateIP(ip)
+}
+
+// 解析可信代理列表，单个IP视为 /32 或 /128
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("server.trusted_proxies 中的地址无效: %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("server.trusted_proxies 中的网段无效: %q", entry)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// 判断地址是否为可信代理
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 从 X-Forwarded-For 中由右向左跳过可信代理，返回第一个不可信的地址
+func clientIPFromXFF(values []string) net.IP {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// 无法解析的条目之后的内容都不可信
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+var (
+	errIPFormat    = errors.New("输入的不是有效的 IP 地址或网段格式！")
+	errIPNotPublic = errors.New("禁止使用局域网地址！")
+)
+
+// 解析用户输入的绑定地址，支持单个IP或CIDR网段，并检查网段大小和是否为公网地址
+func parseIPBinding(input string) (*net.IPNet, error) {
+	network := parseIPNet(input)
+	if network == nil {
+		return nil, errIPFormat
+	}
+
+	ones, bits := network.Mask.Size()
+	minPrefix := config.Limits.BindIPv6Prefix
+	if bits == 32 {
+		minPrefix = config.Limits.BindIPv4Prefix
+	}
+	if ones < minPrefix {
+		return nil, fmt.Errorf("网段过大！IPv4 最大允许 /%d，IPv6 最大允许 /%d", config.Limits.BindIPv4Prefix, config.Limits.BindIPv6Prefix)
+	}
+
+	for _, special := range specialIPRanges {
+		if ipNetsOverlap(network, special) {
+			return nil, errIPNotPublic
+		}
+	}
+	return network, nil
+}
+
+// 解析IP或CIDR为网段，单个IP视为 /32 或 /128，IPv4映射地址转换为IPv4
+func parseIPNet(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := parseIP(s)
+		if ip == nil {
+			return nil
+		}
+		bits := len(ip) * 8
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil && len(network.Mask) == net.IPv6len {
+		// ::ffff:a.b.c.d/n 转换为IPv4网段
+		ones, _ := network.Mask.Size()
+		if ones < 96 {
+			return nil
+		}
+		mask := net.CIDRMask(ones-96, 32)
+		return &net.IPNet{IP: v4.Mask(mask), Mask: mask}
+	}
+	return network
+}
+
+// 绑定地址的规范写法，单个IP不带前缀长度
+func formatIPBinding(network *net.IPNet) string {
+	if ones, bits := network.Mask.Size(); ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+// 两个网段是否有交集（CIDR网段要么包含要么不相交）
+func ipNetsOverlap(a, b *net.IPNet) bool {
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// 两个绑定地址是否重叠
+func ipBindingsOverlap(a, b string) bool {
+	netA, netB := parseIPNet(a), parseIPNet(b)
+	if netA == nil || netB == nil {
+		return false
+	}
+	return ipNetsOverlap(netA, netB)
+}
+
+// 绑定地址是否包含客户端IP
+func ipBindingContains(binding, clientIP string) bool {
+	network := parseIPNet(binding)
+	ip := parseIP(clientIP)
+	if network == nil || ip == nil || len(network.IP) != len(ip) {
+		return false
+	}
+	return network.Contains(ip)
+}
+
+// 获取客户端真实IP，只有直接连接方是可信代理时才读取转发头
+func getRealIP(c *gin.Context) string {
+	peerAddr := c.Request.RemoteAddr
+	if host, _, err := net.SplitHostPort(peerAddr); err == nil {
+		peerAddr = host
+	}
+	peer := net.ParseIP(peerAddr)
+	if peer == nil {
+		log.Printf("[DEBUG] 无法解析RemoteAddr: %s", c.Request.RemoteAddr)
+		return peerAddr
+	}
+
+	if config.Server.ProxyHeader == proxyHeaderNone || config.Server.ProxyHeader == "" || !isTrustedProxy(peer) {
+		log.Printf("[DEBUG] 从RemoteAddr获取IP: %s", peer)
+		return peer.String()
+	}
+
+	var header string
+	var client net.IP
+	switch config.Server.ProxyHeader {
+	case proxyHeaderXFF:
+		header = "X-Forwarded-For"
+		client = clientIPFromXFF(c.Request.Header.Values(header))
+	case proxyHeaderCloudflare:
+		header = "CF-Connecting-IP"
+		client = net.ParseIP(strings.TrimSpace(c.GetHeader(header)))
+	case proxyHeaderRealIP:
+		header = "X-Real-IP"
+		client = net.ParseIP(strings.TrimSpace(c.GetHeader(header)))
+	}
+
+	if client == nil {
+		log.Printf("[DEBUG] 可信代理 %s 未提供有效的%s，使用RemoteAddr", peer, header)
+		return peer.String()
+	}
+
+	log.Printf("[DEBUG] 从%s获取IP: %s (代理 %s)", header, client, peer)
+	return client.String()
+}
+
+// 限流桶空闲多久后清理
+const rateBucketIdleTTL = 10 * time.Minute
+
+// 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 按键（IP、用户ID）分别计数的令牌桶限流器
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // 每秒补充的令牌数
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time // 便于测试时替换时钟
+}
+
+// 创建限流器，perMinute 为负数时返回 nil 表示不限制
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute < 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// 尝试消耗一个令牌，不允许时返回需要等待的时长
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastPrune) > rateBucketIdleTTL {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, rateBucketIdleTTL
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// 清理长时间空闲的令牌桶，避免内存无限增长
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > rateBucketIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// 限流错误，携带建议的重试等待时间
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("请求过于频繁，请 %d 秒后再试", retryAfterSeconds(e.retryAfter))
+}
+
+// Retry-After 秒数，向上取整且至少为1
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// 返回 429 响应
+func abortRateLimited(c *gin.Context, retryAfter time.Duration) {
+	seconds := retryAfterSeconds(retryAfter)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, VerifyResponse{
+		Success: false,
+		Code:    verifyCodeRateLimited,
+		Message: fmt.Sprintf("请求过于频繁，请 %d 秒后再试", seconds),
+	})
+}
+
+// 验证接口按IP限流中间件，在解析请求和查询数据库之前拒绝
+func (app *App) verifyRateLimit(c *gin.Context) {
+	clientIP := getRealIP(c)
+	if ok, wait := app.IPLimiter.Allow(clientIP); !ok {
+		log.Printf("[WARN] 验证请求过于频繁: IP=%s", clientIP)
+		abortRateLimited(c, wait)
+		return
+	}
+	c.Next()
+}
+
+// 修改验证处理函数，确保剩余次数为0时也正确返回
+func (app *App) verifyHandler(c *gin.Context) {
+	log.Printf("[DEBUG] 验证接口被调用: %s %s", c.Request.Method, c.Request.URL.Path)
+
+	var req VerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("[WARN] 验证请求格式错误: %v", err)
+		c.JSON(http.StatusBadRequest, VerifyResponse{
+			Success: false,
+			Message: "请求格式错误: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[DEBUG] 解析请求成功，Token长度: %d", len(req.Token))
+
+	// 获取请求者真实IP
+	clientIP := getRealIP(c)
+	log.Printf("[INFO] 收到验证请求: 客户端IP=%s", clientIP)
+
+	// 验证IP是否为有效的公网IP
+	if !isValidPublicIP(clientIP) {
+		log.Printf("[WARN] 客户端IP无效或为内网IP: %s", clientIP)
+		c.JSON(http.StatusBadRequest, VerifyResponse{
+			Success: false,
+			Message: "无法获取有效的公网IP",
+		})
+		return
+	}
+
+	// 验证Token格式
+	if _, err := hex.DecodeString(req.Token); err != nil {
+		log.Printf("[WARN] Token格式无效: %v", err)
+		c.JSON(http.StatusBadRequest, VerifyResponse{
+			Success: false,
+			Message: "Token格式无效",
+		})
+		return
+	}
+
+	product := findProduct(req.Product)
+	if product == nil {
+		log.Printf("[WARN] 未知产品: %q", req.Product)
+		c.JSON(http.StatusBadRequest, VerifyResponse{
+			Success: false,
+			Code:    verifyCodeUnknownProduct,
+			Message: "未知产品",
+		})
+		return
+	}
+
+	// 解密和验证Token
+	payload, matchedRecord, namedToken, err := app.decryptAndValidateToken(req.Token, clientIP)
+	var limitErr *rateLimitError
+	if errors.As(err, &limitErr) {
+		log.Printf("[WARN] %v", err)
+		abortRateLimited(c, limitErr.retryAfter)
+		return
+	}
+	if errors.Is(err, errTokenExpired) || errors.Is(err, errTokenNotYetValid) || errors.Is(err, errTokenRevoked) {
+		log.Printf("[WARN] Token已失效: %v", err)
+		code := verifyCodeTokenExpired
+		switch {
+		case errors.Is(err, errTokenNotYetValid):
+			code = verifyCodeTokenNotYetValid
+		case errors.Is(err, errTokenRevoked):
+			code = verifyCodeTokenRevoked
+		}
+		c.JSON(http.StatusUnauthorized, VerifyResponse{
+			Success: false,
+			Code:    code,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] Token验证失败: %v", err)
+		c.JSON(http.StatusUnauthorized, VerifyResponse{
+			Success: false,
+			Message: "Token无效或IP不匹配",
+		})
+		return
+	}
+
+	log.Printf("[INFO] Token验证成功: 用户ID=%s, IP匹配", payload.UserID)
+
+	// 验证成功，原子扣除一次使用次数：默认产品下使用独立次数的命名Token扣自身次数，其余扣账户在该产品下的次数
+	var tokenName string
+	var newLimit int
+	if namedToken != nil {
+		tokenName = namedToken.Name
+	}
+	switch {
+	case product.ID == defaultProductID && namedToken != nil && namedToken.OwnQuota:
+		newLimit, err = app.Tokens.ConsumeTokenLimit(namedToken.ID)
+	case product.ID == defaultProductID:
+		newLimit, err = app.Users.ConsumeUserLimit(matchedRecord.UserID)
+	default:
+		newLimit, err = app.Users.ConsumeProductLimit(matchedRecord.UserID, product.ID)
+	}
+	if errors.Is(err, errLimitExhausted) {
+		log.Printf("[WARN] 用户 %s 产品 %s 次数不足", matchedRecord.UserID, product.ID)
+		c.JSON(http.StatusForbidden, VerifyResponse{
+			Success:   false,
+			Message:   "使用次数不足",
+			UserID:    matchedRecord.UserID,
+			Limit:     0,
+			TokenName: tokenName,
+			Product:   product.ID,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] 更新用户次数失败: %v", err)
+		c.JSON(http.StatusInternalServerError, VerifyResponse{
+			Success: false,
+			Message: "系统错误",
+		})
+		return
+	}
+
+	log.Printf("[INFO] 验证完全成功: 用户=%s, Token=%q, 产品=%s, 解密IP=%s, 请求IP=%s, 剩余次数=%d",
+		matchedRecord.UserID, tokenName, product.ID, payload.IP, clientIP, newLimit)
+
+	c.JSON(http.StatusOK, VerifyResponse{
+		Success:   true,
+		Message:   "验证成功",
+		UserID:    matchedRecord.UserID,
+		Limit:     newLimit,
+		TokenName: tokenName,
+		Product:   product.ID,
+	})
+}
+
+// 新的解密和验证函数
+func (app *App) decryptAndValidateToken(tokenHex string, clientIP string) (*Payload, *UserRecord, *TokenRecord, error) {
+	env, payload, err := openToken(tokenHex)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	userID := env.UserID
+	timestamp := env.Timestamp
+
+	// Token解密成功后才按用户ID限流，避免伪造用户ID消耗他人额度
+	if ok, wait := app.UserLimiter.Allow(userID); !ok {
+		return nil, nil, nil, &rateLimitError{retryAfter: wait}
+	}
+
+	// 检查有效期
+	if err := checkTokenClaims(payload, time.Now()); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// 检查吊销列表
+	revoked, err := app.Users.IsTokenRevoked(userID, timestamp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("查询吊销列表失败: %v", err)
+	}
+	if revoked {
+		return nil, nil, nil, errTokenRevoked
+	}
+
+	// 验证IP是否在Token绑定的IP或网段内，比较前统一IPv4映射地址和IPv6写法
+	ipBound := ipBindingContains(payload.IP, clientIP)
+
+	// 从数据库获取用户记录（用于检查剩余次数），不是默认Token时再查找命名Token
+	record, err := app.Users.GetUserByToken(userID, timestamp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("查询用户记录失败: %v", err)
+	}
+	if record != nil {
+		// IP白名单只对默认Token生效，命名Token只能在自身绑定的IP下使用
+		if !ipBound {
+			allowed, err := app.ipAllowlisted(userID, clientIP)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !allowed {
+				return nil, nil, nil, fmt.Errorf("IP不匹配: Token中IP=%s, 请求IP=%s", payload.IP, clientIP)
+			}
+		}
+		log.Printf("[DEBUG] 找到匹配的数据库记录")
+		return payload, record, nil, nil
+	}
+
+	named, err := app.Tokens.GetTokenByTimestamp(userID, timestamp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("查询Token记录失败: %v", err)
+	}
+	if named == nil {
+		return nil, nil, nil, fmt.Errorf("数据库中未找到匹配的记录")
+	}
+	if !ipBound {
+		return nil, nil, nil, fmt.Errorf("IP不匹配: Token中IP=%s, 请求IP=%s", payload.IP, clientIP)
+	}
+	record, err = app.Users.GetUser(userID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("查询用户记录失败: %v", err)
+	}
+	if record == nil {
+		return nil, nil, nil, fmt.Errorf("数据库中未找到匹配的记录")
+	}
+
+	log.Printf("[DEBUG] 找到匹配的命名Token: %s", named.Name)
+	return payload, record, named, nil
+}
+
+// 解析并解密Token，不检查有效期和IP
+func openToken(tokenHex string) (*tokenEnvelope, *Payload, error) {
+	// 解码十六进制
+	data, err := hex.DecodeString(tokenHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("十六进制解码失败: %v", err)
+	}
+
+	env, err := parseToken(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userID := env.UserID
+	timestamp := env.Timestamp
+
+	log.Printf("[DEBUG] 从Token解析: 版本=%d, 算法=%d, 密钥ID=%q, 用户ID=%s, 时间戳=%d",
+		env.Version, env.Alg, env.KeyID, userID, timestamp)
+
+	// 按解析出的版本选择密钥来源，只有v1使用MD5密钥，v4必须使用密钥环中存在的主密钥
+	var key []byte
+	switch env.Version {
+	case tokenVersionLegacy:
+		key, err = generateDeterministicKey(userID, timestamp)
+	case tokenVersionKeyID:
+		secret, ok := keyring.Get(env.KeyID)
+		if !ok {
+			return nil, nil, fmt.Errorf("密钥不存在: %q", env.KeyID)
+		}
+		key, err = deriveTokenKey(secret, userID, timestamp)
+	default:
+		return nil, nil, fmt.Errorf("未知的Token版本: %d", env.Version)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("生成密钥失败: %v", err)
+	}
+
+	// 解密数据
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建密码块失败: %v", err)
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建GCM失败: %v", err)
+	}
+
+	plaintext, err := aesgcm.Open(nil, env.Nonce, env.Ciphertext, env.AAD)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解密失败: %v", err)
+	}
+
+	var payload Payload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, nil, fmt.Errorf("解析Payload失败: %v", err)
+	}
+
+	log.Printf("[DEBUG] 解密成功: 用户ID=%s, IP=%s, 时间戳=%d", payload.UserID, payload.IP, payload.Timestamp)
+
+	// 密文中的用户信息必须与明文头部一致
+	if payload.UserID != userID || payload.Timestamp != timestamp {
+		return nil, nil, fmt.Errorf("Token头部与内容不一致")
+	}
+
+	return env, &payload, nil
+}
+
+// 检查Token的生效时间和过期时间
+func checkTokenClaims(payload *Payload, now time.Time) error {
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+
+	if payload.NotBefore > 0 && nowMs < payload.NotBefore {
+		return errTokenNotYetValid
+	}
+	if payload.ExpiresAt > 0 && nowMs >= payload.ExpiresAt {
+		return errTokenExpired
+	}
+	return nil
+}
+
+// 派生Token密钥（HKDF-SHA256，主密钥 + 用户ID + 时间戳）
+func deriveTokenKey(secret []byte, userID string, timestamp int64) ([]byte, error) {
+	info := fmt.Sprintf("%s_%d", userID, timestamp)
+	reader := hkdf.New(sha256.New, secret, []byte(tokenKeySalt), []byte(info))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// 为用户签发新Token，返回Token和对应的时间戳
+func issueToken(userID, ip string) (string, int64, error) {
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+
+	keyID, secret := keyring.Active()
+	key, err := deriveTokenKey(secret, userID, timestamp)
+	if err != nil {
+		return "", 0, fmt.Errorf("派生密钥失败: %v", err)
+	}
+
+	payload := Payload{
+		UserID:    userID,
+		IP:        ip,
+		Timestamp: timestamp,
+	}
+	if config.Limits.TokenTTLDays > 0 {
+		payload.ExpiresAt = timestamp + int64(config.Limits.TokenTTLDays)*int64(24*time.Hour/time.Millisecond)
+	}
+
+	token, err := encryptPayload(payload, keyID, key)
+	if err != nil {
+		return "", 0, fmt.Errorf("加密Token失败: %v", err)
+	}
+
+	return token, timestamp, nil
+}
+
+// 生成确定性密钥（旧版Token，仅用于兼容验证）
+func generateDeterministicKey(userID string, timestamp int64) ([]byte, error) {
+	// 使用用户ID和时间戳生成确定性密钥
+	data := fmt.Sprintf("%s_%d", userID, timestamp)
+
+	hash := md5.Sum([]byte(data))
+	// 扩展到32字节
+	key := make([]byte, 32)
+	copy(key, hash[:])
+	copy(key[16:], hash[:])
+
+	return key, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 卡密字符集（Crockford Base32，去除易混淆的 I L O U）
+const keyAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const (
+	keyGroupCount = 5 // 卡密分组数
+	keyGroupSize  = 4 // 每组字符数
+	keyLength     = keyGroupCount * keyGroupSize
+)
+
+var errInvalidKeyFormat = errors.New("卡密格式错误，请检查后重新输入")
+
+const (
+	maxKeyBatchSize  = 1000 // 单次批量生成卡密的最大数量
+	maxKeyChannelLen = 64   // 渠道/代理标签最大长度
+)
+
+// 生成卡密：19位CSPRNG随机字符加1位校验字符，按组显示，如 7K3M-Q9XD-2HFW-RB8N-TC4P
+func generateKey() (string, error) {
+	buf := make([]byte, keyLength-1)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %v", err)
+	}
+
+	// 256是32的整数倍，取低5位不会产生偏差
+	chars := make([]byte, 0, keyLength)
+	for _, b := range buf {
+		chars = append(chars, keyAlphabet[b&31])
+	}
+	chars = append(chars, keyCheckChar(chars))
+
+	return formatKey(chars), nil
+}
+
+// 计算Luhn mod 32校验字符，可发现任意单字符错误和绝大多数相邻字符颠倒
+func keyCheckChar(chars []byte) byte {
+	const n = len(keyAlphabet)
+
+	sum := 0
+	factor := 2
+	for i := len(chars) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(keyAlphabet, chars[i])
+		sum += addend/n + addend%n
+		factor = 3 - factor
+	}
+
+	return keyAlphabet[(n-sum%n)%n]
+}
+
+// 按组插入连字符
+func formatKey(chars []byte) string {
+	var b strings.Builder
+	for i, c := range chars {
+		if i > 0 && i%keyGroupSize == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+const (
+	keyGlobalScope    = "global"
+	keyUserFailureTTL = 24 * time.Hour   // 用户超过该时长没有新的失败则重新计数
+	keyGlobalWindow   = 10 * time.Minute // 全局失败计数窗口
+	maxKeyLockout     = 24 * time.Hour   // 最长锁定时长
+)
+
+// 用户的卡密失败计数键
+func keyAttemptScope(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// 卡密失败锁定策略：连续失败达到freeFailures次后锁定，锁定时长从base开始每多失败一次翻倍，最长24小时；
+// 距上次失败（或锁定结束）超过resetAfter时重新计数
+type keyLockoutPolicy struct {
+	freeFailures int
+	base         time.Duration
+	resetAfter   time.Duration
+}
+
+// 连续失败failures次后的锁定时长，未达到锁定次数时返回false
+func (p keyLockoutPolicy) lockout(failures int) (time.Duration, bool) {
+	if failures < p.freeFailures {
+		return 0, false
+	}
+
+	lockout := p.base
+	for i := p.freeFailures; i < failures && lockout < maxKeyLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxKeyLockout {
+		lockout = maxKeyLockout
+	}
+	return lockout, true
+}
+
+// 记录一次失败，返回本次是否触发锁定
+func (a *KeyAttempt) recordFailure(now time.Time, policy keyLockoutPolicy) bool {
+	last := a.LastFailure
+	if a.LockedUntil.After(last) {
+		last = a.LockedUntil
+	}
+	if now.Sub(last) > policy.resetAfter {
+		a.Failures = 0
+		a.LockedUntil = time.Time{}
+		a.AlertSent = false
+	}
+
+	a.Failures++
+	a.LastFailure = now
+	lockout, locked := policy.lockout(a.Failures)
+	if locked {
+		a.LockedUntil = now.Add(lockout)
+	}
+	return locked
+}
+
+// 生成卡密批次ID，如 B20240102-9F3A1C
+func generateBatchID() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %v", err)
+	}
+	return fmt.Sprintf("B%s-%X", time.Now().In(chinaLocation).Format("20060102"), buf), nil
+}
+
+// 每张卡密最多可被多少个用户使用
+func (opts KeyBatchOptions) maxUses() int {
+	if opts.MaxUses <= 0 {
+		return 1
+	}
+	return opts.MaxUses
+}
+
+// 卡密所属产品，未指定时为默认产品
+func (opts KeyBatchOptions) product() string {
+	if opts.Product == "" {
+		return defaultProductID
+	}
+	return opts.Product
+}
+
+// 检查卡密是否可被该用户兑换
+func checkKeyRedeemable(used, disabled bool, expiresAt sql.NullTime, maxUses, usesCount int, redeemedByUser bool, now time.Time) error {
+	switch {
+	case redeemedByUser:
+		return fmt.Errorf("你已使用过该卡密")
+	case used || usesCount >= maxUses:
+		if maxUses > 1 {
+			return fmt.Errorf("卡密已达到最大使用次数")
+		}
+		return fmt.Errorf("卡密已被使用")
+	case disabled:
+		return fmt.Errorf("卡密已作废")
+	case expiresAt.Valid && now.After(expiresAt.Time):
+		return fmt.Errorf("卡密已过期")
+	}
+	return nil
+}
+
+// 解析卡密记录中的过期时间，未设置过期时间时返回无效值
+func keyExpiresAt(record *KeyRecord) (sql.NullTime, error) {
+	if record.ExpiresAt == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05 CST", record.ExpiresAt, chinaLocation)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("解析卡密过期时间失败: %v", err)
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// 构造新生成的卡密记录
+func newKeyRecord(key, batchID, createdBy string, createdAt time.Time, opts KeyBatchOptions) KeyRecord {
+	record := KeyRecord{
+		Key:       key,
+		BatchID:   batchID,
+		AddLimit:  opts.AddLimit,
+		MaxUses:   opts.maxUses(),
+		CreatedBy: createdBy,
+		CreatedAt: createdAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST"),
+		Channel:   opts.Channel,
+		Product:   opts.product(),
+	}
+	if opts.ExpiresAt != nil {
+		record.ExpiresAt = opts.ExpiresAt.In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	}
+	return record
+}
+
+// 生成卡密批次CSV文件内容
+func buildKeyBatchCSV(keys []KeyRecord) ([]byte, error) {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"key", "add_limit", "batch_id", "created_at", "expires_at", "channel", "product"})
+	for _, k := range keys {
+		w.Write([]string{k.Key, strconv.Itoa(k.AddLimit), k.BatchID, k.CreatedAt, k.ExpiresAt, k.Channel, k.Product})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("生成CSV失败: %v", err)
+	}
+	return []byte(buf.String()), nil
+}
+
+// 是否为旧版卡密（32位十六进制MD5）
+func isLegacyKey(key string) bool {
+	if len(key) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// 规范化用户输入的卡密：旧版卡密原样使用；新版卡密忽略大小写、空格和连字符，
+// 按Crockford规则将 O 视为 0、I/L 视为 1，并在查库前校验校验字符
+func normalizeKey(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if isLegacyKey(input) {
+		return strings.ToLower(input), nil
+	}
+
+	chars := make([]byte, 0, keyLength)
+	for _, r := range strings.ToUpper(input) {
+		switch r {
+		case '-', ' ':
+			continue
+		case 'O':
+			r = '0'
+		case 'I', 'L':
+			r = '1'
+		}
+		if !strings.ContainsRune(keyAlphabet, r) {
+			return "", errInvalidKeyFormat
+		}
+		chars = append(chars, byte(r))
+	}
+
+	if len(chars) != keyLength || keyCheckChar(chars[:keyLength-1]) != chars[keyLength-1] {
+		return "", errInvalidKeyFormat
+	}
+
+	return formatKey(chars), nil
+}
+
+// 检查是否为管理员
+func isAdmin(userID int64) bool {
+	for _, adminID := range config.Bot.AdminIDs {
+		if adminID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// 创建主菜单键盘（移除取消按钮）
+func createMainMenuKeyboard(userID int64) tgbotapi.InlineKeyboardMarkup {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+
+	// 普通用户按钮
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🐳 获取Token", "get_token"),
+		tgbotapi.NewInlineKeyboardButtonData("🛳️ 账户信息", "account_info"),
+	))
+
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("💻 使用卡密", "use_key"),
+		tgbotapi.NewInlineKeyboardButtonData("💰 充值次数", "recharge"),
+	))
+
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔥 换绑IP", "change_ip"),
+		tgbotapi.NewInlineKeyboardButtonData("♻️ 重置Token", "reset_token"),
+	))
+
+	row := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🌐 IP白名单", "ip_list"),
+	)
+	if config.Limits.TokenTTLDays > 0 {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("⏳ 续期Token", "renew_token"))
+	}
+	keyboard = append(keyboard, row)
+
+	// 管理员按钮
+	if isAdmin(userID) {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🛠️ 管理员功能", "admin_menu"),
+		))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// 创建管理员菜单键盘（移除取消按钮）
+func createAdminMenuKeyboard() tgbotapi.InlineKeyboardMarkup {
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🎉 生成卡密", "gen_key"),
+			tgbotapi.NewInlineKeyboardButtonData("📦 批量生成卡密", "gen_key_batch"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📋 卡密库存", "key_list_all_0"),
+			tgbotapi.NewInlineKeyboardButtonData("🚫 作废批次", "void_batch"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔑 重新签发Token", "reissue_tokens"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// 创建确认键盘（移除取消按钮）
+func createConfirmKeyboard(action string) tgbotapi.InlineKeyboardMarkup {
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ 确认", "confirm_"+action),
+		),
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// 设置消息超时
+func setMessageTimeout(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	// 清除之前的超时
+	clearMessageTimeout(userID, chatID, messageID)
+
+	timeoutKey := fmt.Sprintf("%d_%d_%d", userID, chatID, messageID)
+
+	timer := time.AfterFunc(5*time.Minute, func() {
+		// 5分钟后删除消息
+		deleteMsg := tgbotapi.NewDeleteMessage(chatID, messageID)
+		bot.Request(deleteMsg)
+
+		// 清理状态
+		clearUserState(userID)
+		delete(messageTimeouts, timeoutKey)
+
+		log.Printf("[INFO] 用户 %d 的消息 %d 因超时被删除", userID, messageID)
+	})
+
+	messageTimeouts[timeoutKey] = &MessageTimeout{
+		UserID:    userID,
+		ChatID:    chatID,
+		MessageID: messageID,
+		Timer:     timer,
+	}
+}
+
+// 清除消息超时
+func clearMessageTimeout(userID int64, chatID int64, messageID int) {
+	timeoutKey := fmt.Sprintf("%d_%d_%d", userID, chatID, messageID)
+	if timeout, exists := messageTimeouts[timeoutKey]; exists {
+		timeout.Timer.Stop()
+		delete(messageTimeouts, timeoutKey)
+	}
+}
+
+// 重置消息超时（用户有操作时调用）
+func resetMessageTimeout(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	setMessageTimeout(bot, userID, chatID, messageID)
 }
 
 // 设置用户状态（更新为包含消息ID）
@@ -1080,242 +4595,1671 @@ func setUserState(userID int64, state string, data map[string]interface{}, messa
 		data = make(map[string]interface{})
 	}
 
-	// 清除旧的定时器
-	if oldState := userStates[userID]; oldState != nil && oldState.Timer != nil {
-		oldState.Timer.Stop()
+	// 清除旧的定时器
+	if oldState := userStates[userID]; oldState != nil && oldState.Timer != nil {
+		oldState.Timer.Stop()
+	}
+
+	userStates[userID] = &UserState{
+		State:     state,
+		Data:      data,
+		MessageID: messageID,
+	}
+}
+
+// 清除用户状态（更新）
+func clearUserState(userID int64) {
+	if state := userStates[userID]; state != nil && state.Timer != nil {
+		state.Timer.Stop()
+	}
+	delete(userStates, userID)
+	delete(userKeys, userID)
+}
+
+// 处理用户状态输入
+func (app *App) handleUserStateInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string, userState *UserState, userMessageID int) {
+	// 删除用户的输入消息
+	deleteMsg := tgbotapi.NewDeleteMessage(chatID, userMessageID)
+	bot.Request(deleteMsg)
+
+	// 重置消息超时
+	resetMessageTimeout(bot, userID, chatID, userState.MessageID)
+
+	switch userState.State {
+	case "waiting_ip":
+		app.handleIPInput(bot, userID, chatID, text)
+	case "waiting_key":
+		app.handleKeyInput(bot, userID, chatID, text)
+	case "waiting_key_limit":
+		app.handleKeyLimitInput(bot, userID, chatID, text)
+	case "waiting_key_max_uses":
+		app.handleKeyMaxUsesInput(bot, userID, chatID, text)
+	case "waiting_batch_count":
+		app.handleBatchCountInput(bot, userID, chatID, text)
+	case "waiting_batch_limit":
+		app.handleBatchLimitInput(bot, userID, chatID, text)
+	case "waiting_batch_expiry":
+		app.handleBatchExpiryInput(bot, userID, chatID, text)
+	case "waiting_batch_channel":
+		app.handleBatchChannelInput(bot, userID, chatID, text)
+	case "waiting_void_batch":
+		app.handleVoidBatchInput(bot, userID, chatID, text)
+	case "waiting_key_batch_filter":
+		app.handleKeyBatchFilterInput(bot, userID, chatID, text)
+	case "waiting_key_search":
+		app.handleKeySearchInput(bot, userID, chatID, text)
+	case "waiting_recharge_count":
+		app.handleRechargeCountInput(bot, userID, chatID, text)
+	case "waiting_change_ip":
+		app.handleChangeIPInput(bot, userID, chatID, text)
+	case "waiting_token_name":
+		app.handleTokenNameInput(bot, userID, chatID, text)
+	case "waiting_token_ip":
+		app.handleTokenIPInput(bot, userID, chatID, text)
+	case "waiting_token_quota":
+		app.handleTokenQuotaInput(bot, userID, chatID, text)
+	case "waiting_user_ip":
+		app.handleUserIPInput(bot, userID, chatID, text)
+	}
+}
+
+// 获取用户状态
+func getUserState(userID int64) *UserState {
+	return userStates[userID]
+}
+
+// 处理IP输入
+func (app *App) handleIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, ip string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	network, err := parseIPBinding(ip)
+	if err == nil {
+		ip = formatIPBinding(network)
+		ipUsed, _, err := app.Users.IPOverlaps(ip, fmt.Sprintf("%d", userID))
+		if err != nil {
+			log.Printf("[ERROR] 检查IP存在性失败: %v", err)
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+			keyboard := createMainMenuKeyboard(userID)
+			editMsg.ReplyMarkup = &keyboard
+			bot.Send(editMsg)
+			clearUserState(userID)
+			return
+		}
+
+		if ipUsed {
+			clearUserState(userID)
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！\n\n请使用其他IP地址。", ip))
+			keyboard := createMainMenuKeyboard(userID)
+			editMsg.ReplyMarkup = &keyboard
+			bot.Send(editMsg)
+			return
+		}
+
+		// 生成Token
+		app.generateTokenForUser(bot, userID, chatID, ip, messageID)
+
+	} else {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ "+err.Error()+"\n\n📥 请重新输入你的公网 IP 地址或网段：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+	}
+}
+
+// 处理卡密输入
+func (app *App) handleKeyInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, key string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	if userInfo == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	now := time.Now()
+	if app.replyIfKeyLocked(bot, userID, chatID, messageID, now) {
+		return
+	}
+
+	// 格式或校验位错误的卡密直接提示，不查询数据库
+	key, err = normalizeKey(key)
+	if err != nil {
+		if app.recordKeyFailure(bot, userID, chatID, messageID, now) {
+			return
+		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ %s\n\n🎉 请重新输入你的卡密：", err.Error()))
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	product, addLimit, newLimit, err := app.Keys.UseKey(key, fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[WARN] 用户 %d 使用卡密失败: %v", userID, err)
+		if errors.Is(err, errKeyNotFound) && app.recordKeyFailure(bot, userID, chatID, messageID, now) {
+			return
+		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ %s\n\n🎉 请重新输入你的卡密：", err.Error()))
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	msgText := fmt.Sprintf("✅ 卡密使用成功！\n\n⚡ 增加次数: %d\n💫 当前总次数: %d", addLimit, newLimit)
+	if len(config.Products) > 1 {
+		msgText = fmt.Sprintf("✅ 卡密使用成功！\n\n📦 产品: %s\n⚡ 增加次数: %d\n💫 当前总次数: %d", productName(product), addLimit, newLimit)
+	}
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createMainMenuKeyboard(userID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	clearUserState(userID)
+	log.Printf("[INFO] 用户 %d 使用卡密成功: %s, 增加次数: %d", userID, key, addLimit)
+	app.resetKeyFailures(userID)
+}
+
+// 检查用户的卡密兑换是否被锁定，锁定时提示用户并返回true
+func (app *App) replyIfKeyLocked(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, now time.Time) bool {
+	attempt, err := app.Keys.GetKeyAttempt(keyAttemptScope(userID))
+	if err != nil {
+		log.Printf("[ERROR] 查询卡密失败计数失败: %v", err)
+		return false
+	}
+	lockedUntil := attempt.LockedUntil
+	if !lockedUntil.After(now) {
+		return false
+	}
+
+	msgText := fmt.Sprintf("🔒 卡密输错次数过多，兑换已被暂时锁定\n\n⏳ 请于 %s 后再试",
+		lockedUntil.In(chinaLocation).Format("2006-01-02 15:04:05"))
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createMainMenuKeyboard(userID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	clearUserState(userID)
+	return true
+}
+
+// 记录一次卡密兑换失败（用户和全局），触发锁定时提示用户并返回true。
+// 只有用户计数会锁定；全局计数只通知管理员，否则少数账户各自输错到上限前就能让所有人无法兑换
+func (app *App) recordKeyFailure(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, now time.Time) bool {
+	lockout := time.Duration(config.Limits.KeyLockoutMinutes) * time.Minute
+	locked := false
+
+	scope := keyAttemptScope(userID)
+	userPolicy := keyLockoutPolicy{freeFailures: config.Limits.KeyFreeFailures, base: lockout, resetAfter: keyUserFailureTTL}
+	attempt, userLocked, err := app.Keys.RecordKeyFailure(scope, now, userPolicy)
+	if err != nil {
+		log.Printf("[ERROR] 记录卡密失败计数失败: %v", err)
+	} else {
+		locked = userLocked
+		// 达到告警次数后每轮连续失败只通知一次，计数并发跳过告警值时也不会漏报
+		if attempt.Failures >= config.Limits.KeyAlertFailures && !attempt.AlertSent {
+			sent, err := app.Keys.MarkKeyAlertSent(scope)
+			if err != nil {
+				log.Printf("[ERROR] 更新告警标记失败: %v", err)
+			}
+			if sent {
+				log.Printf("[WARN] 用户 %d 卡密连续输错 %d 次", userID, attempt.Failures)
+				notifyAdmins(bot, fmt.Sprintf("⚠️ 卡密暴力尝试告警\n\n👤 用户ID: %d\n❌ 连续输错: %d 次\n🔒 锁定至: %s",
+					userID, attempt.Failures, attempt.LockedUntil.In(chinaLocation).Format("2006-01-02 15:04:05")))
+			}
+		}
+	}
+
+	globalPolicy := keyLockoutPolicy{freeFailures: math.MaxInt32, resetAfter: keyGlobalWindow}
+	global, _, err := app.Keys.RecordKeyFailure(keyGlobalScope, now, globalPolicy)
+	if err != nil {
+		log.Printf("[ERROR] 记录卡密失败计数失败: %v", err)
+	} else if global.Failures >= config.Limits.KeyGlobalFailures && !global.AlertSent {
+		sent, err := app.Keys.MarkKeyAlertSent(keyGlobalScope)
+		if err != nil {
+			log.Printf("[ERROR] 更新告警标记失败: %v", err)
+		}
+		if sent {
+			log.Printf("[WARN] 全部用户10分钟内卡密输错 %d 次", global.Failures)
+			notifyAdmins(bot, fmt.Sprintf("🚨 卡密全局输错告警\n\n❌ 10分钟内输错: %d 次\n💡 兑换未暂停，各用户仍按自己的失败次数锁定，请检查是否有多个账户在尝试卡密",
+				global.Failures))
+		}
+	}
+
+	return locked && app.replyIfKeyLocked(bot, userID, chatID, messageID, now)
+}
+
+// 兑换成功后清除用户的失败计数
+func (app *App) resetKeyFailures(userID int64) {
+	attempt, err := app.Keys.GetKeyAttempt(keyAttemptScope(userID))
+	if err != nil || attempt.Failures == 0 {
+		return
+	}
+
+	attempt.Failures = 0
+	attempt.LockedUntil = time.Time{}
+	attempt.AlertSent = false
+	if err = app.Keys.SaveKeyAttempt(attempt); err != nil {
+		log.Printf("[ERROR] 清除卡密失败计数失败: %v", err)
+	}
+}
+
+// 向所有管理员发送通知
+func notifyAdmins(bot *tgbotapi.BotAPI, text string) {
+	for _, adminID := range config.Bot.AdminIDs {
+		if _, err := bot.Send(tgbotapi.NewMessage(adminID, text)); err != nil {
+			log.Printf("[ERROR] 通知管理员 %d 失败: %v", adminID, err)
+		}
+	}
+}
+
+// 处理卡密次数输入
+func (app *App) handleKeyLimitInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	limit, err := strconv.Atoi(text)
+	if err != nil || limit <= 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的正整数\n\n🎉 生成卡密\n\n请输入卡密可增加的次数：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	userState.Data["limit"] = limit
+	setUserState(userID, "waiting_key_max_uses", userState.Data, messageID)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🎉 生成卡密\n\n请输入可使用该卡密的人数：\n\n💡 输入 1 为普通单次卡密，大于 1 为活动卡密（每人限用一次）")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理卡密可使用人数输入
+func (app *App) handleKeyMaxUsesInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	maxUses, err := strconv.Atoi(text)
+	if err != nil || maxUses <= 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的正整数\n\n🎉 生成卡密\n\n请输入可使用该卡密的人数：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	userState.Data["max_uses"] = maxUses
+
+	confirmMsg := fmt.Sprintf("📋 确认生成卡密信息：\n\n%s⚡ 次数: %d\n👥 可使用人数: %d\n\n确认生成吗？", productLine(userState.Data["product"].(string)), userState.Data["limit"].(int), maxUses)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
+	keyboard := createConfirmKeyboard("gen_key")
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理充值次数输入
+func (app *App) handleRechargeCountInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	product := findProduct(userState.Data["product"].(string))
+	if product == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 产品不存在")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	count, err := strconv.Atoi(text)
+	if err != nil || count <= 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 请输入有效的整数\n\n💰 请输入要充值的次数：\n\n💡 按次计费：每次 %.2f 元", product.PricePerUse))
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	totalPrice := float64(count) * product.PricePerUse
+
+	userState.Data["count"] = count
+	userState.Data["price"] = totalPrice
+
+	confirmMsg := fmt.Sprintf("📋 确认充值信息：\n\n%s⚡ 次数: %d\n💰 金额: %.2f 元\n💳 支付方式: 微信支付\n\n确认创建订单吗？", productLine(product.ID), count, totalPrice)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
+	keyboard := createConfirmKeyboard("recharge")
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理充值按钮
+func (app *App) handleRechargeButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	if userInfo == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	// 多个产品时先选择要充值的产品
+	if len(config.Products) > 1 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "💰 充值次数\n\n请选择要充值的产品：")
+		keyboard := productPickerKeyboard("recharge_p_", "🔙 返回主菜单", "main_menu")
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	app.handleRechargeProduct(bot, userID, chatID, messageID, defaultProductID)
+}
+
+// 处理充值产品选择
+func (app *App) handleRechargeProduct(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, productID string) {
+	product := findProduct(productID)
+	if product == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 产品不存在")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	balances, err := app.Users.GetUserBalances(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %d 产品 %s 余额失败: %v", userID, product.ID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	// 未注册用户没有默认产品余额
+	if _, ok := balances[defaultProductID]; !ok {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	balance := productBalance(balances, product)
+
+	setUserState(userID, "waiting_recharge_count", map[string]interface{}{"product": product.ID}, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("💰 请输入要充值的次数：\n\n%s💡 每次 %.2f 元\n🎯 当前剩余次数: %d", productLine(product.ID), product.PricePerUse, balance))
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 产品选择键盘，按钮回调为 prefix+产品ID
+func productPickerKeyboard(prefix, backText, backData string) tgbotapi.InlineKeyboardMarkup {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, p := range config.Products {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📦 "+p.Name, prefix+p.ID),
+		))
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(backText, backData),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// 处理确认充值
+func (app *App) handleConfirmRecharge(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userState := getUserState(userID)
+	if userState == nil || userState.Data["count"] == nil || userState.Data["price"] == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	count := userState.Data["count"].(int)
+	price := userState.Data["price"].(float64)
+	product := userState.Data["product"].(string)
+
+	payID := fmt.Sprintf("RECHARGE_%d_%d", userID, time.Now().UnixNano())
+
+	goodsName := fmt.Sprintf("充值%d次使用次数", count)
+	if len(config.Products) > 1 {
+		goodsName = fmt.Sprintf("%s 充值%d次使用次数", productName(product), count)
+	}
+	order := &Order{
+		PayID:      payID,
+		UserID:     fmt.Sprintf("%d", userID),
+		Count:      count,
+		GoodsName:  goodsName,
+		Price:      price,
+		Status:     "pending",
+		CreateTime: time.Now(),
+		ChatID:     chatID,
+		MessageID:  messageID,
+		Product:    product,
+	}
+
+	err := app.Orders.SaveOrder(order)
+	if err != nil {
+		log.Printf("[ERROR] 保存订单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	req := &CreateOrderRequest{
+		PayID:     payID,
+		Type:      1, // 微信支付
+		Price:     price,
+		GoodsName: order.GoodsName,
+		Param:     fmt.Sprintf("%d", userID),
+		IsHTML:    0,
+		NotifyURL: config.Payment.NotifyURL,
+		ReturnURL: config.Payment.ReturnURL,
+	}
+
+	result, err := epayClient.CreateOrder(req)
+	if err != nil {
+		log.Printf("[ERROR] 创建订单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	if result.Code != 1 {
+		log.Printf("[ERROR] 创建订单失败: %s", result.Msg)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 创建订单失败: %s", result.Msg))
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	// 保存易支付订单号到数据库
+	err = app.Orders.UpdateOrderWithEpayInfo(payID, result.Data.OrderID, result.Data.ReallyPrice, result.Data.PayType)
+	if err != nil {
+		log.Printf("[ERROR] 更新订单信息失败: %v", err)
+	}
+
+	msgText := fmt.Sprintf("🎉 订单创建成功！\n\n"+
+		"📦 商品: %s\n"+
+		"💰 金额: %.2f 元\n"+
+		"📋 订单号: %s\n\n"+
+		"🔗 请点击下方链接完成支付：\n%s\n\n"+
+		"⏰ 订单有效期: %d 分钟\n"+
+		"💡 支付完成后次数将自动到账",
+		order.GoodsName,
+		result.Data.Price,
+		result.Data.OrderID,
+		result.Data.PayURL,
+		result.Data.TimeOut)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonURL("💳 去支付", result.Data.PayURL),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 查询订单状态", "check_order_"+result.Data.OrderID),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+
+	clearUserState(userID)
+	log.Printf("[INFO] 用户 %d 创建充值订单: %s, 次数: %d, 金额: %.2f", userID, payID, count, price)
+}
+
+// 处理查询订单状态
+func (app *App) handleCheckOrderStatus(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, orderID string) {
+	result, err := epayClient.GetOrder(orderID)
+	if err != nil {
+		log.Printf("[ERROR] 查询订单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 查询订单失败，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	if result.Code != 1 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 查询订单失败: %s", result.Msg))
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	var statusText string
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+
+	order, err := app.Orders.GetOrderByPayID(result.Data.PayID)
+	if err == nil && order != nil && (order.Status == "paid" || order.Status == orderStatusRefundRequired) {
+		statusText = "✅ 已支付完成"
+		if order.Status == orderStatusRefundRequired {
+			statusText = "⚠️ 已支付，但订单未能完成，等待管理员退款"
+		}
+		keyboard = [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+	} else {
+		switch result.Data.State {
+		case 0:
+			statusText = "⏳ 等待支付"
+			keyboard = [][]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonURL("💳 去支付", result.Data.PayURL),
+				),
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔄 刷新状态", "check_order_"+orderID),
+				),
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+				),
+			}
+		case 1:
+			statusText = "✅ 已支付完成"
+			keyboard = [][]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+				),
+			}
+		case 2:
+			statusText = "❌ 支付失败"
+			keyboard = [][]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+				),
+			}
+		default:
+			statusText = "❓ 未知状态"
+			keyboard = [][]tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔄 刷新状态", "check_order_"+orderID),
+				),
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+				),
+			}
+		}
+	}
+
+	msgText := fmt.Sprintf("📋 订单状态查询\n\n"+
+		"📦 商品: %s\n"+
+		"💰 金额: %.2f 元\n"+
+		"📋 订单号: %s\n"+
+		"📊 状态: %s",
+		result.Data.PayID,
+		result.Data.Price,
+		result.Data.OrderID,
+		statusText)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 生成Token
+func (app *App) generateTokenForUser(bot *tgbotapi.BotAPI, userID int64, chatID int64, ip string, messageID int) {
+	token, timestamp, err := issueToken(fmt.Sprintf("%d", userID), ip)
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 生成 Token 失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成 Token 出错，请重试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	err = app.Users.AddUser(fmt.Sprintf("%d", userID), ip, token, config.Limits.DefaultLimit, timestamp)
+	if err != nil {
+		log.Printf("[ERROR] 保存用户记录失败: %v", err)
+		msgText := "❌ 生成 Token 出错，请重试"
+		if errors.Is(err, errIPOverlap) {
+			msgText = fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！\n\n请使用其他IP地址。", ip)
+		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		clearUserState(userID)
+		return
+	}
+
+	result := fmt.Sprintf("🎉 你的 Token 生成成功！\n\n```\n%s\n```\n\n📌 请妥善保存，用于身份验证\n⚡ 初始额度: %d 次\n\n💡 使用账户信息按钮查看详情", token, config.Limits.DefaultLimit)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, result)
+	editMsg.ParseMode = "Markdown"
+	keyboard := createMainMenuKeyboard(userID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+
+	clearUserState(userID)
+	log.Printf("[INFO] ✅ 为用户 %d 生成 Token 成功，IP: %s, 时间戳: %d", userID, ip, timestamp)
+}
+
+// 处理回调查询
+func (app *App) handleCallbackQuery(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	userID := query.From.ID
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+	data := query.Data
+
+	resetMessageTimeout(bot, userID, chatID, messageID)
+
+	callback := tgbotapi.NewCallback(query.ID, "")
+	bot.Request(callback)
+
+	log.Printf("[INFO] 用户 %d 点击按钮: %s", userID, data)
+
+	switch {
+	case data == "main_menu":
+		clearUserState(userID)
+		welcomeMsg := "🎉 欢迎使用 Token 验证系统！\n\n请选择你需要的功能："
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, welcomeMsg)
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+
+	case data == "get_token":
+		app.handleGetTokenButton(bot, userID, chatID, messageID)
+
+	case data == "account_info":
+		app.handleAccountInfoButton(bot, userID, chatID, messageID)
+
+	case data == "use_key":
+		app.handleUseKeyButton(bot, userID, chatID, messageID)
+
+	case strings.HasPrefix(data, "recharge_p_"):
+		app.handleRechargeProduct(bot, userID, chatID, messageID, strings.TrimPrefix(data, "recharge_p_"))
+
+	case strings.HasPrefix(data, "gen_key_p_"):
+		app.handleGenKeyProduct(bot, userID, chatID, messageID, strings.TrimPrefix(data, "gen_key_p_"))
+
+	case strings.HasPrefix(data, "gen_key_batch_p_"):
+		app.handleGenKeyBatchProduct(bot, userID, chatID, messageID, strings.TrimPrefix(data, "gen_key_batch_p_"))
+
+	case data == "recharge":
+		app.handleRechargeButton(bot, userID, chatID, messageID)
+
+	case data == "change_ip":
+		app.handleChangeIPButton(bot, userID, chatID, messageID)
+
+	case data == "renew_token":
+		app.handleRenewTokenButton(bot, userID, chatID, messageID)
+
+	case data == "reset_token":
+		app.handleResetTokenButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_reset_token":
+		app.handleConfirmResetToken(bot, userID, chatID, messageID)
+
+	case data == "confirm_recharge":
+		app.handleConfirmRecharge(bot, userID, chatID, messageID)
+
+	case data == "confirm_change_ip":
+		app.handleConfirmChangeIP(bot, userID, chatID, messageID)
+
+	case data == "ip_list":
+		app.handleIPListButton(bot, userID, chatID, messageID)
+
+	case data == "add_user_ip":
+		app.handleAddUserIPButton(bot, userID, chatID, messageID)
+
+	case strings.HasPrefix(data, "del_ip_"):
+		app.handleDeleteUserIP(bot, userID, chatID, messageID, strings.TrimPrefix(data, "del_ip_"))
+
+	case data == "buy_ip_slot":
+		app.handleBuyIPSlotButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_buy_ip_slot":
+		app.handleConfirmBuyIPSlot(bot, userID, chatID, messageID)
+
+	case strings.HasPrefix(data, "token_view_"):
+		app.handleTokenView(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_view_"))
+
+	case strings.HasPrefix(data, "token_del_"):
+		app.handleDeleteTokenButton(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_del_"))
+
+	case strings.HasPrefix(data, "token_delok_"):
+		app.handleConfirmDeleteToken(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_delok_"))
+
+	case strings.HasPrefix(data, "token_renew_"):
+		app.handleRenewNamedToken(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_renew_"))
+
+	case strings.HasPrefix(data, "token_reset_"):
+		app.handleResetNamedTokenButton(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_reset_"))
+
+	case strings.HasPrefix(data, "token_resetok_"):
+		app.handleConfirmResetNamedToken(bot, userID, chatID, messageID, strings.TrimPrefix(data, "token_resetok_"))
+
+	case data == "key_batch_filter":
+		app.handleKeyBatchFilterButton(bot, userID, chatID, messageID)
+
+	case data == "key_search":
+		app.handleKeySearchButton(bot, userID, chatID, messageID)
+
+	case strings.HasPrefix(data, "key_list_"), strings.HasPrefix(data, "key_batch_"):
+		app.handleKeyListCallback(bot, userID, chatID, messageID, data)
+
+	case strings.HasPrefix(data, "check_order_"):
+		orderID := strings.TrimPrefix(data, "check_order_")
+		app.handleCheckOrderStatus(bot, userID, chatID, messageID, orderID)
+
+	case data == "admin_menu":
+		if !isAdmin(userID) {
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
+			keyboard := createMainMenuKeyboard(userID)
+			editMsg.ReplyMarkup = &keyboard
+			bot.Send(editMsg)
+			return
+		}
+		adminMsg := "🛠️ 管理员功能面板\n\n请选择操作："
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, adminMsg)
+		keyboard := createAdminMenuKeyboard()
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+
+	case data == "gen_key":
+		app.handleGenKeyButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_gen_key":
+		app.handleConfirmGenKey(bot, userID, chatID, messageID)
+
+	case data == "gen_key_batch":
+		app.handleGenKeyBatchButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_gen_key_batch":
+		app.handleConfirmGenKeyBatch(bot, userID, chatID, messageID)
+
+	case data == "void_batch":
+		app.handleVoidBatchButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_void_batch":
+		app.handleConfirmVoidBatch(bot, userID, chatID, messageID)
+
+	case data == "reissue_tokens":
+		app.handleReissueTokensButton(bot, userID, chatID, messageID)
+
+	case data == "confirm_reissue_tokens":
+		app.handleConfirmReissueTokens(bot, userID, chatID, messageID)
+
+	default:
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 未知操作")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+	}
+}
+
+// 处理获取Token按钮
+func (app *App) handleGetTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	exists, err := app.Users.UserExists(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 检查用户存在性失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	// 已有默认Token的用户继续创建命名Token
+	if exists {
+		app.handleNewTokenButton(bot, userID, chatID, messageID)
+		return
+	}
+
+	key, err := generateAESKey()
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 生成密钥失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 无法生成密钥，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	userKeys[userID] = key
+	setUserState(userID, "waiting_ip", nil, messageID)
+
+	log.Printf("[INFO] 为用户 %d 生成密钥成功", userID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🧩 已为你生成 AES 密钥\n\n📥 请输入你的公网 IP 地址以生成专属 Token：\n（IP会变动时可输入网段，例如 1.2.3.0/24）")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 用户在产品下的剩余次数，尚未使用过的产品按产品默认次数显示
+func productBalance(balances map[string]int, p *ProductConfig) int {
+	if limit, ok := balances[p.ID]; ok {
+		return limit
+	}
+	return p.DefaultLimit
+}
+
+// 各产品剩余次数文本，只有一个产品时为空
+func (app *App) productBalancesText(userID string) (string, error) {
+	if len(config.Products) <= 1 {
+		return "", nil
+	}
+	balances, err := app.Users.GetUserBalances(userID)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("\n\n📦 各产品剩余次数:")
+	for i := range config.Products {
+		p := &config.Products[i]
+		fmt.Fprintf(&b, "\n  • %s（%s）: %d 次", p.Name, p.ID, productBalance(balances, p))
+	}
+	return b.String(), nil
+}
+
+// 处理账户信息按钮
+func (app *App) handleAccountInfoButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	if userInfo == nil {
+		log.Printf("[INFO] 用户 %d 查询信息但未注册", userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	balancesText, err := app.productBalancesText(userInfo.UserID)
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %d 的产品余额失败: %v", userID, err)
+	}
+
+	infoMsg := fmt.Sprintf("🌸 你的账户信息：\n\n"+
+		"💭 用户ID: %s\n"+
+		"🌐 绑定IP: %s\n"+
+		"⚡ 剩余次数: %d\n"+
+		"📅 创建时间: %s\n"+
+		"⏳ 到期时间: %s%s\n\n"+
+		"👑 Token: ```\n%s\n```",
+		userInfo.UserID,
+		userInfo.IP,
+		userInfo.Limit,
+		userInfo.CreatedAt,
+		tokenExpiryText(userInfo.Token),
+		balancesText,
+		userInfo.Token)
+
+	tokens, err := app.Tokens.ListTokens(userInfo.UserID)
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %d 的Token列表失败: %v", userID, err)
+	}
+	if len(tokens) > 0 {
+		infoMsg += fmt.Sprintf("\n\n🔑 其他Token: %d 个（点击下方按钮查看）", len(tokens))
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, infoMsg)
+	editMsg.ParseMode = "Markdown"
+	keyboard := createMainMenuKeyboard(userID)
+	var tokenRows [][]tgbotapi.InlineKeyboardButton
+	for _, record := range tokens {
+		tokenRows = append(tokenRows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔑 "+record.Name, fmt.Sprintf("token_view_%d", record.ID)),
+		))
+	}
+	keyboard.InlineKeyboard = append(tokenRows, keyboard.InlineKeyboard...)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	log.Printf("[INFO] 用户 %d 查询账户信息成功", userID)
+}
+
+// 处理新建命名Token按钮
+func (app *App) handleNewTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	tokens, err := app.Tokens.ListTokens(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %d 的Token列表失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	// 默认Token也计入数量上限
+	if 1+len(tokens) >= config.Limits.MaxTokens {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 每个用户最多只能拥有 %d 个 Token\n\n💡 可在账户信息中删除不再使用的 Token", config.Limits.MaxTokens))
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	setUserState(userID, "waiting_token_name", nil, messageID)
+
+	msgText := fmt.Sprintf("🆕 创建新的 Token（已有 %d/%d 个）\n\n每个 Token 可绑定不同的 IP，并可使用独立的次数\n\n📥 请输入 Token 名称（1-32个字符，只能包含字母、数字、中文和 - ）：", 1+len(tokens), config.Limits.MaxTokens)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 检查Token名称，名称会显示在Markdown消息中，因此不允许特殊字符
+func validateTokenName(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length < 1 || length > 32 {
+		return fmt.Errorf("Token 名称长度需要在1-32个字符之间")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' {
+			return fmt.Errorf("Token 名称只能包含字母、数字、中文和 -")
+		}
+	}
+	if name == "默认" || strings.EqualFold(name, "default") {
+		return fmt.Errorf("Token 名称「%s」为保留名称", name)
+	}
+	return nil
+}
+
+// 处理Token名称输入
+func (app *App) handleTokenNameInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+	name := strings.TrimSpace(text)
+
+	retry := func(reason string) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ "+reason+"\n\n📥 请重新输入 Token 名称：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+	}
+
+	if err := validateTokenName(name); err != nil {
+		retry(err.Error())
+		return
+	}
+
+	tokens, err := app.Tokens.ListTokens(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %d 的Token列表失败: %v", userID, err)
+		clearUserState(userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	for _, record := range tokens {
+		if record.Name == name {
+			retry(fmt.Sprintf("Token 名称「%s」已存在", name))
+			return
+		}
+	}
+
+	setUserState(userID, "waiting_token_ip", map[string]interface{}{"name": name}, messageID)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("🔑 Token 名称: %s\n\n📥 请输入该 Token 绑定的公网 IP 地址：\n（IP会变动时可输入网段，例如 1.2.3.0/24）", name))
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理Token绑定IP输入
+func (app *App) handleTokenIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+	name := userState.Data["name"].(string)
+
+	network, err := parseIPBinding(text)
+	if err != nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ "+err.Error()+"\n\n📥 请重新输入该 Token 绑定的公网 IP 地址或网段：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+	ip := formatIPBinding(network)
+
+	ipUsed, _, err := app.Users.IPOverlaps(ip, fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 检查IP存在性失败: %v", err)
+		clearUserState(userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	if ipUsed {
+		clearUserState(userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！\n\n请使用其他IP地址。", ip))
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil || userInfo == nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		clearUserState(userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	userState.Data["ip"] = ip
+
+	msgText := fmt.Sprintf("🔑 Token 名称: %s\n🌐 绑定IP: %s\n\n⚡ 请输入分配给该 Token 的独立次数（从账户剩余 %d 次中划拨）\n💡 输入 0 表示与账户共享次数", name, ip, userInfo.Limit)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+	setUserState(userID, "waiting_token_quota", userState.Data, messageID)
+}
+
+// 处理Token独立次数输入，输入完成后签发Token
+func (app *App) handleTokenQuotaInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+	name := userState.Data["name"].(string)
+	ip := userState.Data["ip"].(string)
+
+	limit, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || limit < 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的次数（0 表示共享账户次数）：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	clearUserState(userID)
+
+	token, timestamp, err := issueToken(fmt.Sprintf("%d", userID), ip)
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 生成Token失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成 Token 出错，请重试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
 
-	userStates[userID] = &UserState{
-		State:     state,
-		Data:      data,
-		MessageID: messageID,
+	record := &TokenRecord{
+		UserID:    fmt.Sprintf("%d", userID),
+		Name:      name,
+		IP:        ip,
+		Token:     token,
+		Timestamp: timestamp,
+		OwnQuota:  limit > 0,
+		Limit:     limit,
+	}
+	if err := app.Tokens.AddToken(record, config.Limits.MaxTokens); err != nil {
+		log.Printf("[WARN] 用户 %d 创建Token「%s」失败: %v", userID, name, err)
+		reply := "❌ 系统错误，请稍后再试"
+		switch {
+		case errors.Is(err, errLimitExhausted):
+			reply = "❌ 账户剩余次数不足，无法划拨"
+		case errors.Is(err, errTooManyTokens):
+			reply = fmt.Sprintf("❌ 每个用户最多只能拥有 %d 个 Token", config.Limits.MaxTokens)
+		case errors.Is(err, errTokenNameTaken):
+			reply = fmt.Sprintf("❌ Token 名称「%s」已存在", name)
+		case errors.Is(err, errIPOverlap):
+			reply = fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！", ip)
+		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, reply)
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
+
+	log.Printf("[INFO] 用户 %d 创建Token「%s」成功，绑定IP: %s", userID, name, ip)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "✅ Token 创建成功！\n\n"+tokenDetailText(record))
+	editMsg.ParseMode = "Markdown"
+	keyboard := tokenDetailKeyboard(record.ID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
 }
 
-// 清除用户状态（更新）
-func clearUserState(userID int64) {
-	if state := userStates[userID]; state != nil && state.Timer != nil {
-		state.Timer.Stop()
+// 命名Token详情文本
+func tokenDetailText(record *TokenRecord) string {
+	quota := "与账户共享"
+	if record.OwnQuota {
+		quota = fmt.Sprintf("独立次数，剩余 %d 次", record.Limit)
 	}
-	delete(userStates, userID)
-	delete(userKeys, userID)
+	return fmt.Sprintf("🔑 Token 名称: %s\n"+
+		"🌐 绑定IP: %s\n"+
+		"⚡ 次数: %s\n"+
+		"📅 创建时间: %s\n"+
+		"⏳ 到期时间: %s\n\n"+
+		"👑 Token: ```\n%s\n```",
+		record.Name,
+		record.IP,
+		quota,
+		record.CreatedAt,
+		tokenExpiryText(record.Token),
+		record.Token)
 }
 
-// 处理用户状态输入
-func handleUserStateInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string, userState *UserState, userMessageID int) {
-	// 删除用户的输入消息
-	deleteMsg := tgbotapi.NewDeleteMessage(chatID, userMessageID)
-	bot.Request(deleteMsg)
-
-	// 重置消息超时
-	resetMessageTimeout(bot, userID, chatID, userState.MessageID)
+func tokenDetailKeyboard(id int64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏳ 续期Token", fmt.Sprintf("token_renew_%d", id)),
+			tgbotapi.NewInlineKeyboardButtonData("♻️ 重置Token", fmt.Sprintf("token_reset_%d", id)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ 删除Token", fmt.Sprintf("token_del_%d", id)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回账户信息", "account_info"),
+		),
+	)
+}
 
-	switch userState.State {
-	case "waiting_ip":
-		handleIPInput(bot, userID, chatID, text)
-	case "waiting_key":
-		handleKeyInput(bot, userID, chatID, text)
-	case "waiting_key_limit":
-		handleKeyLimitInput(bot, userID, chatID, text)
-	case "waiting_recharge_count":
-		handleRechargeCountInput(bot, userID, chatID, text)
-	case "waiting_change_ip":
-		handleChangeIPInput(bot, userID, chatID, text)
+// 查询当前用户的命名Token，不存在时回复提示并返回nil
+func (app *App) lookupUserToken(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) *TokenRecord {
+	id, err := strconv.ParseInt(idText, 10, 64)
+	var record *TokenRecord
+	if err == nil {
+		record, err = app.Tokens.GetToken(fmt.Sprintf("%d", userID), id)
+	}
+	if err != nil || record == nil {
+		if err != nil {
+			log.Printf("[WARN] 获取用户 %d 的Token %s 失败: %v", userID, idText, err)
+		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ Token 不存在或已被删除")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return nil
 	}
+	return record
 }
 
-// 获取用户状态
-func getUserState(userID int64) *UserState {
-	return userStates[userID]
+// 处理查看命名Token
+func (app *App) handleTokenView(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	record := app.lookupUserToken(bot, userID, chatID, messageID, idText)
+	if record == nil {
+		return
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, tokenDetailText(record))
+	editMsg.ParseMode = "Markdown"
+	keyboard := tokenDetailKeyboard(record.ID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
 }
 
-// 处理IP输入
-func handleIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, ip string) {
-	userState := getUserState(userID)
-	if userState == nil {
+// 处理删除命名Token按钮
+func (app *App) handleDeleteTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	record := app.lookupUserToken(bot, userID, chatID, messageID, idText)
+	if record == nil {
 		return
 	}
 
-	messageID := userState.MessageID
+	msgText := fmt.Sprintf("🗑️ 删除Token\n\n🔑 Token 名称: %s\n🌐 绑定IP: %s\n\n⚠️ 删除后该 Token 立即失效", record.Name, record.IP)
+	if record.OwnQuota && record.Limit > 0 {
+		msgText += fmt.Sprintf("\n💰 剩余的 %d 次将退回账户", record.Limit)
+	}
+	msgText += "\n\n确认删除吗？"
 
-	if isValidPublicIP(ip) {
-		ipUsed, _, err := ipExists(ip)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ 确认删除", fmt.Sprintf("token_delok_%d", record.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ 取消", fmt.Sprintf("token_view_%d", record.ID)),
+		),
+	)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理确认删除命名Token
+func (app *App) handleConfirmDeleteToken(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	id, err := strconv.ParseInt(idText, 10, 64)
+	var record *TokenRecord
+	if err == nil {
+		record, err = app.Tokens.DeleteToken(fmt.Sprintf("%d", userID), id)
+	}
+	if err != nil || record == nil {
 		if err != nil {
-			log.Printf("[ERROR] 检查IP存在性失败: %v", err)
-			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
-			keyboard := createMainMenuKeyboard(userID)
-			editMsg.ReplyMarkup = &keyboard
-			bot.Send(editMsg)
-			clearUserState(userID)
-			return
+			log.Printf("[ERROR] 删除用户 %d 的Token %s 失败: %v", userID, idText, err)
 		}
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ Token 不存在或已被删除")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
 
-		if ipUsed {
-			clearUserState(userID)
-			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 已被其他用户绑定！\n\n请使用其他IP地址。", ip))
-			keyboard := createMainMenuKeyboard(userID)
-			editMsg.ReplyMarkup = &keyboard
-			bot.Send(editMsg)
-			return
-		}
+	msgText := fmt.Sprintf("✅ Token「%s」已删除", record.Name)
+	if record.OwnQuota && record.Limit > 0 {
+		msgText += fmt.Sprintf("\n\n💰 剩余的 %d 次已退回账户", record.Limit)
+	}
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createMainMenuKeyboard(userID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	log.Printf("[INFO] 用户 %d 删除Token「%s」成功", userID, record.Name)
+}
 
-		// 生成Token
-		generateTokenForUser(bot, userID, chatID, ip, messageID)
+// 处理续期命名Token（保持当前绑定IP）
+func (app *App) handleRenewNamedToken(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	record := app.lookupUserToken(bot, userID, chatID, messageID, idText)
+	if record == nil {
+		return
+	}
 
-	} else if net.ParseIP(ip) != nil && isPrivateIP(ip) {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 禁止使用局域网地址！\n\n📥 请重新输入你的公网 IP 地址：")
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	newToken, timestamp, err := issueToken(record.UserID, record.IP)
+	if err == nil {
+		err = app.Tokens.UpdateTokenValue(record.ID, newToken, timestamp)
+	}
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 续期Token「%s」失败: %v", userID, record.Name, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 续期 Token 出错，请重试")
+		keyboard := tokenDetailKeyboard(record.ID)
+		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
+		return
+	}
 
-	} else {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 输入的不是有效的 IP 地址格式！\n\n📥 请重新输入你的公网 IP 地址：")
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-		bot.Send(editMsg)
+	msgText := fmt.Sprintf("✅ Token「%s」续期成功！\n\n```\n%s\n```\n\n🌐 绑定IP: %s\n⏳ 到期时间: %s\n\n⚠️ 旧 Token 已失效，请及时替换",
+		record.Name, newToken, record.IP, tokenExpiryText(newToken))
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ParseMode = "Markdown"
+	keyboard := tokenDetailKeyboard(record.ID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	log.Printf("[INFO] 用户 %d 续期Token「%s」成功", userID, record.Name)
+}
+
+// 处理重置命名Token按钮
+func (app *App) handleResetNamedTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	record := app.lookupUserToken(bot, userID, chatID, messageID, idText)
+	if record == nil {
+		return
 	}
+
+	msgText := fmt.Sprintf("♻️ 重置Token\n\n🔑 Token 名称: %s\n🌐 绑定IP: %s\n\n⚠️ 当前Token将被吊销并立即失效，新Token仍绑定当前IP\n💡 如果你的Token已泄露，请立即重置\n\n确认重置吗？", record.Name, record.IP)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ 确认重置", fmt.Sprintf("token_resetok_%d", record.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ 取消", fmt.Sprintf("token_view_%d", record.ID)),
+		),
+	)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
 }
 
-// 处理卡密输入
-func handleKeyInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, key string) {
-	userState := getUserState(userID)
-	if userState == nil {
+// 处理确认重置命名Token
+func (app *App) handleConfirmResetNamedToken(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, idText string) {
+	record := app.lookupUserToken(bot, userID, chatID, messageID, idText)
+	if record == nil {
 		return
 	}
 
-	messageID := userState.MessageID
+	// 吊销旧Token和保存新Token在同一事务中完成，失败时旧Token保持不变
+	newToken, timestamp, err := issueToken(record.UserID, record.IP)
+	if err == nil {
+		err = app.Tokens.RotateTokenValue(record.UserID, record.ID, record.Timestamp, newToken, timestamp, record.UserID, "用户重置")
+	}
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 重置Token「%s」失败: %v", userID, record.Name, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 重置 Token 失败，请重试")
+		keyboard := tokenDetailKeyboard(record.ID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	msgText := fmt.Sprintf("✅ Token「%s」重置成功！\n\n```\n%s\n```\n\n🌐 绑定IP: %s\n\n⚠️ 旧 Token 已吊销，请及时替换", record.Name, newToken, record.IP)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ParseMode = "Markdown"
+	keyboard := tokenDetailKeyboard(record.ID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	log.Printf("[INFO] 用户 %d 重置Token「%s」成功", userID, record.Name)
+}
 
-	userInfo, err := getUserInfo(fmt.Sprintf("%d", userID))
+// 处理续期Token按钮（保持当前绑定IP）
+func (app *App) handleRenewTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
 	if err != nil {
 		log.Printf("[ERROR] 获取用户信息失败: %v", err)
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
 	if userInfo == nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取 Token")
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	addLimit, err := useKey(key, fmt.Sprintf("%d", userID))
+	newToken, timestamp, err := issueToken(userInfo.UserID, userInfo.IP)
 	if err != nil {
-		log.Printf("[WARN] 用户 %d 使用卡密失败: %v", userID, err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ %s\n\n🎉 请重新输入你的卡密：", err.Error()))
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		log.Printf("[ERROR] 为用户 %d 续期Token失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 续期 Token 出错，请重试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	err = updateUserLimit(fmt.Sprintf("%d", userID), addLimit)
-	if err != nil {
-		log.Printf("[ERROR] 更新用户次数失败: %v", err)
+	if err := app.Users.UpdateUserIPAndToken(userInfo.UserID, userInfo.IP, newToken, timestamp); err != nil {
+		log.Printf("[ERROR] 保存续期Token失败: %v", err)
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	newLimit := userInfo.Limit + addLimit
-	msgText := fmt.Sprintf("✅ 卡密使用成功！\n\n⚡ 增加次数: %d\n💫 当前总次数: %d", addLimit, newLimit)
+	msgText := fmt.Sprintf("✅ Token 续期成功！\n\n```\n%s\n```\n\n🌐 绑定IP: %s\n⏳ 到期时间: %s\n\n⚠️ 旧 Token 已失效，请及时替换",
+		newToken, userInfo.IP, tokenExpiryText(newToken))
 	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ParseMode = "Markdown"
 	keyboard := createMainMenuKeyboard(userID)
 	editMsg.ReplyMarkup = &keyboard
 	bot.Send(editMsg)
-	clearUserState(userID)
-	log.Printf("[INFO] 用户 %d 使用卡密成功: %s, 增加次数: %d", userID, key, addLimit)
+	log.Printf("[INFO] 用户 %d 续期Token成功", userID)
 }
 
-// 处理卡密次数输入
-func handleKeyLimitInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
-	userState := getUserState(userID)
-	if userState == nil {
+// 处理重置Token按钮
+func (app *App) handleResetTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
 		return
 	}
 
-	messageID := userState.MessageID
+	if userInfo == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
 
-	limit, err := strconv.Atoi(text)
-	if err != nil || limit <= 0 {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的正整数\n\n🎉 生成卡密\n\n请输入卡密可增加的次数：")
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	msgText := fmt.Sprintf("♻️ 重置Token\n\n🌐 绑定IP: %s\n\n⚠️ 当前Token将被吊销并立即失效，新Token仍绑定当前IP\n💡 如果你的Token已泄露，请立即重置\n\n确认重置吗？", userInfo.IP)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createConfirmKeyboard("reset_token")
+	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+	))
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理确认重置Token
+func (app *App) handleConfirmResetToken(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
+	if err != nil || userInfo == nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	userState.Data["limit"] = limit
+	// 吊销旧Token和保存新Token在同一事务中完成，失败时旧Token保持不变
+	newToken, timestamp, err := issueToken(userInfo.UserID, userInfo.IP)
+	if err == nil {
+		err = app.Users.RotateUserToken(userInfo.UserID, userInfo.Timestamp, newToken, timestamp, userInfo.UserID, "用户重置")
+	}
+	if err != nil {
+		log.Printf("[ERROR] 为用户 %d 重置Token失败: %v", userID, err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 重置 Token 失败，请重试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
 
-	confirmMsg := fmt.Sprintf("📋 确认生成卡密信息：\n\n⚡ 次数: %d\n\n确认生成吗？", limit)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
-	keyboard := createConfirmKeyboard("gen_key")
+	msgText := fmt.Sprintf("✅ Token 重置成功！\n\n```\n%s\n```\n\n🌐 绑定IP: %s\n\n⚠️ 旧 Token 已吊销，请及时替换", newToken, userInfo.IP)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ParseMode = "Markdown"
+	keyboard := createMainMenuKeyboard(userID)
 	editMsg.ReplyMarkup = &keyboard
 	bot.Send(editMsg)
+	log.Printf("[INFO] 用户 %d 重置Token成功", userID)
 }
 
-// 处理充值次数输入
-func handleRechargeCountInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
-	userState := getUserState(userID)
-	if userState == nil {
+// 处理管理员吊销命令: /revoke <用户ID>
+func (app *App) handleRevokeCommand(bot *tgbotapi.BotAPI, userID int64, chatID int64, args string) {
+	reply := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = createMainMenuKeyboard(userID)
+		sentMsg, err := bot.Send(msg)
+		if err == nil {
+			setMessageTimeout(bot, userID, chatID, sentMsg.MessageID)
+		}
+	}
+
+	if !isAdmin(userID) {
+		reply("❌ 你没有管理员权限")
 		return
 	}
 
-	messageID := userState.MessageID
+	targetID := strings.TrimSpace(args)
+	if targetID == "" {
+		reply("❌ 用法: /revoke <用户ID>")
+		return
+	}
 
-	count, err := strconv.Atoi(text)
-	if err != nil || count <= 0 {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的整数\n\n💰 请输入要充值的次数：\n\n💡 按次计费：每次 0.1 ¥")
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-		bot.Send(editMsg)
+	userInfo, err := app.Users.GetUser(targetID)
+	if err != nil {
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		reply("❌ 系统错误，请稍后再试")
+		return
+	}
+	if userInfo == nil {
+		reply(fmt.Sprintf("❌ 用户 %s 不存在", targetID))
 		return
 	}
 
-	totalPrice := float64(count) * config.Payment.PricePerUse
+	err = app.Users.RevokeToken(userInfo.UserID, userInfo.Timestamp, fmt.Sprintf("%d", userID), "管理员吊销")
+	if err != nil {
+		log.Printf("[ERROR] 吊销用户 %s 的Token失败: %v", targetID, err)
+		reply("❌ 吊销失败，请稍后再试")
+		return
+	}
 
-	userState.Data["count"] = count
-	userState.Data["price"] = totalPrice
+	// 命名Token一并吊销
+	revoked := 1
+	tokens, err := app.Tokens.ListTokens(userInfo.UserID)
+	if err != nil {
+		log.Printf("[ERROR] 获取用户 %s 的Token列表失败: %v", targetID, err)
+	}
+	for _, record := range tokens {
+		if err := app.Users.RevokeToken(record.UserID, record.Timestamp, fmt.Sprintf("%d", userID), "管理员吊销"); err != nil {
+			log.Printf("[WARN] 吊销用户 %s 的Token「%s」失败: %v", targetID, record.Name, err)
+			continue
+		}
+		revoked++
+	}
+
+	reply(fmt.Sprintf("✅ 已吊销用户 %s 的 %d 个 Token", targetID, revoked))
+	log.Printf("[INFO] 管理员 %d 吊销了用户 %s 的 %d 个Token", userID, targetID, revoked)
+
+	if targetChatID, err := strconv.ParseInt(targetID, 10, 64); err == nil {
+		notice := tgbotapi.NewMessage(targetChatID, "⚠️ 你的 Token 已被管理员吊销\n\n💡 请使用「♻️ 重置Token」获取新的 Token，命名Token请在账户信息中逐个重置")
+		if _, err := bot.Send(notice); err != nil {
+			log.Printf("[WARN] 通知用户 %s Token吊销失败: %v", targetID, err)
+		}
+	}
+}
 
-	confirmMsg := fmt.Sprintf("📋 确认充值信息：\n\n⚡ 次数: %d\n💰 金额: %.2f 元\n💳 支付方式: 微信支付\n\n确认创建订单吗？", count, totalPrice)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
-	keyboard := createConfirmKeyboard("recharge")
-	editMsg.ReplyMarkup = &keyboard
-	bot.Send(editMsg)
+// 获取Token到期时间的显示文本
+func tokenExpiryText(token string) string {
+	_, payload, err := openToken(token)
+	if err != nil {
+		return "未知"
+	}
+	if payload.ExpiresAt == 0 {
+		return "永久有效"
+	}
+	return time.Unix(0, payload.ExpiresAt*int64(time.Millisecond)).In(chinaLocation).Format("2006-01-02 15:04:05 CST")
 }
 
-// 处理充值按钮
-func handleRechargeButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	userInfo, err := getUserInfo(fmt.Sprintf("%d", userID))
+// 处理使用卡密按钮
+func (app *App) handleUseKeyButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
 	if err != nil {
 		log.Printf("[ERROR] 获取用户信息失败: %v", err)
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
@@ -1333,8 +6277,12 @@ func handleRechargeButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, mess
 		return
 	}
 
-	setUserState(userID, "waiting_recharge_count", make(map[string]interface{}), messageID)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("💰 请输入要充值的次数：\n\n💡 每次 %.2f 元\n🎯 当前剩余次数: %d", config.Payment.PricePerUse, userInfo.Limit))
+	if app.replyIfKeyLocked(bot, userID, chatID, messageID, time.Now()) {
+		return
+	}
+
+	setUserState(userID, "waiting_key", nil, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🎉 请输入你的卡密：")
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
@@ -1344,39 +6292,54 @@ func handleRechargeButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, mess
 	bot.Send(editMsg)
 }
 
-// 处理确认充值
-func handleConfirmRecharge(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	userState := getUserState(userID)
-	if userState == nil || userState.Data["count"] == nil || userState.Data["price"] == nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
+// 处理生成卡密按钮
+func (app *App) handleGenKeyButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	count := userState.Data["count"].(int)
-	price := userState.Data["price"].(float64)
+	// 多个产品时先选择卡密所属产品
+	if len(config.Products) > 1 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🎉 生成卡密\n\n请选择卡密所属产品：")
+		keyboard := productPickerKeyboard("gen_key_p_", "🔙 返回管理员菜单", "admin_menu")
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
 
-	payID := fmt.Sprintf("RECHARGE_%d_%d", userID, time.Now().UnixNano())
+	app.handleGenKeyProduct(bot, userID, chatID, messageID, defaultProductID)
+}
 
-	order := &Order{
-		PayID:      payID,
-		UserID:     fmt.Sprintf("%d", userID),
-		Count:      count,
-		GoodsName:  fmt.Sprintf("充值%d次使用次数", count),
-		Price:      price,
-		Status:     "pending",
-		CreateTime: time.Now(),
-		ChatID:     chatID,
-		MessageID:  messageID,
+// 处理生成卡密的产品选择
+func (app *App) handleGenKeyProduct(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, productID string) {
+	if !isAdmin(userID) || findProduct(productID) == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限或产品不存在")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
 
-	err := saveOrderToDB(order)
-	if err != nil {
-		log.Printf("[ERROR] 保存订单失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+	setUserState(userID, "waiting_key_limit", map[string]interface{}{"product": productID}, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("🎉 生成卡密\n\n%s请输入卡密可增加的次数：\n\n💡 默认次数: %d", productLine(productID), config.Limits.KeyAddLimit))
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理确认生成卡密
+func (app *App) handleConfirmGenKey(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	userState := getUserState(userID)
+	if userState == nil || userState.Data["limit"] == nil || userState.Data["max_uses"] == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
@@ -1384,21 +6347,14 @@ func handleConfirmRecharge(bot *tgbotapi.BotAPI, userID int64, chatID int64, mes
 		return
 	}
 
-	req := &CreateOrderRequest{
-		PayID:     payID,
-		Type:      1, // 微信支付
-		Price:     price,
-		GoodsName: order.GoodsName,
-		Param:     fmt.Sprintf("%d", userID),
-		IsHTML:    0,
-		NotifyURL: config.Payment.NotifyURL,
-		ReturnURL: config.Payment.ReturnURL,
-	}
+	addLimit := userState.Data["limit"].(int)
+	maxUses := userState.Data["max_uses"].(int)
+	product := userState.Data["product"].(string)
 
-	result, err := epayClient.CreateOrder(req)
+	_, keys, err := app.Keys.AddKeys(KeyBatchOptions{Count: 1, AddLimit: addLimit, MaxUses: maxUses, Product: product}, userID)
 	if err != nil {
-		log.Printf("[ERROR] 创建订单失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+		log.Printf("[ERROR] 生成卡密失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成卡密失败")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
@@ -1406,150 +6362,210 @@ func handleConfirmRecharge(bot *tgbotapi.BotAPI, userID int64, chatID int64, mes
 		return
 	}
 
-	if result.Code != 1 {
-		log.Printf("[ERROR] 创建订单失败: %s", result.Msg)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 创建订单失败: %s", result.Msg))
+	key := keys[0].Key
+	msgText := fmt.Sprintf("🎉 卡密生成成功：\n\n```\n%s\n```\n\n%s⚡ 可增加次数: %d\n👥 可使用人数: %d\n\n📌 请妥善保存此卡密", key, productLine(product), addLimit, maxUses)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	editMsg.ParseMode = "Markdown"
+	keyboard := createMainMenuKeyboard(userID)
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+	clearUserState(userID)
+	log.Printf("[INFO] 管理员 %d 生成卡密: %s, 产品: %s, 次数: %d, 可使用人数: %d", userID, key, product, addLimit, maxUses)
+}
+
+// 处理批量生成卡密按钮
+func (app *App) handleGenKeyBatchButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	// 保存易支付订单号到数据库
-	err = updateOrderWithEpayInfo(payID, result.Data.OrderID, result.Data.ReallyPrice, result.Data.PayType)
-	if err != nil {
-		log.Printf("[ERROR] 更新订单信息失败: %v", err)
+	if len(config.Products) > 1 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "📦 批量生成卡密\n\n请选择卡密所属产品：")
+		keyboard := productPickerKeyboard("gen_key_batch_p_", "🔙 返回管理员菜单", "admin_menu")
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
 
-	msgText := fmt.Sprintf("🎉 订单创建成功！\n\n"+
-		"📦 商品: %s\n"+
-		"💰 金额: %.2f 元\n"+
-		"📋 订单号: %s\n\n"+
-		"🔗 请点击下方链接完成支付：\n%s\n\n"+
-		"⏰ 订单有效期: %d 分钟\n"+
-		"💡 支付完成后次数将自动到账",
-		order.GoodsName,
-		result.Data.Price,
-		result.Data.OrderID,
-		result.Data.PayURL,
-		result.Data.TimeOut)
+	app.handleGenKeyBatchProduct(bot, userID, chatID, messageID, defaultProductID)
+}
 
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+// 处理批量生成卡密的产品选择
+func (app *App) handleGenKeyBatchProduct(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, productID string) {
+	if !isAdmin(userID) || findProduct(productID) == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限或产品不存在")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	setUserState(userID, "waiting_batch_count", map[string]interface{}{"product": productID}, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("📦 批量生成卡密\n\n%s请输入生成数量（1-%d）：", productLine(productID), maxKeyBatchSize))
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonURL("💳 去支付", result.Data.PayURL),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
 		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理批量生成数量输入
+func (app *App) handleBatchCountInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔄 查询订单状态", "check_order_"+result.Data.OrderID),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
 		),
+	}
+
+	count, err := strconv.Atoi(text)
+	if err != nil || count <= 0 || count > maxKeyBatchSize {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 请输入 1-%d 之间的整数\n\n📦 批量生成卡密\n\n请输入生成数量：", maxKeyBatchSize))
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	userState.Data["count"] = count
+	setUserState(userID, "waiting_batch_limit", userState.Data, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("📦 批量生成卡密\n\n📊 数量: %d\n\n请输入每张卡密可增加的次数：\n\n💡 默认次数: %d", count, config.Limits.KeyAddLimit))
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理批量生成每张卡密次数输入
+func (app *App) handleBatchLimitInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	limit, err := strconv.Atoi(text)
+	if err != nil || limit <= 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的正整数\n\n📦 批量生成卡密\n\n请输入每张卡密可增加的次数：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	userState.Data["limit"] = limit
+	setUserState(userID, "waiting_batch_expiry", userState.Data, messageID)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "📦 批量生成卡密\n\n请输入卡密有效天数：\n\n💡 输入 0 表示永不过期")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
 		),
 	}
 	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 	bot.Send(editMsg)
-
-	clearUserState(userID)
-	log.Printf("[INFO] 用户 %d 创建充值订单: %s, 次数: %d, 金额: %.2f", userID, payID, count, price)
 }
 
-// 处理查询订单状态
-func handleCheckOrderStatus(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, orderID string) {
-	result, err := epayClient.GetOrder(orderID)
-	if err != nil {
-		log.Printf("[ERROR] 查询订单失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 查询订单失败，请稍后再试")
-		keyboard := createMainMenuKeyboard(userID)
-		editMsg.ReplyMarkup = &keyboard
-		bot.Send(editMsg)
+// 处理批量生成有效天数输入
+func (app *App) handleBatchExpiryInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
 		return
 	}
 
-	if result.Code != 1 {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 查询订单失败: %s", result.Msg))
-		keyboard := createMainMenuKeyboard(userID)
-		editMsg.ReplyMarkup = &keyboard
+	messageID := userState.MessageID
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+		),
+	}
+
+	days, err := strconv.Atoi(text)
+	if err != nil || days < 0 {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 请输入有效的非负整数\n\n📦 批量生成卡密\n\n请输入卡密有效天数：\n\n💡 输入 0 表示永不过期")
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 		bot.Send(editMsg)
 		return
 	}
 
-	var statusText string
-	var keyboard [][]tgbotapi.InlineKeyboardButton
+	userState.Data["expiry_days"] = days
+	setUserState(userID, "waiting_batch_channel", userState.Data, messageID)
 
-	order, err := getOrderByPayID(result.Data.PayID)
-	if err == nil && order != nil && order.Status == "paid" {
-		statusText = "✅ 已支付完成"
-		keyboard = [][]tgbotapi.InlineKeyboardButton{
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("📦 批量生成卡密\n\n请输入渠道/代理标签（最多%d个字符）：\n\n💡 输入 - 跳过", maxKeyChannelLen))
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理批量生成渠道标签输入
+func (app *App) handleBatchChannelInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+
+	channel := strings.TrimSpace(text)
+	if channel == "-" {
+		channel = ""
+	}
+	if len([]rune(channel)) > maxKeyChannelLen {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 标签过长\n\n📦 批量生成卡密\n\n请输入渠道/代理标签（最多%d个字符）：\n\n💡 输入 - 跳过", maxKeyChannelLen))
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
 			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
 			),
 		}
-	} else {
-		switch result.Data.State {
-		case 0:
-			statusText = "⏳ 等待支付"
-			keyboard = [][]tgbotapi.InlineKeyboardButton{
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonURL("💳 去支付", result.Data.PayURL),
-				),
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔄 刷新状态", "check_order_"+orderID),
-				),
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-				),
-			}
-		case 1:
-			statusText = "✅ 已支付完成"
-			keyboard = [][]tgbotapi.InlineKeyboardButton{
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-				),
-			}
-		case 2:
-			statusText = "❌ 支付失败"
-			keyboard = [][]tgbotapi.InlineKeyboardButton{
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-				),
-			}
-		default:
-			statusText = "❓ 未知状态"
-			keyboard = [][]tgbotapi.InlineKeyboardButton{
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔄 刷新状态", "check_order_"+orderID),
-				),
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-				),
-			}
-		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
 	}
 
-	msgText := fmt.Sprintf("📋 订单状态查询\n\n"+
-		"📦 商品: %s\n"+
-		"💰 金额: %.2f 元\n"+
-		"📋 订单号: %s\n"+
-		"📊 状态: %s",
-		result.Data.PayID,
-		result.Data.Price,
-		result.Data.OrderID,
-		statusText)
+	userState.Data["channel"] = channel
+
+	expiryText := "永不过期"
+	if days := userState.Data["expiry_days"].(int); days > 0 {
+		expiryText = fmt.Sprintf("%d 天", days)
+	}
+	channelText := channel
+	if channelText == "" {
+		channelText = "无"
+	}
 
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
-	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	confirmMsg := fmt.Sprintf("📋 确认批量生成卡密：\n\n%s📊 数量: %d\n⚡ 每张次数: %d\n⏳ 有效期: %s\n🏷️ 渠道: %s\n\n确认生成吗？",
+		productLine(userState.Data["product"].(string)), userState.Data["count"].(int), userState.Data["limit"].(int), expiryText, channelText)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
+	keyboard := createConfirmKeyboard("gen_key_batch")
+	editMsg.ReplyMarkup = &keyboard
 	bot.Send(editMsg)
 }
 
-// 生成Token
-func generateTokenForUser(bot *tgbotapi.BotAPI, userID int64, chatID int64, ip string, messageID int) {
-	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+// 处理确认批量生成卡密，生成后以CSV文件发送
+func (app *App) handleConfirmGenKeyBatch(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
 
-	deterministicKey, err := generateDeterministicKey(fmt.Sprintf("%d", userID), timestamp)
-	if err != nil {
-		log.Printf("[ERROR] 生成确定性密钥失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成 Token 出错，请重试")
+	userState := getUserState(userID)
+	if userState == nil || userState.Data["count"] == nil || userState.Data["limit"] == nil || userState.Data["channel"] == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
@@ -1557,286 +6573,614 @@ func generateTokenForUser(bot *tgbotapi.BotAPI, userID int64, chatID int64, ip s
 		return
 	}
 
-	payload := Payload{
-		UserID:    fmt.Sprintf("%d", userID),
-		IP:        ip,
-		Timestamp: timestamp,
+	count := userState.Data["count"].(int)
+	addLimit := userState.Data["limit"].(int)
+	opts := KeyBatchOptions{
+		Count:    count,
+		AddLimit: addLimit,
+		Channel:  userState.Data["channel"].(string),
+		Product:  userState.Data["product"].(string),
 	}
+	if days := userState.Data["expiry_days"].(int); days > 0 {
+		expiresAt := time.Now().In(chinaLocation).AddDate(0, 0, days)
+		opts.ExpiresAt = &expiresAt
+	}
+	clearUserState(userID)
 
-	token, err := encryptPayload(payload, deterministicKey)
+	batchID, keys, err := app.Keys.AddKeys(opts, userID)
 	if err != nil {
-		log.Printf("[ERROR] 为用户 %d 生成 Token 失败: %v", userID, err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成 Token 出错，请重试")
-		keyboard := createMainMenuKeyboard(userID)
+		log.Printf("[ERROR] 批量生成卡密失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 批量生成卡密失败")
+		keyboard := createAdminMenuKeyboard()
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	err = addUserRecord(fmt.Sprintf("%d", userID), ip, token, config.Limits.DefaultLimit, timestamp)
-	if err != nil {
-		log.Printf("[ERROR] 保存用户记录失败: %v", err)
+	content, err := buildKeyBatchCSV(keys)
+	if err == nil {
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+			Name:  fmt.Sprintf("keys_%s.csv", batchID),
+			Bytes: content,
+		})
+		doc.Caption = fmt.Sprintf("📦 批次 %s\n📊 数量: %d\n⚡ 每张次数: %d", batchID, count, addLimit)
+		_, err = bot.Send(doc)
 	}
 
-	result := fmt.Sprintf("🎉 你的 Token 生成成功！\n\n```\n%s\n```\n\n📌 请妥善保存，用于身份验证\n⚡ 初始额度: %d 次\n\n💡 使用账户信息按钮查看详情", token, config.Limits.DefaultLimit)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, result)
-	editMsg.ParseMode = "Markdown"
-	keyboard := createMainMenuKeyboard(userID)
+	msgText := fmt.Sprintf("✅ 批量生成卡密成功\n\n🏷️ 批次: %s\n📊 数量: %d\n⚡ 每张次数: %d\n\n📌 卡密文件已发送，请妥善保存", batchID, count, addLimit)
+	if err != nil {
+		log.Printf("[ERROR] 发送卡密文件失败: 批次 %s, %v", batchID, err)
+		msgText = fmt.Sprintf("⚠️ 卡密已生成，但文件发送失败\n\n🏷️ 批次: %s\n📊 数量: %d\n⚡ 每张次数: %d", batchID, count, addLimit)
+	}
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createAdminMenuKeyboard()
 	editMsg.ReplyMarkup = &keyboard
 	bot.Send(editMsg)
-
-	clearUserState(userID)
-	log.Printf("[INFO] ✅ 为用户 %d 生成 Token 成功，IP: %s, 时间戳: %d", userID, ip, timestamp)
+	log.Printf("[INFO] 管理员 %d 批量生成卡密: 批次 %s, 产品 %s, 数量 %d, 次数 %d", userID, batchID, opts.Product, count, addLimit)
 }
 
-// 处理回调查询
-func handleCallbackQuery(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
-	userID := query.From.ID
-	chatID := query.Message.Chat.ID
-	messageID := query.Message.MessageID
-	data := query.Data
-
-	resetMessageTimeout(bot, userID, chatID, messageID)
-
-	callback := tgbotapi.NewCallback(query.ID, "")
-	bot.Request(callback)
-
-	log.Printf("[INFO] 用户 %d 点击按钮: %s", userID, data)
-
-	switch {
-	case data == "main_menu":
-		clearUserState(userID)
-		welcomeMsg := "🎉 欢迎使用 Token 验证系统！\n\n请选择你需要的功能："
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, welcomeMsg)
+// 处理作废批次按钮
+func (app *App) handleVoidBatchButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
+		return
+	}
 
-	case data == "get_token":
-		handleGetTokenButton(bot, userID, chatID, messageID)
-
-	case data == "account_info":
-		handleAccountInfoButton(bot, userID, chatID, messageID)
-
-	case data == "use_key":
-		handleUseKeyButton(bot, userID, chatID, messageID)
-
-	case data == "recharge":
-		handleRechargeButton(bot, userID, chatID, messageID)
-
-	case data == "change_ip":
-		handleChangeIPButton(bot, userID, chatID, messageID)
-
-	case data == "confirm_recharge":
-		handleConfirmRecharge(bot, userID, chatID, messageID)
-
-	case data == "confirm_change_ip":
-		handleConfirmChangeIP(bot, userID, chatID, messageID)
+	setUserState(userID, "waiting_void_batch", nil, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🚫 作废卡密批次\n\n请输入要作废的批次ID：\n\n💡 批次中未使用的卡密将全部失效")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
 
-	case strings.HasPrefix(data, "check_order_"):
-		orderID := strings.TrimPrefix(data, "check_order_")
-		handleCheckOrderStatus(bot, userID, chatID, messageID, orderID)
+// 处理作废批次ID输入
+func (app *App) handleVoidBatchInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
 
-	case data == "admin_menu":
-		if !isAdmin(userID) {
-			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
-			keyboard := createMainMenuKeyboard(userID)
-			editMsg.ReplyMarkup = &keyboard
-			bot.Send(editMsg)
-			return
+	batchID := strings.ToUpper(strings.TrimSpace(text))
+	if !validBatchID(batchID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, userState.MessageID, "❌ 批次ID格式错误\n\n请重新输入要作废的批次ID：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+			),
 		}
-		adminMsg := "🛠️ 管理员功能面板\n\n请选择操作："
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, adminMsg)
-		keyboard := createAdminMenuKeyboard()
-		editMsg.ReplyMarkup = &keyboard
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 		bot.Send(editMsg)
+		return
+	}
+	userState.Data["batch_id"] = batchID
 
-	case data == "gen_key":
-		handleGenKeyButton(bot, userID, chatID, messageID)
-
-	case data == "confirm_gen_key":
-		handleConfirmGenKey(bot, userID, chatID, messageID)
+	confirmMsg := fmt.Sprintf("⚠️ 确认作废批次 %s 中所有未使用的卡密吗？\n\n此操作不可撤销", batchID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, userState.MessageID, confirmMsg)
+	keyboard := createConfirmKeyboard("void_batch")
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
 
-	default:
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 未知操作")
+// 处理确认作废批次
+func (app *App) handleConfirmVoidBatch(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
+		return
 	}
-}
 
-// 处理获取Token按钮
-func handleGetTokenButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	exists, err := userExists(fmt.Sprintf("%d", userID))
-	if err != nil {
-		log.Printf("[ERROR] 检查用户存在性失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+	userState := getUserState(userID)
+	if userState == nil || userState.Data["batch_id"] == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
+		clearUserState(userID)
 		return
 	}
 
-	if exists {
-		log.Printf("[WARN] 用户 %d 尝试重复获取token", userID)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你已经获取过 Token，每个用户只能获取一次\n\n💡 使用账户信息按钮查看你的信息")
+	batchID := userState.Data["batch_id"].(string)
+	clearUserState(userID)
+
+	disabled, err := app.Keys.DisableBatch(batchID)
+	var msgText string
+	switch {
+	case err != nil:
+		log.Printf("[ERROR] 作废卡密批次失败: %v", err)
+		msgText = "❌ 作废批次失败，请稍后再试"
+	case disabled == 0:
+		msgText = fmt.Sprintf("ℹ️ 批次 %s 不存在或没有可作废的卡密", batchID)
+	default:
+		msgText = fmt.Sprintf("✅ 批次 %s 已作废\n\n🚫 作废卡密: %d 张", batchID, disabled)
+		log.Printf("[INFO] 管理员 %d 作废卡密批次: %s, 数量 %d", userID, batchID, disabled)
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createAdminMenuKeyboard()
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 卡密库存每页显示数量
+const keyListPageSize = 10
+
+// 卡密列表分页回调数据：key_list_<状态>_<页码> 或 key_batch_<页码>_<批次ID>
+func keyListCallback(filter KeyFilter, page int) string {
+	if filter.BatchID != "" {
+		return fmt.Sprintf("key_batch_%d_%s", page, filter.BatchID)
+	}
+	return fmt.Sprintf("key_list_%s_%d", filter.Status, page)
+}
+
+// 处理卡密库存分页回调
+func (app *App) handleKeyListCallback(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, data string) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	key, err := generateAESKey()
+	var filter KeyFilter
+	var pageText string
+	if strings.HasPrefix(data, "key_batch_") {
+		parts := strings.SplitN(strings.TrimPrefix(data, "key_batch_"), "_", 2)
+		if len(parts) == 2 {
+			pageText, filter.BatchID = parts[0], parts[1]
+		}
+	} else {
+		parts := strings.SplitN(strings.TrimPrefix(data, "key_list_"), "_", 2)
+		if len(parts) == 2 {
+			filter.Status, pageText = parts[0], parts[1]
+		}
+	}
+	page, _ := strconv.Atoi(pageText)
+
+	app.showKeyList(bot, userID, chatID, messageID, filter, page)
+}
+
+// 显示卡密库存列表
+func (app *App) showKeyList(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, filter KeyFilter, page int) {
+	if page < 0 {
+		page = 0
+	}
+	if filter.BatchID == "" && filter.Status == "" {
+		filter.Status = keyStatusAll
+	}
+
+	keys, total, err := app.Keys.ListKeys(filter, page*keyListPageSize, keyListPageSize)
 	if err != nil {
-		log.Printf("[ERROR] 为用户 %d 生成密钥失败: %v", userID, err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 无法生成密钥，请稍后再试")
-		keyboard := createMainMenuKeyboard(userID)
+		log.Printf("[ERROR] 查询卡密库存失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 查询卡密库存失败，请稍后再试")
+		keyboard := createAdminMenuKeyboard()
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	userKeys[userID] = key
-	setUserState(userID, "waiting_ip", nil, messageID)
+	filterText := map[string]string{keyStatusAll: "全部", keyStatusUnused: "未使用", keyStatusUsed: "已使用"}[filter.Status]
+	if filter.BatchID != "" {
+		filterText = "批次 " + filter.BatchID
+	}
+	pages := (total + keyListPageSize - 1) / keyListPageSize
+	if pages == 0 {
+		pages = 1
+	}
 
-	log.Printf("[INFO] 为用户 %d 生成密钥成功", userID)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🧩 已为你生成 AES 密钥\n\n📥 请输入你的公网 IP 地址以生成专属 Token：")
-	keyboard := [][]tgbotapi.InlineKeyboardButton{
+	var b strings.Builder
+	fmt.Fprintf(&b, "📋 卡密库存（%s）\n📄 第 %d/%d 页，共 %d 张\n", filterText, page+1, pages, total)
+	if len(keys) == 0 {
+		b.WriteString("\n暂无卡密")
+	}
+	for i, k := range keys {
+		fmt.Fprintf(&b, "\n%d. %s\n   %s ⚡%d 👥%d/%d", page*keyListPageSize+i+1, k.Key, keyStatusText(k), k.AddLimit, k.UsesCount, k.MaxUses)
+		if k.UsedBy != "" {
+			fmt.Fprintf(&b, "\n   👤 %s · %s", k.UsedBy, k.UsedAt)
+		}
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	var nav []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("⬅️ 上一页", keyListCallback(filter, page-1)))
+	}
+	if page+1 < pages {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("➡️ 下一页", keyListCallback(filter, page+1)))
+	}
+	if len(nav) > 0 {
+		keyboard = append(keyboard, nav)
+	}
+	keyboard = append(keyboard,
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			tgbotapi.NewInlineKeyboardButtonData("📋 全部", keyListCallback(KeyFilter{Status: keyStatusAll}, 0)),
+			tgbotapi.NewInlineKeyboardButtonData("🟢 未使用", keyListCallback(KeyFilter{Status: keyStatusUnused}, 0)),
+			tgbotapi.NewInlineKeyboardButtonData("🔴 已使用", keyListCallback(KeyFilter{Status: keyStatusUsed}, 0)),
 		),
-	}
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🏷️ 按批次", "key_batch_filter"),
+			tgbotapi.NewInlineKeyboardButtonData("🔍 查询卡密", "key_search"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+		),
+	)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, b.String())
 	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 	bot.Send(editMsg)
 }
 
-// 处理账户信息按钮
-func handleAccountInfoButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	userInfo, err := getUserInfo(fmt.Sprintf("%d", userID))
-	if err != nil {
-		log.Printf("[ERROR] 获取用户信息失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
-		keyboard := createMainMenuKeyboard(userID)
-		editMsg.ReplyMarkup = &keyboard
-		bot.Send(editMsg)
-		return
+// 卡密状态描述
+func keyStatusText(k KeyRecord) string {
+	expiresAt, _ := keyExpiresAt(&k)
+	switch {
+	case k.Disabled:
+		return "🚫 已作废"
+	case k.Used:
+		return "🔴 已用完"
+	case expiresAt.Valid && time.Now().After(expiresAt.Time):
+		return "⏰ 已过期"
+	case k.UsesCount > 0:
+		return "🟡 部分使用"
+	default:
+		return "🟢 未使用"
 	}
+}
 
-	if userInfo == nil {
-		log.Printf("[INFO] 用户 %d 查询信息但未注册", userID)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+// 处理按批次筛选按钮
+func (app *App) handleKeyBatchFilterButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	infoMsg := fmt.Sprintf("🌸 你的账户信息：\n\n"+
-		"💭 用户ID: %s\n"+
-		"🌐 绑定IP: %s\n"+
-		"⚡ 剩余次数: %d\n"+
-		"📅 创建时间: %s\n\n"+
-		"👑 Token: ```\n%s\n```",
-		userInfo.UserID,
-		userInfo.IP,
-		userInfo.Limit,
-		userInfo.CreatedAt,
-		userInfo.Token)
-
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, infoMsg)
-	editMsg.ParseMode = "Markdown"
-	keyboard := createMainMenuKeyboard(userID)
-	editMsg.ReplyMarkup = &keyboard
+	setUserState(userID, "waiting_key_batch_filter", nil, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🏷️ 按批次查看卡密\n\n请输入批次ID：")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回卡密库存", "key_list_all_0"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 	bot.Send(editMsg)
-	log.Printf("[INFO] 用户 %d 查询账户信息成功", userID)
 }
 
-// 处理使用卡密按钮
-func handleUseKeyButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	userInfo, err := getUserInfo(fmt.Sprintf("%d", userID))
-	if err != nil {
-		log.Printf("[ERROR] 获取用户信息失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
-		keyboard := createMainMenuKeyboard(userID)
-		editMsg.ReplyMarkup = &keyboard
+// 处理批次ID输入
+func (app *App) handleKeyBatchFilterInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	batchID := strings.ToUpper(strings.TrimSpace(text))
+	if !validBatchID(batchID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, userState.MessageID, "❌ 批次ID格式错误\n\n🏷️ 请重新输入批次ID：")
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回卡密库存", "key_list_all_0"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 		bot.Send(editMsg)
 		return
 	}
 
-	if userInfo == nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+	messageID := userState.MessageID
+	clearUserState(userID)
+
+	app.showKeyList(bot, userID, chatID, messageID, KeyFilter{BatchID: batchID}, 0)
+}
+
+// 批次ID最长长度，与数据库字段一致，同时保证分页回调数据不超过Telegram的64字节限制
+const maxBatchIDLen = 32
+
+// 检查管理员输入的批次ID，只允许大写字母、数字和 -
+func validBatchID(id string) bool {
+	if id == "" || len(id) > maxBatchIDLen {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// 处理查询卡密按钮
+func (app *App) handleKeySearchButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 		return
 	}
 
-	setUserState(userID, "waiting_key", nil, messageID)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🎉 请输入你的卡密：")
+	setUserState(userID, "waiting_key_search", nil, messageID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "🔍 查询卡密\n\n请输入要查询的卡密：")
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回卡密库存", "key_list_all_0"),
 		),
 	}
 	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 	bot.Send(editMsg)
 }
 
-// 处理生成卡密按钮
-func handleGenKeyButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	if !isAdmin(userID) {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
-		keyboard := createMainMenuKeyboard(userID)
-		editMsg.ReplyMarkup = &keyboard
-		bot.Send(editMsg)
+// 处理查询卡密输入，显示卡密状态和兑换记录
+func (app *App) handleKeySearchInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
 		return
 	}
 
-	setUserState(userID, "waiting_key_limit", nil, messageID)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("🎉 生成卡密\n\n请输入卡密可增加的次数：\n\n💡 默认次数: %d", config.Limits.KeyAddLimit))
+	messageID := userState.MessageID
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+			tgbotapi.NewInlineKeyboardButtonData("🔍 继续查询", "key_search"),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回卡密库存", "key_list_all_0"),
 		),
 	}
+	clearUserState(userID)
+
+	var msgText string
+	key, err := normalizeKey(text)
+	var record *KeyRecord
+	if err == nil {
+		record, err = app.Keys.GetKey(key)
+	}
+
+	switch {
+	case err == errInvalidKeyFormat:
+		msgText = "❌ " + err.Error()
+	case err != nil:
+		log.Printf("[ERROR] 查询卡密失败: %v", err)
+		msgText = "❌ 查询卡密失败，请稍后再试"
+	case record == nil:
+		msgText = "❌ 卡密不存在"
+	default:
+		msgText = app.keyDetailText(record)
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
 	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
 	bot.Send(editMsg)
 }
 
-// 处理确认生成卡密
-func handleConfirmGenKey(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
-	userState := getUserState(userID)
-	if userState == nil || userState.Data["limit"] == nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
+// 卡密详情中最多显示的兑换记录数，避免超过Telegram消息长度限制
+const keyDetailMaxRedemptions = 20
+
+// 卡密详情
+func (app *App) keyDetailText(k *KeyRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "🔍 卡密详情\n\n🎫 卡密: %s\n📌 状态: %s\n⚡ 可增加次数: %d\n👥 已使用: %d/%d\n",
+		k.Key, keyStatusText(*k), k.AddLimit, k.UsesCount, k.MaxUses)
+	b.WriteString(productLine(k.Product))
+	if k.BatchID != "" {
+		fmt.Fprintf(&b, "🏷️ 批次: %s\n", k.BatchID)
+	}
+	if k.Channel != "" {
+		fmt.Fprintf(&b, "🤝 渠道: %s\n", k.Channel)
+	}
+	fmt.Fprintf(&b, "🛠️ 创建者: %s\n🕐 创建时间: %s\n", k.CreatedBy, k.CreatedAt)
+	if k.ExpiresAt != "" {
+		fmt.Fprintf(&b, "⏳ 过期时间: %s\n", k.ExpiresAt)
+	}
+
+	redemptions, err := app.Keys.GetKeyRedemptions(k.Key)
+	if err != nil {
+		log.Printf("[ERROR] 查询兑换记录失败: %v", err)
+		return b.String()
+	}
+	if len(redemptions) > keyDetailMaxRedemptions {
+		fmt.Fprintf(&b, "\n📜 兑换记录（共 %d 条，显示最近 %d 条）:\n", len(redemptions), keyDetailMaxRedemptions)
+		redemptions = redemptions[len(redemptions)-keyDetailMaxRedemptions:]
+	} else if len(redemptions) > 0 {
+		b.WriteString("\n📜 兑换记录:\n")
+	}
+	for _, r := range redemptions {
+		fmt.Fprintf(&b, "👤 %s · %s\n", r.UserID, r.RedeemedAt)
+	}
+	return b.String()
+}
+
+// 处理重新签发Token按钮
+func (app *App) handleReissueTokensButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	addLimit := userState.Data["limit"].(int)
+	activeID, _ := keyring.Active()
+	if activeID == "" {
+		activeID = "默认主密钥"
+	}
 
-	key, err := addKey(addLimit, userID)
-	if err != nil {
-		log.Printf("[ERROR] 生成卡密失败: %v", err)
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 生成卡密失败")
+	msgText := fmt.Sprintf("🔑 重新签发Token\n\n"+
+		"🗝️ 当前密钥: %s\n\n"+
+		"⚠️ 将为所有未使用当前密钥的用户重新签发Token并通知用户，旧Token将立即失效\n\n"+
+		"确认执行吗？", activeID)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := createConfirmKeyboard("reissue_tokens")
+	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 返回管理员菜单", "admin_menu"),
+	))
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理确认重新签发Token
+func (app *App) handleConfirmReissueTokens(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if !isAdmin(userID) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你没有管理员权限")
 		keyboard := createMainMenuKeyboard(userID)
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
-		clearUserState(userID)
 		return
 	}
 
-	msgText := fmt.Sprintf("🎉 卡密生成成功：\n\n```\n%s\n```\n\n⚡ 可增加次数: %d\n\n📌 请妥善保存此卡密", key, addLimit)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
-	editMsg.ParseMode = "Markdown"
-	keyboard := createMainMenuKeyboard(userID)
-	editMsg.ReplyMarkup = &keyboard
-	bot.Send(editMsg)
-	clearUserState(userID)
-	log.Printf("[INFO] 管理员 %d 生成卡密: %s, 次数: %d", userID, key, addLimit)
+	bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, "⏳ 正在重新签发Token，请稍候..."))
+
+	go func() {
+		reissued, skipped, failed, err := app.reissueAllTokens(bot)
+
+		var msgText string
+		if err != nil {
+			log.Printf("[ERROR] 重新签发Token失败: %v", err)
+			msgText = "❌ 重新签发Token失败，请查看日志"
+		} else {
+			msgText = fmt.Sprintf("✅ Token重新签发完成\n\n"+
+				"🔄 已重新签发: %d\n"+
+				"⏭️ 已是当前密钥或已吊销: %d\n"+
+				"❌ 失败: %d", reissued, skipped, failed)
+		}
+
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+		keyboard := createAdminMenuKeyboard()
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		log.Printf("[INFO] 管理员 %d 重新签发Token: 成功 %d, 跳过 %d, 失败 %d", userID, reissued, skipped, failed)
+	}()
+}
+
+// 使用当前密钥为所有用户重新签发Token并通知用户
+func (app *App) reissueAllTokens(bot *tgbotapi.BotAPI) (reissued, skipped, failed int, err error) {
+	userDB, err := app.Users.LoadUsers()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	activeID, _ := keyring.Active()
+
+	for _, record := range userDB.Records {
+		if keyID, ok := tokenKeyID(record.Token); ok && keyID == activeID {
+			skipped++
+			continue
+		}
+
+		// 已吊销的Token不重新签发，否则轮换密钥会让吊销失效
+		if revoked, err := app.Users.IsTokenRevoked(record.UserID, record.Timestamp); err != nil || revoked {
+			if err != nil {
+				log.Printf("[ERROR] 检查用户 %s 的Token吊销状态失败: %v", record.UserID, err)
+				failed++
+			} else {
+				skipped++
+			}
+			continue
+		}
+
+		newToken, timestamp, err := issueToken(record.UserID, record.IP)
+		if err != nil {
+			log.Printf("[ERROR] 为用户 %s 重新签发Token失败: %v", record.UserID, err)
+			failed++
+			continue
+		}
+
+		if err := app.Users.UpdateUserIPAndToken(record.UserID, record.IP, newToken, timestamp); err != nil {
+			log.Printf("[ERROR] 保存用户 %s 的新Token失败: %v", record.UserID, err)
+			failed++
+			continue
+		}
+		reissued++
+
+		userIDInt, err := strconv.ParseInt(record.UserID, 10, 64)
+		if err != nil {
+			log.Printf("[WARN] 用户ID无法通知: %s", record.UserID)
+			continue
+		}
+
+		message := fmt.Sprintf("🔑 你的 Token 已更新\n\n```\n%s\n```\n\n⚠️ 旧 Token 已失效，请尽快替换\n🌐 绑定IP: %s", newToken, record.IP)
+		msg := tgbotapi.NewMessage(userIDInt, message)
+		msg.ParseMode = "Markdown"
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("[WARN] 通知用户 %s 新Token失败: %v", record.UserID, err)
+		}
+
+		// 避免触发Telegram发送频率限制
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 命名Token同样需要使用新主密钥重新签发
+	tokens, err := app.Tokens.LoadTokens()
+	if err != nil {
+		return reissued, skipped, failed, err
+	}
+
+	for _, record := range tokens {
+		if keyID, ok := tokenKeyID(record.Token); ok && keyID == activeID {
+			skipped++
+			continue
+		}
+
+		if revoked, err := app.Users.IsTokenRevoked(record.UserID, record.Timestamp); err != nil || revoked {
+			if err != nil {
+				log.Printf("[ERROR] 检查用户 %s 的Token「%s」吊销状态失败: %v", record.UserID, record.Name, err)
+				failed++
+			} else {
+				skipped++
+			}
+			continue
+		}
+
+		newToken, timestamp, err := issueToken(record.UserID, record.IP)
+		if err == nil {
+			err = app.Tokens.UpdateTokenValue(record.ID, newToken, timestamp)
+		}
+		if err != nil {
+			log.Printf("[ERROR] 为用户 %s 重新签发Token「%s」失败: %v", record.UserID, record.Name, err)
+			failed++
+			continue
+		}
+		reissued++
+
+		userIDInt, err := strconv.ParseInt(record.UserID, 10, 64)
+		if err != nil {
+			log.Printf("[WARN] 用户ID无法通知: %s", record.UserID)
+			continue
+		}
+
+		message := fmt.Sprintf("🔑 你的 Token「%s」已更新\n\n```\n%s\n```\n\n⚠️ 旧 Token 已失效，请尽快替换\n🌐 绑定IP: %s", record.Name, newToken, record.IP)
+		msg := tgbotapi.NewMessage(userIDInt, message)
+		msg.ParseMode = "Markdown"
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("[WARN] 通知用户 %s 新Token失败: %v", record.UserID, err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return reissued, skipped, failed, nil
+}
+
+// 获取Token使用的主密钥ID，v1 Token返回false
+func tokenKeyID(tokenHex string) (string, bool) {
+	data, err := hex.DecodeString(tokenHex)
+	if err != nil {
+		return "", false
+	}
+
+	env, err := parseToken(data)
+	if err != nil || env.Version != tokenVersionKeyID {
+		return "", false
+	}
+	return env.KeyID, true
 }
 
 // returnHandler 同步回调处理器
@@ -2001,7 +7345,7 @@ func (c *EpayClient) GetOrder(orderID string) (*GetOrderResponse, error) {
 }
 
 // 支付成功通知函数（修改以支持换绑IP）
-func notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
+func (app *App) notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
 	go func() {
 		// 解析用户ID
 		userIDInt, err := strconv.ParseInt(order.UserID, 10, 64)
@@ -2023,7 +7367,7 @@ func notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
 		}
 
 		// 获取用户信息
-		userInfo, err := getUserInfo(order.UserID)
+		userInfo, err := app.Users.GetUser(order.UserID)
 		if err != nil {
 			log.Printf("[ERROR] 获取用户信息失败: %v", err)
 			return
@@ -2052,8 +7396,22 @@ func notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
 				"💡 请使用账户信息查看新Token\n\n"+
 				"感谢您的使用！",
 				order.GoodsName, reallyPrice, payTypeStr, order.PayID, userInfo.IP)
+		} else if strings.HasPrefix(order.PayID, "IP_SLOT_") {
+			message = fmt.Sprintf("🌐 IP槽位购买成功通知\n\n"+
+				"🎁 服务名称: %s\n"+
+				"💵 支付金额: %.2f 元\n"+
+				"💳 支付方式: %s\n"+
+				"📦 订单号: %s\n\n"+
+				"✅ 已增加 1 个IP槽位！\n"+
+				"💡 请在IP白名单中添加新的IP地址\n\n"+
+				"感谢您的使用！",
+				order.GoodsName, reallyPrice, payTypeStr, order.PayID)
 		} else {
-			// 普通充值订单
+			// 普通充值订单，显示所充值产品的余额
+			balances, err := app.Users.GetUserBalances(order.UserID)
+			if err != nil {
+				log.Printf("[ERROR] 获取用户产品余额失败: %v", err)
+			}
 			message = fmt.Sprintf("💰 支付成功通知\n\n"+
 				"🎁 商品名称: %s\n"+
 				"💵 支付金额: %.2f 元\n"+
@@ -2062,7 +7420,7 @@ func notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
 				"✅ 增加次数: %d\n"+
 				"🔢 当前总次数: %d\n\n"+
 				"感谢您的购买！",
-				order.GoodsName, reallyPrice, payTypeStr, order.PayID, order.Count, userInfo.Limit)
+				order.GoodsName, reallyPrice, payTypeStr, order.PayID, order.Count, balances[order.Product])
 		}
 
 		msg := tgbotapi.NewMessage(userIDInt, message)
@@ -2075,8 +7433,82 @@ func notifyPaymentSuccess(order *Order, reallyPrice float64, payType int) {
 	}()
 }
 
+// 已支付但无法完成的订单状态，需要管理员人工退款
+const orderStatusRefundRequired = "refund_required"
+
+// 订单已支付但无法完成时标记为待退款，通知用户和管理员，并向支付平台确认已收到回调
+func (app *App) flagOrderForRefund(c *gin.Context, order *Order, reallyPrice float64, payType int, reason string) {
+	if err := app.Orders.UpdateOrderStatus(order.PayID, orderStatusRefundRequired, reallyPrice, payType); err != nil {
+		log.Printf("[ERROR] 更新订单状态失败: %v", err)
+		c.String(http.StatusInternalServerError, "fail")
+		return
+	}
+	log.Printf("[WARN] 订单 %s 需要退款: %s", order.PayID, reason)
+
+	go func() {
+		if config.Bot.Token == "" {
+			log.Printf("[ERROR] Bot Token未配置，无法发送通知")
+			return
+		}
+		bot, err := tgbotapi.NewBotAPI(config.Bot.Token)
+		if err != nil {
+			log.Printf("[ERROR] 创建Bot实例失败: %v", err)
+			return
+		}
+
+		if userIDInt, err := strconv.ParseInt(order.UserID, 10, 64); err == nil {
+			bot.Send(tgbotapi.NewMessage(userIDInt, fmt.Sprintf("⚠️ 订单未能完成\n\n"+
+				"🎁 服务名称: %s\n"+
+				"📦 订单号: %s\n"+
+				"💵 支付金额: %.2f 元\n\n"+
+				"❌ %s\n"+
+				"💡 管理员将为你办理退款", order.GoodsName, order.PayID, reallyPrice, reason)))
+		}
+		notifyAdmins(bot, fmt.Sprintf("💸 订单需要退款\n\n👤 用户ID: %s\n📦 订单号: %s\n💵 支付金额: %.2f 元\n❌ 原因: %s",
+			order.UserID, order.PayID, reallyPrice, reason))
+	}()
+
+	c.String(http.StatusOK, "success")
+}
+
+// 金额比较允许的误差（元）
+const priceTolerance = 0.005
+
+func priceMatches(got, want float64) bool {
+	return math.Abs(got-want) < priceTolerance
+}
+
+// 订单应付的实际金额，易支付下单时返回的实际金额优先于商品价格
+func (o *Order) expectedPayment() float64 {
+	if o.ReallyPrice > 0 {
+		return o.ReallyPrice
+	}
+	return o.Price
+}
+
+// 按易支付订单号查找回调对应的本地订单
+// 下单后保存易支付订单号失败时，向易支付查询商户订单号再查找
+func (app *App) findCallbackOrder(epayOrderID string) (*Order, error) {
+	if epayOrderID == "" {
+		return nil, nil
+	}
+	order, err := app.Orders.GetOrderByEpayOrderID(epayOrderID)
+	if err != nil || order != nil || epayClient == nil {
+		return order, err
+	}
+
+	result, err := epayClient.GetOrder(epayOrderID)
+	if err != nil {
+		return nil, fmt.Errorf("向易支付查询订单失败: %v", err)
+	}
+	if result.Code != 1 || result.Data == nil || result.Data.PayID == "" {
+		return nil, nil
+	}
+	return app.Orders.GetOrderByPayID(result.Data.PayID)
+}
+
 // notifyHandler 异步回调处理器
-func notifyHandler(c *gin.Context) {
+func (app *App) notifyHandler(c *gin.Context) {
 	log.Printf("[INFO] 收到支付回调通知，方法: %s", c.Request.Method)
 
 	// 获取所有参数
@@ -2137,29 +7569,12 @@ func notifyHandler(c *gin.Context) {
 		return
 	}
 
-	// 获取订单信息
-	var order *Order
-	var err error
-
-	// 解析param参数，可能包含用户ID或用户ID|新IP
-	paramParts := strings.Split(params["param"], "|")
-	userID := paramParts[0]
-
-	// 首先尝试通过param（用户ID）查找最近的未支付订单
-	if userID != "" {
-		order, err = getLatestPendingOrderByUserID(userID)
-		if err != nil {
-			log.Printf("[ERROR] 通过用户ID查询最新待支付订单失败: %v", err)
-		}
-	}
-
-	// 如果通过用户ID找不到，尝试通过orderId查找
-	if order == nil {
-		epayOrderID := params["orderId"]
-		order, err = getOrderByEpayOrderID(epayOrderID)
-		if err != nil {
-			log.Printf("[ERROR] 通过orderId查询订单失败: %v", err)
-		}
+	// 获取订单信息：只按回调中已签名的易支付订单号查找，同一用户的其他未支付订单不会被误记账
+	order, err := app.findCallbackOrder(params["orderId"])
+	if err != nil {
+		log.Printf("[ERROR] 查询回调订单失败: %v", err)
+		c.String(http.StatusInternalServerError, "fail")
+		return
 	}
 
 	if order == nil {
@@ -2168,20 +7583,36 @@ func notifyHandler(c *gin.Context) {
 		return
 	}
 
+	// 解析param参数，可能包含用户ID或用户ID|新IP
+	paramParts := strings.Split(params["param"], "|")
+	if paramParts[0] != order.UserID {
+		log.Printf("[WARN] 回调用户与订单不一致: 订单 %s 属于 %s, param=%s", order.PayID, order.UserID, params["param"])
+		c.String(http.StatusBadRequest, "fail")
+		return
+	}
+
 	log.Printf("[INFO] 找到订单: PayID=%s, UserID=%s, Status=%s", order.PayID, order.UserID, order.Status)
 
-	if order.Status == "paid" {
+	if order.Status == "paid" || order.Status == orderStatusRefundRequired {
 		log.Printf("[INFO] 订单已处理过: %s", order.PayID)
 		c.String(http.StatusOK, "success")
 		return
 	}
 
 	// 解析金额和支付类型
+	price, _ := strconv.ParseFloat(params["price"], 64)
 	reallyPrice, _ := strconv.ParseFloat(params["reallyPrice"], 64)
 	payType, _ := strconv.Atoi(params["type"])
 
+	// 入账前核对金额，实付金额与下单时不一致的订单不发放权益
+	if expected := order.expectedPayment(); !priceMatches(price, order.Price) || !priceMatches(reallyPrice, expected) {
+		app.flagOrderForRefund(c, order, reallyPrice, payType,
+			fmt.Sprintf("支付金额 %.2f 与订单金额 %.2f 不一致", reallyPrice, expected))
+		return
+	}
+
 	// 更新订单状态
-	err = updateOrderStatus(order.PayID, "paid", reallyPrice, payType)
+	err = app.Orders.UpdateOrderStatus(order.PayID, "paid", reallyPrice, payType)
 	if err != nil {
 		log.Printf("[ERROR] 更新订单状态失败: %v", err)
 		c.String(http.StatusInternalServerError, "fail")
@@ -2192,7 +7623,13 @@ func notifyHandler(c *gin.Context) {
 	if strings.HasPrefix(order.PayID, "CHANGE_IP_") && len(paramParts) > 1 {
 		// 处理换绑IP
 		newIP := paramParts[1]
-		err = handleChangeIPSuccess(order, newIP)
+		err = app.handleChangeIPSuccess(order, newIP)
+		if errors.Is(err, errIPOverlap) {
+			// 下单后新IP已被其他用户绑定，订单无法完成
+			app.flagOrderForRefund(c, order, reallyPrice, payType,
+				fmt.Sprintf("新IP %s 在支付期间已被其他用户绑定，换绑未完成", newIP))
+			return
+		}
 		if err != nil {
 			log.Printf("[ERROR] 处理换绑IP失败: %v", err)
 			c.String(http.StatusInternalServerError, "fail")
@@ -2200,20 +7637,34 @@ func notifyHandler(c *gin.Context) {
 		}
 		log.Printf("[INFO] 换绑IP成功处理完成: 用户 %s, 订单 %s, 新IP %s",
 			order.UserID, order.PayID, newIP)
+	} else if strings.HasPrefix(order.PayID, "IP_SLOT_") {
+		// 购买IP槽位，多个未支付的订单先后完成时可能超过上限
+		err = app.Users.AddIPSlots(order.UserID, 1, config.Limits.MaxIPSlots-config.Limits.IPSlots)
+		if errors.Is(err, errIPSlotsMax) {
+			app.flagOrderForRefund(c, order, reallyPrice, payType,
+				fmt.Sprintf("IP槽位已达到上限 %d 个，无法继续增加", config.Limits.MaxIPSlots))
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] 增加IP槽位失败: %v", err)
+			c.String(http.StatusInternalServerError, "fail")
+			return
+		}
+		log.Printf("[INFO] IP槽位购买成功处理完成: 用户 %s, 订单 %s", order.UserID, order.PayID)
 	} else {
-		// 普通充值订单，更新用户次数
-		err = updateUserLimit(order.UserID, order.Count)
+		// 普通充值订单，增加用户在订单产品下的次数
+		_, err = app.Users.CreditProductLimit(order.UserID, order.Product, order.Count, "recharge", order.PayID)
 		if err != nil {
 			log.Printf("[ERROR] 更新用户次数失败: %v", err)
 			c.String(http.StatusInternalServerError, "fail")
 			return
 		}
-		log.Printf("[INFO] 充值成功处理完成: 用户 %s, 订单 %s, 增加次数 %d",
-			order.UserID, order.PayID, order.Count)
+		log.Printf("[INFO] 充值成功处理完成: 用户 %s, 订单 %s, 产品 %s, 增加次数 %d",
+			order.UserID, order.PayID, order.Product, order.Count)
 	}
 
 	// 发送支付成功通知
-	notifyPaymentSuccess(order, reallyPrice, payType)
+	app.notifyPaymentSuccess(order, reallyPrice, payType)
 
 	// 删除支付消息
 	if order.ChatID != 0 && order.MessageID != 0 {
@@ -2235,6 +7686,9 @@ func notifyHandler(c *gin.Context) {
 }
 
 func main() {
+	migrateOnly := flag.Bool("migrate-only", false, "只执行数据库迁移，完成后退出")
+	flag.Parse()
+
 	// 初始化随机数种子
 	rand.Seed(time.Now().UnixNano())
 
@@ -2243,13 +7697,28 @@ func main() {
 		log.Fatal("[FATAL] 加载配置失败:", err)
 	}
 
-	// 初始化MySQL数据库
-	err = initDatabase()
+	// 初始化数据库
+	db, err := initDatabase()
 	if err != nil {
 		log.Fatal("[FATAL] 初始化数据库失败:", err)
 	}
 	defer db.Close()
 
+	if *migrateOnly {
+		log.Printf("[INFO] 数据库迁移完成，退出")
+		return
+	}
+
+	store := newSQLStore(db, config.Database.Driver)
+	app := &App{
+		Users:       store,
+		Keys:        store,
+		Tokens:      store,
+		Orders:      store,
+		IPLimiter:   newRateLimiter(config.Server.VerifyIPRate, config.Server.VerifyIPBurst),
+		UserLimiter: newRateLimiter(config.Server.VerifyUserRate, config.Server.VerifyUserBurst),
+	}
+
 	// 初始化易支付客户端
 	if config.Payment.BaseURL != "" && config.Payment.MchID != "" && config.Payment.Secret != "" {
 		epayClient = NewEpayClient(config.Payment.BaseURL, config.Payment.MchID, config.Payment.Secret)
@@ -2287,12 +7756,12 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
-	r.POST("/verify", verifyHandler)
+	r.POST("/verify", app.verifyRateLimit, app.verifyHandler)
 
 	// 支付相关端点
 	if epayClient != nil {
-		r.POST("/notify", notifyHandler)
-		r.GET("/notify", notifyHandler) // 添加GET方法支持
+		r.POST("/notify", app.notifyHandler)
+		r.GET("/notify", app.notifyHandler) // 添加GET方法支持
 		r.GET("/return", returnHandler)
 		log.Printf("[INFO] 支付回调端点已注册: /notify (GET/POST), /return")
 	}
@@ -2373,9 +7842,16 @@ func main() {
 				}
 				log.Printf("[INFO] 用户 %d 使用了help命令", userID)
 
+			} else if strings.HasPrefix(text, "/revoke") {
+				deleteMsg := tgbotapi.NewDeleteMessage(chatID, messageID)
+				bot.Request(deleteMsg)
+
+				clearUserState(userID)
+				app.handleRevokeCommand(bot, userID, chatID, strings.TrimPrefix(text, "/revoke"))
+
 			} else if userState != nil {
 				// 处理用户状态相关的输入（传递用户消息ID用于删除）
-				handleUserStateInput(bot, userID, chatID, text, userState, messageID)
+				app.handleUserStateInput(bot, userID, chatID, text, userState, messageID)
 			} else {
 				// 删除用户消息
 				deleteMsg := tgbotapi.NewDeleteMessage(chatID, messageID)
@@ -2393,44 +7869,68 @@ func main() {
 
 		// 处理回调查询（按钮点击）
 		if update.CallbackQuery != nil {
-			handleCallbackQuery(bot, update.CallbackQuery)
+			app.handleCallbackQuery(bot, update.CallbackQuery)
 		}
 	}
 }
 
-// 更新用户IP和Token - MySQL版本
-func updateUserIPAndToken(userID, newIP, newToken string, timestamp int64) error {
-	query := "UPDATE users SET ip = ?, token = ?, timestamp = ?, updated_at = ? WHERE user_id = ?"
-	result, err := db.Exec(query, newIP, newToken, timestamp, time.Now(), userID)
+// 更新用户IP和Token
+func (s *sqlStore) UpdateUserIPAndToken(userID, newIP, newToken string, timestamp int64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("更新用户IP和Token失败: %v", err)
+		return fmt.Errorf("开始事务失败: %v", err)
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("获取影响行数失败: %v", err)
+	if err := s.lockIPBindingsTx(tx); err != nil {
+		return err
 	}
 
-	if rowsAffected == 0 {
+	// IP不变时（续期、重新签发）无需检查重叠
+	var oldIP string
+	query := "SELECT ip FROM users WHERE user_id = ?" + s.dialect.forUpdate
+	err = tx.QueryRow(s.dialect.rebind(query), userID).Scan(&oldIP)
+	if err == sql.ErrNoRows {
 		return fmt.Errorf("用户不存在")
 	}
+	if err != nil {
+		return fmt.Errorf("查询用户记录失败: %v", err)
+	}
+	if newIP != oldIP {
+		if err := s.checkIPOverlapTx(tx, newIP, userID); err != nil {
+			return err
+		}
+	}
+
+	query = "UPDATE users SET ip = ?, token = ?, timestamp = ?, updated_at = ? WHERE user_id = ?"
+	if _, err = tx.Exec(s.dialect.rebind(query), newIP, newToken, timestamp, time.Now(), userID); err != nil {
+		return fmt.Errorf("更新用户IP和Token失败: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
 
 	log.Printf("[INFO] 用户 %s IP和Token已更新: %s", userID, newIP)
 	return nil
 }
 
 // 处理换绑IP输入
-func handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP string) {
+func (app *App) handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP string) {
 	userState := getUserState(userID)
 	if userState == nil {
 		return
 	}
 
 	messageID := userState.MessageID
+	currentUserID := fmt.Sprintf("%d", userID)
 
-	if isValidPublicIP(newIP) {
-		// 检查新IP是否已被其他用户使用
-		ipUsed, existingUserID, err := ipExists(newIP)
+	network, err := parseIPBinding(newIP)
+	if err == nil {
+		newIP = formatIPBinding(network)
+
+		// 检查新地址是否与其他用户的绑定重叠
+		ipUsed, _, err := app.Users.IPOverlaps(newIP, currentUserID)
 		if err != nil {
 			log.Printf("[ERROR] 检查IP存在性失败: %v", err)
 			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
@@ -2441,19 +7941,27 @@ func handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP
 			return
 		}
 
-		// 检查是否是用户自己当前的IP
-		currentUserID := fmt.Sprintf("%d", userID)
-		if ipUsed && existingUserID != currentUserID {
+		if ipUsed {
 			clearUserState(userID)
-			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 已被其他用户绑定！\n\n请使用其他IP地址。", newIP))
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！\n\n请使用其他IP地址。", newIP))
+			keyboard := createMainMenuKeyboard(userID)
+			editMsg.ReplyMarkup = &keyboard
+			bot.Send(editMsg)
+			return
+		}
+
+		// 如果是用户当前的IP，提示无需换绑
+		userInfo, err := app.Users.GetUser(currentUserID)
+		if err != nil {
+			log.Printf("[ERROR] 获取用户信息失败: %v", err)
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
 			keyboard := createMainMenuKeyboard(userID)
 			editMsg.ReplyMarkup = &keyboard
 			bot.Send(editMsg)
+			clearUserState(userID)
 			return
 		}
-
-		// 如果是用户当前的IP，提示无需换绑
-		if ipUsed && existingUserID == currentUserID {
+		if userInfo != nil && userInfo.IP == newIP {
 			clearUserState(userID)
 			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ %s 就是你当前绑定的IP地址！\n\n无需重复换绑。", newIP))
 			keyboard := createMainMenuKeyboard(userID)
@@ -2463,7 +7971,7 @@ func handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP
 		}
 
 		// IP可用，显示确认信息
-		price := 1.0 // 换绑IP费用1元
+		price := config.Payment.ChangeIPPrice
 		userState.Data["new_ip"] = newIP
 		userState.Data["price"] = price
 
@@ -2473,18 +7981,8 @@ func handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP
 		editMsg.ReplyMarkup = &keyboard
 		bot.Send(editMsg)
 
-	} else if net.ParseIP(newIP) != nil && isPrivateIP(newIP) {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 禁止使用局域网地址！\n\n📥 请重新输入你的新公网 IP 地址：")
-		keyboard := [][]tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
-			),
-		}
-		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-		bot.Send(editMsg)
-
 	} else {
-		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 输入的不是有效的 IP 地址格式！\n\n📥 请重新输入你的新公网 IP 地址：")
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ "+err.Error()+"\n\n📥 请重新输入你的新公网 IP 地址或网段：")
 		keyboard := [][]tgbotapi.InlineKeyboardButton{
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
@@ -2496,10 +7994,10 @@ func handleChangeIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, newIP
 }
 
 // 处理换绑IP按钮
-func handleChangeIPButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+func (app *App) handleChangeIPButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
 	log.Printf("[DEBUG] handleChangeIPButton被调用: 用户 %d", userID)
 
-	userInfo, err := getUserInfo(fmt.Sprintf("%d", userID))
+	userInfo, err := app.Users.GetUser(fmt.Sprintf("%d", userID))
 	if err != nil {
 		log.Printf("[ERROR] 获取用户信息失败: %v", err)
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
@@ -2520,7 +8018,7 @@ func handleChangeIPButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, mess
 
 	log.Printf("[DEBUG] 用户 %d 开始换绑IP流程，当前IP: %s", userID, userInfo.IP)
 	setUserState(userID, "waiting_change_ip", nil, messageID)
-	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("🔥 换绑IP地址\n\n🌐 当前绑定IP: %s\n💰 换绑费用: 1.00 元\n\n📥 请输入你的新公网 IP 地址：", userInfo.IP))
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("🔥 换绑IP地址\n\n🌐 当前绑定IP: %s\n💰 换绑费用: %.2f 元\n\n📥 请输入你的新公网 IP 地址或网段：", userInfo.IP, config.Payment.ChangeIPPrice))
 	keyboard := [][]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
@@ -2531,7 +8029,7 @@ func handleChangeIPButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, mess
 }
 
 // 处理确认换绑IP
-func handleConfirmChangeIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+func (app *App) handleConfirmChangeIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
 	userState := getUserState(userID)
 	if userState == nil || userState.Data["new_ip"] == nil || userState.Data["price"] == nil {
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 操作超时，请重新开始")
@@ -2559,7 +8057,7 @@ func handleConfirmChangeIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, mes
 		MessageID:  messageID,
 	}
 
-	err := saveOrderToDB(order)
+	err := app.Orders.SaveOrder(order)
 	if err != nil {
 		log.Printf("[ERROR] 保存换绑IP订单失败: %v", err)
 		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
@@ -2603,7 +8101,7 @@ func handleConfirmChangeIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, mes
 	}
 
 	// 保存易支付订单号到数据库
-	err = updateOrderWithEpayInfo(payID, result.Data.OrderID, result.Data.ReallyPrice, result.Data.PayType)
+	err = app.Orders.UpdateOrderWithEpayInfo(payID, result.Data.OrderID, result.Data.ReallyPrice, result.Data.PayType)
 	if err != nil {
 		log.Printf("[ERROR] 更新换绑IP订单信息失败: %v", err)
 	}
@@ -2641,34 +8139,368 @@ func handleConfirmChangeIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, mes
 }
 
 // 处理换绑IP成功后的Token生成
-func handleChangeIPSuccess(order *Order, newIP string) error {
+func (app *App) handleChangeIPSuccess(order *Order, newIP string) error {
 	userID := order.UserID
 
 	// 生成新的时间戳和Token
-	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	newToken, timestamp, err := issueToken(userID, newIP)
+	if err != nil {
+		return fmt.Errorf("生成新Token失败: %v", err)
+	}
 
-	deterministicKey, err := generateDeterministicKey(userID, timestamp)
+	// 更新数据库中的IP和Token
+	err = app.Users.UpdateUserIPAndToken(userID, newIP, newToken, timestamp)
 	if err != nil {
-		return fmt.Errorf("生成确定性密钥失败: %v", err)
+		return fmt.Errorf("更新数据库失败: %v", err)
 	}
 
-	payload := Payload{
-		UserID:    userID,
-		IP:        newIP,
-		Timestamp: timestamp,
+	log.Printf("[INFO] 用户 %s 换绑IP成功: %s -> %s, 新Token已生成", userID, order.GoodsName, newIP)
+	return nil
+}
+
+// 检查客户端IP是否在用户的IP白名单中
+func (app *App) ipAllowlisted(userID, clientIP string) (bool, error) {
+	ips, _, err := app.Users.ListUserIPs(userID)
+	if err != nil {
+		return false, fmt.Errorf("查询IP白名单失败: %v", err)
+	}
+	for _, ip := range ips {
+		if ipBindingContains(ip.IP, clientIP) {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	newToken, err := encryptPayload(payload, deterministicKey)
+// 处理IP白名单按钮
+func (app *App) handleIPListButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	currentUserID := fmt.Sprintf("%d", userID)
+	userInfo, err := app.Users.GetUser(currentUserID)
 	if err != nil {
-		return fmt.Errorf("生成新Token失败: %v", err)
+		log.Printf("[ERROR] 获取用户信息失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
 
-	// 更新数据库中的IP和Token
-	err = updateUserIPAndToken(userID, newIP, newToken, timestamp)
+	if userInfo == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 你还没有获取过 Token\n\n💡 请先获取你的专属 Token")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	ips, purchased, err := app.Users.ListUserIPs(currentUserID)
 	if err != nil {
-		return fmt.Errorf("更新数据库失败: %v", err)
+		log.Printf("[ERROR] 查询IP白名单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
 	}
 
-	log.Printf("[INFO] 用户 %s 换绑IP成功: %s -> %s, 新Token已生成", userID, order.GoodsName, newIP)
-	return nil
+	totalSlots := config.Limits.IPSlots + purchased
+	usedSlots := 1 + len(ips)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "🌐 IP白名单\n\n📌 主绑定IP: %s\n", userInfo.IP)
+	if len(ips) > 0 {
+		b.WriteString("\n➕ 附加IP:\n")
+		for i, ip := range ips {
+			fmt.Fprintf(&b, "%d. %s (%s)\n", i+1, ip.IP, ip.CreatedAt)
+		}
+	}
+	fmt.Fprintf(&b, "\n🎫 已用槽位: %d/%d（最多 %d 个）\n💡 Token在以上任一IP或网段下均可验证", usedSlots, totalSlots, config.Limits.MaxIPSlots)
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if usedSlots < totalSlots {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➕ 添加IP", "add_user_ip"),
+		))
+	}
+	if totalSlots < config.Limits.MaxIPSlots && epayClient != nil {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("💳 购买IP槽位 (%.2f元)", config.Payment.IPSlotPrice), "buy_ip_slot"),
+		))
+	}
+	for _, ip := range ips {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ 删除 "+ip.IP, "del_ip_"+ip.IP),
+		))
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+	))
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, b.String())
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理添加IP按钮
+func (app *App) handleAddUserIPButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	setUserState(userID, "waiting_user_ip", nil, messageID)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "➕ 添加IP白名单\n\n📥 请输入要添加的公网 IP 地址或网段：")
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回IP白名单", "ip_list"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+}
+
+// 处理添加IP输入
+func (app *App) handleUserIPInput(bot *tgbotapi.BotAPI, userID int64, chatID int64, text string) {
+	userState := getUserState(userID)
+	if userState == nil {
+		return
+	}
+
+	messageID := userState.MessageID
+	currentUserID := fmt.Sprintf("%d", userID)
+	backKeyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回IP白名单", "ip_list"),
+		),
+	}
+
+	network, err := parseIPBinding(text)
+	if err != nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ "+err.Error()+"\n\n📥 请重新输入要添加的公网 IP 地址或网段：")
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+		bot.Send(editMsg)
+		return
+	}
+	ip := formatIPBinding(network)
+
+	// 检查是否与自己已有的IP重叠
+	userInfo, err := app.Users.GetUser(currentUserID)
+	var ips []UserIP
+	if err == nil && userInfo != nil {
+		ips, _, err = app.Users.ListUserIPs(currentUserID)
+	}
+	if err != nil || userInfo == nil {
+		if err != nil {
+			log.Printf("[ERROR] 查询IP白名单失败: %v", err)
+		}
+		clearUserState(userID)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	owned := []string{userInfo.IP}
+	for _, existing := range ips {
+		owned = append(owned, existing.IP)
+	}
+	for _, existing := range owned {
+		if ipBindingsOverlap(ip, existing) {
+			editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ %s 与你已绑定的 %s 重叠，无需重复添加！\n\n📥 请输入其他 IP 地址或网段：", ip, existing))
+			editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+			bot.Send(editMsg)
+			return
+		}
+	}
+
+	ipUsed, _, err := app.Users.IPOverlaps(ip, currentUserID)
+	if err == nil && ipUsed {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！\n\n📥 请输入其他 IP 地址或网段：", ip))
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+		bot.Send(editMsg)
+		return
+	}
+	if err == nil {
+		err = app.Users.AddUserIP(currentUserID, ip, config.Limits.IPSlots)
+	}
+
+	clearUserState(userID)
+	if errors.Is(err, errIPSlotsFull) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ IP槽位已满，请先删除不用的IP或购买槽位")
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+		bot.Send(editMsg)
+		return
+	}
+	if errors.Is(err, errIPOverlap) {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ IP地址 %s 与其他用户绑定的地址重叠！", ip))
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+		bot.Send(editMsg)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] 添加IP白名单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 添加IP失败，请稍后再试")
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: backKeyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	app.handleIPListButton(bot, userID, chatID, messageID)
+}
+
+// 处理删除IP按钮
+func (app *App) handleDeleteUserIP(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int, ip string) {
+	removed, err := app.Users.RemoveUserIP(fmt.Sprintf("%d", userID), ip)
+	if err != nil {
+		log.Printf("[ERROR] 删除IP白名单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+	if !removed {
+		log.Printf("[WARN] 用户 %d 删除不存在的IP白名单: %s", userID, ip)
+	}
+
+	app.handleIPListButton(bot, userID, chatID, messageID)
+}
+
+// 处理购买IP槽位按钮
+func (app *App) handleBuyIPSlotButton(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if epayClient == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 支付功能暂不可用")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	_, purchased, err := app.Users.ListUserIPs(fmt.Sprintf("%d", userID))
+	if err != nil {
+		log.Printf("[ERROR] 查询IP槽位失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 系统错误，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	totalSlots := config.Limits.IPSlots + purchased
+	if totalSlots >= config.Limits.MaxIPSlots {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 最多只能拥有 %d 个IP槽位", config.Limits.MaxIPSlots))
+		keyboard := [][]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 返回IP白名单", "ip_list"),
+			),
+		}
+		editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		bot.Send(editMsg)
+		return
+	}
+
+	confirmMsg := fmt.Sprintf("📋 确认购买IP槽位：\n\n🎫 当前槽位: %d 个\n➕ 购买数量: 1 个\n💰 费用: %.2f 元\n💳 支付方式: 微信支付\n\n确认创建订单吗？",
+		totalSlots, config.Payment.IPSlotPrice)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, confirmMsg)
+	keyboard := createConfirmKeyboard("buy_ip_slot")
+	editMsg.ReplyMarkup = &keyboard
+	bot.Send(editMsg)
+}
+
+// 处理确认购买IP槽位
+func (app *App) handleConfirmBuyIPSlot(bot *tgbotapi.BotAPI, userID int64, chatID int64, messageID int) {
+	if epayClient == nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 支付功能暂不可用")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	price := config.Payment.IPSlotPrice
+	payID := fmt.Sprintf("IP_SLOT_%d_%d", userID, time.Now().UnixNano())
+
+	order := &Order{
+		PayID:      payID,
+		UserID:     fmt.Sprintf("%d", userID),
+		Count:      0, // 购买IP槽位不涉及次数
+		GoodsName:  "附加IP槽位 x1",
+		Price:      price,
+		Status:     "pending",
+		CreateTime: time.Now(),
+		ChatID:     chatID,
+		MessageID:  messageID,
+	}
+
+	err := app.Orders.SaveOrder(order)
+	if err != nil {
+		log.Printf("[ERROR] 保存IP槽位订单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	req := &CreateOrderRequest{
+		PayID:     payID,
+		Type:      1, // 微信支付
+		Price:     price,
+		GoodsName: order.GoodsName,
+		Param:     fmt.Sprintf("%d", userID),
+		IsHTML:    0,
+		NotifyURL: config.Payment.NotifyURL,
+		ReturnURL: config.Payment.ReturnURL,
+	}
+
+	result, err := epayClient.CreateOrder(req)
+	if err != nil {
+		log.Printf("[ERROR] 创建IP槽位订单失败: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, "❌ 创建订单失败，请稍后再试")
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	if result.Code != 1 {
+		log.Printf("[ERROR] 创建IP槽位订单失败: %s", result.Msg)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("❌ 创建订单失败: %s", result.Msg))
+		keyboard := createMainMenuKeyboard(userID)
+		editMsg.ReplyMarkup = &keyboard
+		bot.Send(editMsg)
+		return
+	}
+
+	// 保存易支付订单号到数据库
+	err = app.Orders.UpdateOrderWithEpayInfo(payID, result.Data.OrderID, result.Data.ReallyPrice, result.Data.PayType)
+	if err != nil {
+		log.Printf("[ERROR] 更新IP槽位订单信息失败: %v", err)
+	}
+
+	msgText := fmt.Sprintf("🎉 IP槽位订单创建成功！\n\n"+
+		"📦 服务: %s\n"+
+		"💰 费用: %.2f 元\n"+
+		"📋 订单号: %s\n\n"+
+		"🔗 请点击下方链接完成支付：\n%s\n\n"+
+		"⏰ 订单有效期: %d 分钟\n"+
+		"💡 支付完成后即可在IP白名单中添加新的IP",
+		order.GoodsName,
+		result.Data.Price,
+		result.Data.OrderID,
+		result.Data.PayURL,
+		result.Data.TimeOut)
+
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, msgText)
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonURL("💳 去支付", result.Data.PayURL),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 查询订单状态", "check_order_"+result.Data.OrderID),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 返回主菜单", "main_menu"),
+		),
+	}
+	editMsg.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	bot.Send(editMsg)
+
+	log.Printf("[INFO] 用户 %d 创建IP槽位订单: %s, 金额: %.2f", userID, payID, price)
 }
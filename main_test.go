@@ -0,0 +1,1615 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	// 验证流程会输出大量DEBUG日志，测试时丢弃
+	log.SetOutput(io.Discard)
+	keyring = &Keyring{
+		keys:     map[string][]byte{"": []byte("test-master-secret-0123456789abcdef")},
+		activeID: "",
+	}
+	config.Products = []ProductConfig{
+		{ID: defaultProductID, Name: "默认"},
+		{ID: "pro", Name: "Pro", DefaultLimit: 5},
+	}
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// 使用内存存储的App，不限流
+func newTestApp() (*App, *memoryStore) {
+	store := newMemoryStore()
+	return &App{Users: store, Keys: store, Tokens: store, Orders: store}, store
+}
+
+// 添加测试用户并返回其默认Token
+func addTestUser(t testing.TB, store UserStore, userID, ip string, limit int) string {
+	t.Helper()
+	token, timestamp, err := issueToken(userID, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AddUser(userID, ip, token, limit, timestamp); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testStore 内存存储和SQL存储都实现的全部数据访问接口
+type testStore interface {
+	UserStore
+	KeyStore
+	TokenStore
+	OrderStore
+}
+
+// 使用给定存储的App，不限流
+func newStoreApp(store testStore) *App {
+	return &App{Users: store, Keys: store, Tokens: store, Orders: store}
+}
+
+// 分别使用内存存储和SQLite存储运行同一个测试
+func forEachStore(t *testing.T, fn func(t *testing.T, store testStore)) {
+	t.Helper()
+	stores := []struct {
+		name string
+		open func(t *testing.T) testStore
+	}{
+		{"memory", func(*testing.T) testStore { return newMemoryStore() }},
+		{"sqlite", func(t *testing.T) testStore { return newTestSQLStore(t) }},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) { fn(t, s.open(t)) })
+	}
+}
+
+// 创建临时SQLite数据库并执行全部迁移
+func newTestSQLStore(t testing.TB) *sqlStore {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_txlock=immediate&_time_format=sqlite"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = migrateDatabase(db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	return newSQLStore(db, "sqlite")
+}
+
+func TestMigrateDatabaseTwice(t *testing.T) {
+	store := newTestSQLStore(t)
+	if err := migrateDatabase(store.db, "sqlite"); err != nil {
+		t.Fatalf("重复执行迁移失败: %v", err)
+	}
+}
+
+// MySQL迁移中断后需要能重跑：每条 ALTER TABLE 只添加一列，索引单独创建
+func TestMySQLMigrationsRerunnable(t *testing.T) {
+	migrations, err := loadMigrations("mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations {
+		for _, stmt := range splitSQLStatements(m.sql) {
+			upper := strings.ToUpper(stmt)
+			switch {
+			case strings.HasPrefix(upper, "ALTER TABLE"):
+				if !mysqlAddColumnRe.MatchString(stmt) || strings.Count(upper, " ADD ") != 1 {
+					t.Errorf("%04d_%s: ALTER TABLE 只能添加一列: %s", m.version, m.name, stmt)
+				}
+			case strings.HasPrefix(upper, "CREATE INDEX"), strings.HasPrefix(upper, "CREATE UNIQUE INDEX"):
+				if !mysqlCreateIndexRe.MatchString(stmt) {
+					t.Errorf("%04d_%s: 无法识别的 CREATE INDEX: %s", m.version, m.name, stmt)
+				}
+			case strings.HasPrefix(upper, "INSERT INTO"):
+				t.Errorf("%04d_%s: 回填数据需使用 INSERT IGNORE: %s", m.version, m.name, stmt)
+			}
+		}
+	}
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	script := "-- 头部注释\n\nALTER TABLE `a` ADD COLUMN `b` int;\n\n-- 只有注释\n;\nCREATE INDEX `b` ON `a` (`b`);\n"
+	got := splitSQLStatements(script)
+	want := []string{"ALTER TABLE `a` ADD COLUMN `b` int", "CREATE INDEX `b` ON `a` (`b`)"}
+	if len(got) != len(want) {
+		t.Fatalf("语句数量 = %d, 期望 %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("第 %d 条语句 = %q, 期望 %q", i, got[i], want[i])
+		}
+	}
+}
+
+// 验证Token按用户ID和时间戳直接查找记录，耗时不随用户数量增长
+func BenchmarkDecryptAndValidateToken(b *testing.B) {
+	for _, users := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("memory/users=%d", users), func(b *testing.B) {
+			app, store := newTestApp()
+			benchmarkVerify(b, app, store, users)
+		})
+		b.Run(fmt.Sprintf("sqlite/users=%d", users), func(b *testing.B) {
+			store := newTestSQLStore(b)
+			app := &App{Users: store, Keys: store, Tokens: store, Orders: store}
+			benchmarkVerify(b, app, store, users)
+		})
+	}
+}
+
+func benchmarkVerify(b *testing.B, app *App, store UserStore, users int) {
+	// 其他用户直接写入，只有被验证的用户需要真实Token
+	if sqlStore, ok := store.(*sqlStore); ok {
+		tx, err := sqlStore.db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 1; i < users; i++ {
+			_, err = tx.Exec(`INSERT INTO users (user_id, ip, token, limit_count, timestamp, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				fmt.Sprintf("user%d", i), fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255), "x", 10, int64(i), time.Now())
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		for i := 1; i < users; i++ {
+			if err := store.AddUser(fmt.Sprintf("user%d", i), fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255), "x", 10, int64(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	token := addTestUser(b, store, "target", "203.0.113.10", 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := app.decryptAndValidateToken(token, "203.0.113.10"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 并发验证时每次成功都恰好扣除一次，次数用完后的请求全部返回403
+func TestVerifyParallelAccounting(t *testing.T) {
+	const limit, requests = 50, 120
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		app := newStoreApp(store)
+		token := addTestUser(t, store, "parallel", "8.8.8.8", limit)
+
+		router := gin.New()
+		router.POST("/verify", app.verifyHandler)
+
+		var mu sync.Mutex
+		statuses := make(map[int]int)
+		var wg sync.WaitGroup
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(`{"token":"`+token+`"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.RemoteAddr = "8.8.8.8:40000"
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				mu.Lock()
+				statuses[w.Code]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		if statuses[http.StatusOK] != limit || statuses[http.StatusForbidden] != requests-limit {
+			t.Fatalf("状态码统计 = %v, 期望 200×%d 403×%d", statuses, limit, requests-limit)
+		}
+		record, err := store.GetUser("parallel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Limit != 0 {
+			t.Fatalf("剩余次数 = %d, 期望 0", record.Limit)
+		}
+	})
+}
+
+// 兑换卡密过程中写入流水失败时，卡密、兑换记录和用户次数都保持不变
+func TestUseKeyAllOrNothing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		// inject(true) 让后续写入流水失败，inject(false) 恢复
+		inject := func(fail bool) {
+			switch s := store.(type) {
+			case *memoryStore:
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.ledgerErr = nil
+				if fail {
+					s.ledgerErr = fmt.Errorf("注入的故障")
+				}
+			case *sqlStore:
+				query := "ALTER TABLE limit_ledger_off RENAME TO limit_ledger"
+				if fail {
+					query = "ALTER TABLE limit_ledger RENAME TO limit_ledger_off"
+				}
+				if _, err := s.db.Exec(query); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		addTestUser(t, store, "redeemer", "8.8.8.8", 3)
+		_, keys, err := store.AddKeys(KeyBatchOptions{Count: 1, AddLimit: 10, MaxUses: 2}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := keys[0].Key
+
+		inject(true)
+		if _, _, _, err = store.UseKey(key, "redeemer"); err == nil {
+			t.Fatal("写入流水失败时兑换应返回错误")
+		}
+		inject(false)
+
+		record, err := store.GetKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.UsesCount != 0 || record.Used || record.UsedBy != "" {
+			t.Fatalf("兑换失败后卡密被修改: %+v", record)
+		}
+		redemptions, err := store.GetKeyRedemptions(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(redemptions) != 0 {
+			t.Fatalf("兑换失败后留下兑换记录: %+v", redemptions)
+		}
+		user, err := store.GetUser("redeemer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Limit != 3 {
+			t.Fatalf("兑换失败后次数 = %d, 期望 3", user.Limit)
+		}
+
+		// 故障恢复后同一张卡密可以正常兑换
+		_, addLimit, newLimit, err := store.UseKey(key, "redeemer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addLimit != 10 || newLimit != 13 {
+			t.Fatalf("兑换结果 = +%d / %d, 期望 +10 / 13", addLimit, newLimit)
+		}
+	})
+}
+
+// 内存存储和SQL存储一样按卡密记录中的过期时间判断
+func TestMemoryStoreKeyExpiry(t *testing.T) {
+	store := newMemoryStore()
+	addTestUser(t, store, "expiry", "8.8.8.8", 0)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	_, expired, err := store.AddKeys(KeyBatchOptions{Count: 1, AddLimit: 1, ExpiresAt: &past}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, valid, err := store.AddKeys(KeyBatchOptions{Count: 1, AddLimit: 1, ExpiresAt: &future}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err = store.UseKey(expired[0].Key, "expiry"); err == nil || !strings.Contains(err.Error(), "过期") {
+		t.Fatalf("过期卡密兑换结果 = %v, 期望已过期", err)
+	}
+	if _, _, _, err = store.UseKey(valid[0].Key, "expiry"); err != nil {
+		t.Fatalf("未过期卡密兑换失败: %v", err)
+	}
+}
+
+// 并发记录失败时计数不丢失，达到告警次数后只有一个调用能标记告警
+func TestRecordKeyFailureConcurrent(t *testing.T) {
+	const workers = 40
+	policy := keyLockoutPolicy{freeFailures: 1000, base: time.Minute, resetAfter: time.Hour}
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		now := time.Now()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		alerts := 0
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				attempt, _, err := store.RecordKeyFailure("user:1", now, policy)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if attempt.Failures >= 10 && !attempt.AlertSent {
+					sent, err := store.MarkKeyAlertSent("user:1")
+					if err != nil {
+						t.Error(err)
+					}
+					if sent {
+						mu.Lock()
+						alerts++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		attempt, err := store.GetKeyAttempt("user:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Failures != workers {
+			t.Fatalf("失败次数 = %d, 期望 %d", attempt.Failures, workers)
+		}
+		if alerts != 1 || !attempt.AlertSent {
+			t.Fatalf("告警次数 = %d, 标记 = %v, 期望只告警一次", alerts, attempt.AlertSent)
+		}
+
+		// 超过重置时长后重新计数并清除告警标记
+		attempt, locked, err := store.RecordKeyFailure("user:1", now.Add(2*time.Hour), policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Failures != 1 || attempt.AlertSent || locked {
+			t.Fatalf("重置后计数 = %+v, locked = %v", attempt, locked)
+		}
+	})
+}
+
+func TestKeyLockoutPolicy(t *testing.T) {
+	policy := keyLockoutPolicy{freeFailures: 5, base: 15 * time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+		locked   bool
+	}{
+		{4, 0, false},
+		{5, 15 * time.Minute, true},
+		{6, 30 * time.Minute, true},
+		{8, 2 * time.Hour, true},
+		{20, maxKeyLockout, true},
+	}
+	for _, tt := range tests {
+		got, locked := policy.lockout(tt.failures)
+		if got != tt.want || locked != tt.locked {
+			t.Errorf("lockout(%d) = %v, %v, 期望 %v, %v", tt.failures, got, locked, tt.want, tt.locked)
+		}
+	}
+}
+
+func TestKeyStatusText(t *testing.T) {
+	past := time.Now().Add(-time.Hour).In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	future := time.Now().Add(time.Hour).In(chinaLocation).Format("2006-01-02 15:04:05 CST")
+	tests := []struct {
+		name string
+		key  KeyRecord
+		want string
+	}{
+		{"未使用", KeyRecord{MaxUses: 1}, "🟢 未使用"},
+		{"未过期", KeyRecord{MaxUses: 1, ExpiresAt: future}, "🟢 未使用"},
+		{"部分使用", KeyRecord{MaxUses: 3, UsesCount: 1}, "🟡 部分使用"},
+		{"已用完", KeyRecord{MaxUses: 1, UsesCount: 1, Used: true, ExpiresAt: past}, "🔴 已用完"},
+		{"已过期", KeyRecord{MaxUses: 1, ExpiresAt: past}, "⏰ 已过期"},
+		{"部分使用后过期", KeyRecord{MaxUses: 3, UsesCount: 1, ExpiresAt: past}, "⏰ 已过期"},
+		{"已作废", KeyRecord{MaxUses: 1, Disabled: true, ExpiresAt: past}, "🚫 已作废"},
+	}
+	for _, tt := range tests {
+		if got := keyStatusText(tt.key); got != tt.want {
+			t.Errorf("%s: keyStatusText = %q, 期望 %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 合法的批次ID生成的分页回调数据不超过Telegram的64字节限制
+func TestValidBatchID(t *testing.T) {
+	generated, err := generateBatchID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{generated, true},
+		{"B20240102-9F3A1C", true},
+		{strings.Repeat("A", maxBatchIDLen), true},
+		{"", false},
+		{strings.Repeat("A", maxBatchIDLen+1), false},
+		{"B2024_01", false},
+		{"批次1", false},
+		{"b20240102", false},
+	}
+	for _, tt := range tests {
+		if got := validBatchID(tt.id); got != tt.want {
+			t.Errorf("validBatchID(%q) = %v, 期望 %v", tt.id, got, tt.want)
+		}
+		if tt.want {
+			if data := keyListCallback(KeyFilter{BatchID: tt.id}, 99999); len(data) > 64 {
+				t.Errorf("回调数据过长: %q（%d 字节）", data, len(data))
+			}
+		}
+	}
+}
+
+// 卡密详情只显示最近的兑换记录
+func TestKeyDetailTextCapsRedemptions(t *testing.T) {
+	app, store := newTestApp()
+	const users = keyDetailMaxRedemptions + 5
+
+	_, keys, err := store.AddKeys(KeyBatchOptions{Count: 1, AddLimit: 1, MaxUses: users}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < users; i++ {
+		userID := fmt.Sprintf("u%02d", i)
+		addTestUser(t, store, userID, fmt.Sprintf("8.8.8.%d", i+1), 0)
+		if _, _, _, err = store.UseKey(keys[0].Key, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	text := app.keyDetailText(&keys[0])
+	if got := strings.Count(text, "👤 "); got != keyDetailMaxRedemptions {
+		t.Fatalf("显示的兑换记录 = %d, 期望 %d", got, keyDetailMaxRedemptions)
+	}
+	if !strings.Contains(text, fmt.Sprintf("共 %d 条", users)) {
+		t.Fatalf("缺少兑换记录总数: %s", text)
+	}
+	if strings.Contains(text, "👤 u00 ") || !strings.Contains(text, fmt.Sprintf("👤 u%02d ", users-1)) {
+		t.Fatalf("应显示最近的兑换记录: %s", text)
+	}
+}
+
+// 可手动推进的测试时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestRateLimiter(perMinute, burst int) (*rateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	l := newRateLimiter(perMinute, burst)
+	l.now = clock.now
+	l.lastPrune = clock.t
+	return l, clock
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l, clock := newTestRateLimiter(60, 3) // 每秒补充1个令牌
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("k"); !ok {
+			t.Fatalf("突发内第 %d 个请求被拒绝", i+1)
+		}
+	}
+	ok, wait := l.Allow("k")
+	if ok {
+		t.Fatal("超出突发数的请求应被拒绝")
+	}
+	if wait != time.Second {
+		t.Fatalf("等待时长 = %v, 期望 1s", wait)
+	}
+
+	// 半秒只补充半个令牌，仍然拒绝，等待时长相应缩短
+	clock.advance(500 * time.Millisecond)
+	if ok, wait = l.Allow("k"); ok || wait != 500*time.Millisecond {
+		t.Fatalf("半秒后 Allow = %v, %v, 期望拒绝并等待500ms", ok, wait)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ = l.Allow("k"); !ok {
+		t.Fatal("补充一个令牌后应允许")
+	}
+
+	// 长时间空闲后最多恢复到突发数
+	clock.advance(time.Minute)
+	for i := 0; i < 3; i++ {
+		if ok, _ = l.Allow("k"); !ok {
+			t.Fatalf("恢复后第 %d 个请求被拒绝", i+1)
+		}
+	}
+	if ok, _ = l.Allow("k"); ok {
+		t.Fatal("令牌数不应超过突发数")
+	}
+
+	// 不同的键互不影响
+	if ok, _ = l.Allow("other"); !ok {
+		t.Fatal("其他键不应受影响")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if l := newRateLimiter(-1, 10); l != nil {
+		t.Fatal("负数速率应返回nil表示不限制")
+	}
+	var l *rateLimiter
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.Allow("k"); !ok {
+			t.Fatal("不限制时应始终允许")
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l, clock := newTestRateLimiter(60, 1)
+	l.Allow("idle")
+	clock.advance(rateBucketIdleTTL / 2)
+	l.Allow("active")
+
+	// 超过空闲时长后，下一次请求清理空闲的令牌桶，活跃的保留
+	clock.advance(rateBucketIdleTTL/2 + time.Second)
+	l.Allow("active")
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("空闲的令牌桶应被清理")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Fatal("活跃的令牌桶不应被清理")
+	}
+	if !l.lastPrune.Equal(clock.t) {
+		t.Fatalf("lastPrune = %v, 期望 %v", l.lastPrune, clock.t)
+	}
+}
+
+// 被限流的请求返回429和向上取整的Retry-After
+func TestVerifyRateLimitRetryAfter(t *testing.T) {
+	limiter, clock := newTestRateLimiter(24, 1) // 每2.5秒补充1个令牌
+	app := &App{IPLimiter: limiter}
+
+	router := gin.New()
+	router.POST("/verify", app.verifyRateLimit, func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/verify", nil)
+		req.RemoteAddr = "8.8.8.8:40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(); w.Code != http.StatusOK {
+		t.Fatalf("第一个请求状态码 = %d", w.Code)
+	}
+	w := do()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("状态码 = %d, Retry-After = %q, 期望 429 和 3", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	clock.advance(2400 * time.Millisecond)
+	if w = do(); w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Retry-After = %q, 期望不足1秒时为 1", w.Header().Get("Retry-After"))
+	}
+
+	clock.advance(100 * time.Millisecond)
+	if w = do(); w.Code != http.StatusOK {
+		t.Fatalf("补充令牌后状态码 = %d", w.Code)
+	}
+}
+
+func TestIsValidPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		// IPv4 特殊地址段及其边界
+		{"8.8.8.8", true},
+		{"0.0.0.0", false},
+		{"0.255.255.255", false},
+		{"1.0.0.0", true},
+		{"9.255.255.255", true},
+		{"10.0.0.0", false},
+		{"10.255.255.255", false},
+		{"11.0.0.0", true},
+		{"100.63.255.255", true},
+		{"100.64.0.0", false},
+		{"100.127.255.255", false},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"169.254.1.1", false},
+		{"172.15.255.255", true},
+		{"172.16.0.0", false},
+		{"172.31.255.255", false},
+		{"172.32.0.0", true},
+		{"192.0.0.8", false},
+		{"192.0.2.1", false},
+		{"192.88.99.1", false},
+		{"192.167.255.255", true},
+		{"192.168.0.0", false},
+		{"192.168.255.255", false},
+		{"192.169.0.0", true},
+		{"198.17.255.255", true},
+		{"198.18.0.0", false},
+		{"198.19.255.255", false},
+		{"198.20.0.0", true},
+		{"198.51.100.1", false},
+		{"203.0.113.255", false},
+		{"203.0.114.0", true},
+		{"223.255.255.255", true},
+		{"224.0.0.1", false},
+		{"239.255.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		// IPv6 特殊地址段
+		{"2606:4700:4700::1111", true},
+		{"2001:4860:4860::8888", true},
+		{"::", false},
+		{"::1", false},
+		{"::8.8.8.8", false},
+		{"64:ff9b:1::1", false},
+		{"100::1", false},
+		{"2001::1", false},
+		{"2001:1ff:ffff::1", false},
+		{"2001:200::1", true},
+		{"2001:db8::1", false},
+		{"2002:808:808::1", false},
+		{"3fff::1", false},
+		{"5f00::1", false},
+		{"fc00::1", false},
+		{"fdff:ffff::1", false},
+		{"fe80::1", false},
+		{"febf:ffff::1", false},
+		{"fec0::1", false},
+		{"ff02::1", false},
+		// IPv4映射地址按IPv4判断
+		{"::ffff:8.8.8.8", true},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:192.168.1.1", false},
+		// 无效输入
+		{"", false},
+		{"not-an-ip", false},
+		{"256.1.1.1", false},
+		{"8.8.8.8/32", false},
+	}
+	for _, tt := range tests {
+		if got := isValidPublicIP(tt.ip); got != tt.want {
+			t.Errorf("isValidPublicIP(%q) = %v, 期望 %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParseIPNormalizesMappedAddresses(t *testing.T) {
+	tests := []struct {
+		in, want string
+		bytes    int
+	}{
+		{"8.8.8.8", "8.8.8.8", 4},
+		{" 8.8.8.8 ", "8.8.8.8", 4},
+		{"::ffff:8.8.8.8", "8.8.8.8", 4},
+		{"::FFFF:808:808", "8.8.8.8", 4},
+		{"2001:4860:0:0:0:0:0:8888", "2001:4860::8888", 16},
+		{"2001:4860::8888", "2001:4860::8888", 16},
+	}
+	for _, tt := range tests {
+		ip := parseIP(tt.in)
+		if ip == nil || ip.String() != tt.want || len(ip) != tt.bytes {
+			t.Errorf("parseIP(%q) = %v（%d 字节）, 期望 %s（%d 字节）", tt.in, ip, len(ip), tt.want, tt.bytes)
+		}
+	}
+}
+
+// Token中绑定的IP或网段与请求IP的比较
+func TestDecryptAndValidateTokenIP(t *testing.T) {
+	tests := []struct {
+		binding, clientIP string
+		want              bool
+	}{
+		{"8.8.8.8", "8.8.8.8", true},
+		{"8.8.8.8", "::ffff:8.8.8.8", true},
+		{"::ffff:8.8.8.8", "8.8.8.8", true},
+		{"8.8.8.8", "8.8.8.9", false},
+		{"8.8.8.0/24", "8.8.8.0", true},
+		{"8.8.8.0/24", "8.8.8.255", true},
+		{"8.8.8.0/24", "::ffff:8.8.8.200", true},
+		{"8.8.8.0/24", "8.8.9.0", false},
+		{"8.8.7.255/24", "8.8.7.1", true},
+		{"::ffff:8.8.8.0/120", "8.8.8.77", true},
+		{"2001:4860::8888", "2001:4860:0:0:0:0:0:8888", true},
+		{"2001:4860::8888", "2001:4860::8889", false},
+		{"2001:4860:4860::/48", "2001:4860:4860:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:4860:4860::/48", "2001:4860:4861::", false},
+		// 不同地址族永远不匹配
+		{"8.8.8.8", "::8.8.8.8", false},
+		{"::/0", "8.8.8.8", false},
+		{"0.0.0.0/0", "2001:4860::8888", false},
+	}
+	for _, tt := range tests {
+		app, store := newTestApp()
+		token := addTestUser(t, store, "ipcheck", tt.binding, 1)
+
+		_, _, _, err := app.decryptAndValidateToken(token, tt.clientIP)
+		if got := err == nil; got != tt.want {
+			t.Errorf("绑定 %s, 请求IP %s: err = %v, 期望通过 = %v", tt.binding, tt.clientIP, err, tt.want)
+		}
+	}
+}
+
+// IP白名单只放行默认Token，命名Token只能在自身绑定的IP下使用
+func TestAllowlistOnlyForDefaultToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		app := newStoreApp(store)
+		defaultToken := addTestUser(t, store, "owner", "1.1.1.1", 10)
+		if err := store.AddUserIP("owner", "9.9.9.9", 3); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(2 * time.Millisecond) // 避免与默认Token的毫秒时间戳相同
+		token, timestamp, err := issueToken("owner", "8.8.8.8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddToken(&TokenRecord{UserID: "owner", Name: "named", IP: "8.8.8.8", Token: token, Timestamp: timestamp}, 5); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, _, err := app.decryptAndValidateToken(defaultToken, "9.9.9.9"); err != nil {
+			t.Fatalf("默认Token从白名单IP验证失败: %v", err)
+		}
+		if _, _, named, err := app.decryptAndValidateToken(token, "8.8.8.8"); err != nil || named == nil {
+			t.Fatalf("命名Token从绑定IP验证 = %v, %v", named, err)
+		}
+		if _, _, _, err := app.decryptAndValidateToken(token, "9.9.9.9"); err == nil {
+			t.Fatal("命名Token不应通过用户的IP白名单")
+		}
+	})
+}
+
+// 并发绑定互相重叠的地址时只有一个能成功，其余返回 errIPOverlap
+func TestConcurrentOverlappingBinds(t *testing.T) {
+	const workers = 20
+	forEachStore(t, func(t *testing.T, store testStore) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded, overlapped := 0, 0
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// 都包含 8.8.8.8，两两重叠
+				ip := []string{"8.8.8.0/24", "8.8.8.8", "8.8.0.0/16", "::ffff:8.8.8.8"}[i%4]
+				err := store.AddUser(fmt.Sprintf("bind%d", i), ip, "x", 0, int64(i))
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					succeeded++
+				case errors.Is(err, errIPOverlap):
+					overlapped++
+				default:
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if succeeded != 1 || overlapped != workers-1 {
+			t.Fatalf("成功 %d 个，重叠 %d 个，期望只有 1 个成功", succeeded, overlapped)
+		}
+	})
+}
+
+// IP白名单、命名Token和换绑IP写入时同样检查重叠
+func TestBindWritesRejectOverlap(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		addTestUser(t, store, "owner", "8.8.8.0/24", 10)
+		addTestUser(t, store, "other", "9.9.9.9", 10)
+
+		if err := store.AddUserIP("other", "8.8.8.8", 5); !errors.Is(err, errIPOverlap) {
+			t.Errorf("AddUserIP = %v, 期望 errIPOverlap", err)
+		}
+		err := store.AddToken(&TokenRecord{UserID: "other", Name: "t", IP: "8.8.0.0/16", Token: "x", Timestamp: 1}, 5)
+		if !errors.Is(err, errIPOverlap) {
+			t.Errorf("AddToken = %v, 期望 errIPOverlap", err)
+		}
+		if err := store.UpdateUserIPAndToken("other", "8.8.8.9", "x", 2); !errors.Is(err, errIPOverlap) {
+			t.Errorf("UpdateUserIPAndToken = %v, 期望 errIPOverlap", err)
+		}
+
+		// IP不变时（续期、重新签发）不检查重叠，自己的地址也不算重叠
+		if err := store.UpdateUserIPAndToken("owner", "8.8.8.0/24", "y", 3); err != nil {
+			t.Errorf("IP不变时更新失败: %v", err)
+		}
+		if err := store.AddUserIP("owner", "8.8.8.8", 5); err != nil {
+			t.Errorf("添加与自己绑定重叠的白名单失败: %v", err)
+		}
+	})
+}
+
+// 并发完成的槽位订单不会让已购买槽位超过上限
+func TestAddIPSlotsCap(t *testing.T) {
+	const maxPurchased, orders = 4, 10
+	forEachStore(t, func(t *testing.T, store testStore) {
+		addTestUser(t, store, "slots", "8.8.8.8", 0)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		added, capped := 0, 0
+		for i := 0; i < orders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.AddIPSlots("slots", 1, maxPurchased)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					added++
+				case errors.Is(err, errIPSlotsMax):
+					capped++
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		_, purchased, err := store.ListUserIPs("slots")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != maxPurchased || capped != orders-maxPurchased || purchased != maxPurchased {
+			t.Fatalf("成功 %d 次，超限 %d 次，已购买 %d 个，期望上限 %d", added, capped, purchased, maxPurchased)
+		}
+		if err := store.AddIPSlots("nobody", 1, maxPurchased); err == nil || errors.Is(err, errIPSlotsMax) {
+			t.Fatalf("用户不存在时 AddIPSlots = %v", err)
+		}
+	})
+}
+
+// 轮换密钥后重新签发Token时必须跳过已吊销的Token
+func TestReissueSkipsRevokedTokens(t *testing.T) {
+	app, store := newTestApp()
+	// 非数字用户ID不会触发Telegram通知
+	if err := store.AddUser("alice", "8.8.8.8", "old-alice", 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddUser("bob", "8.8.4.4", "old-bob", 10, 2); err != nil {
+		t.Fatal(err)
+	}
+	named := &TokenRecord{UserID: "alice", Name: "n1", IP: "1.1.1.1", Token: "old-named", Timestamp: 3}
+	if err := store.AddToken(named, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeToken("bob", 2, "admin", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeToken("alice", 3, "admin", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	reissued, skipped, failed, err := app.reissueAllTokens(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reissued != 1 || skipped != 2 || failed != 0 {
+		t.Fatalf("重新签发 %d, 跳过 %d, 失败 %d，期望 1/2/0", reissued, skipped, failed)
+	}
+
+	bob, _ := store.GetUser("bob")
+	if bob.Token != "old-bob" {
+		t.Fatal("已吊销的默认Token被重新签发")
+	}
+	token, _ := store.GetToken("alice", named.ID)
+	if token.Token != "old-named" {
+		t.Fatal("已吊销的命名Token被重新签发")
+	}
+	alice, _ := store.GetUser("alice")
+	if alice.Token == "old-alice" {
+		t.Fatal("未吊销的Token没有重新签发")
+	}
+}
+
+func TestRotateTokenValue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		if err := store.AddUser("alice", "1.1.1.1", "default", 10, 1); err != nil {
+			t.Fatal(err)
+		}
+		record := &TokenRecord{UserID: "alice", Name: "n1", IP: "8.8.8.8", Token: "old", Timestamp: 10}
+		if err := store.AddToken(record, 5); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RotateTokenValue("alice", record.ID, 10, "new", 11, "alice", "用户重置"); err != nil {
+			t.Fatal(err)
+		}
+
+		if revoked, _ := store.IsTokenRevoked("alice", 10); !revoked {
+			t.Fatal("旧Token未被吊销")
+		}
+		if revoked, _ := store.IsTokenRevoked("alice", 11); revoked {
+			t.Fatal("新Token不应被吊销")
+		}
+		got, _ := store.GetToken("alice", record.ID)
+		if got.Token != "new" || got.Timestamp != 11 {
+			t.Fatalf("Token未更新: %+v", got)
+		}
+
+		// 旧时间戳已失效，重复重置必须失败且不产生新的吊销记录
+		if err := store.RotateTokenValue("alice", record.ID, 10, "newer", 12, "alice", "用户重置"); err == nil {
+			t.Fatal("使用过期时间戳重置应失败")
+		}
+		if err := store.RotateTokenValue("bob", record.ID, 11, "newer", 12, "bob", "用户重置"); err == nil {
+			t.Fatal("重置其他用户的Token应失败")
+		}
+		if revoked, _ := store.IsTokenRevoked("alice", 11); revoked {
+			t.Fatal("失败的重置不应吊销当前Token")
+		}
+	})
+}
+
+// 非默认产品的余额只在首次使用、兑换或充值时创建，查看账户不会创建
+func TestProductBalanceCreatedOnFirstCredit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		addTestUser(t, store, "alice", "8.8.8.8", 3)
+		app := newStoreApp(store)
+
+		text, err := app.productBalancesText("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, "Pro（pro）: 5 次") {
+			t.Fatalf("未开通的产品应按默认次数显示: %q", text)
+		}
+		balances, _ := store.GetUserBalances("alice")
+		if _, ok := balances["pro"]; ok {
+			t.Fatal("查看账户不应创建产品余额")
+		}
+
+		_, keys, err := store.AddKeys(KeyBatchOptions{Count: 1, AddLimit: 10, Product: "pro"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		product, _, newLimit, err := store.UseKey(keys[0].Key, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if product != "pro" || newLimit != 15 {
+			t.Fatalf("兑换后产品 %s 余额 %d，期望 pro 15", product, newLimit)
+		}
+
+		balance, err := store.CreditProductLimit("alice", "pro", 2, "recharge", "order")
+		if err != nil || balance != 17 {
+			t.Fatalf("再次充值后余额 %d (%v)，期望 17", balance, err)
+		}
+
+		if _, err := store.CreditProductLimit("nobody", "pro", 2, "recharge", "order"); err == nil {
+			t.Fatal("不存在的用户不应创建产品余额")
+		}
+		balances, _ = store.GetUserBalances("nobody")
+		if len(balances) != 0 {
+			t.Fatalf("不存在的用户出现余额: %v", balances)
+		}
+	})
+}
+
+// 验证时每个产品只扣自己的余额，其他产品首次使用时在扣除的同时按默认次数开通
+func TestVerifyPerProductBalance(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		app := newStoreApp(store)
+		token := addTestUser(t, store, "multi", "8.8.8.8", 2)
+
+		router := gin.New()
+		router.POST("/verify", app.verifyHandler)
+		verify := func(product string) (int, VerifyResponse) {
+			body := fmt.Sprintf(`{"token":%q,"product":%q}`, token, product)
+			req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.RemoteAddr = "8.8.8.8:40000"
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			var resp VerifyResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w.Code, resp
+		}
+		balances := func() map[string]int {
+			t.Helper()
+			got, err := store.GetUserBalances("multi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+
+		if code, resp := verify(""); code != http.StatusOK || resp.Product != defaultProductID || resp.Limit != 1 {
+			t.Fatalf("默认产品验证 = %d %+v, 期望剩余 1", code, resp)
+		}
+		if _, ok := balances()["pro"]; ok {
+			t.Fatal("验证默认产品不应开通其他产品")
+		}
+
+		for want := 4; want >= 0; want-- {
+			if code, resp := verify("pro"); code != http.StatusOK || resp.Product != "pro" || resp.Limit != want {
+				t.Fatalf("pro 验证 = %d %+v, 期望剩余 %d", code, resp, want)
+			}
+		}
+		if code, _ := verify("pro"); code != http.StatusForbidden {
+			t.Fatalf("pro 次数用完后状态码 = %d, 期望 403", code)
+		}
+		if got := balances(); got[defaultProductID] != 1 || got["pro"] != 0 {
+			t.Fatalf("余额 = %v, 期望 default 1、pro 0", got)
+		}
+	})
+}
+
+// 临时替换密钥环，测试结束后恢复
+func withKeyring(t testing.TB, activeID string, keys map[string]string) {
+	t.Helper()
+	old := keyring
+	kr := &Keyring{keys: make(map[string][]byte), activeID: activeID}
+	for id, secret := range keys {
+		kr.keys[id] = []byte(secret)
+	}
+	keyring = kr
+	t.Cleanup(func() { keyring = old })
+}
+
+// Token头部中的 [timestamp(8)] + [userID_len(1)] + [userID]
+func testTokenBody(userID string, timestamp int64) []byte {
+	body := make([]byte, 8, 9+len(userID))
+	binary.BigEndian.PutUint64(body, uint64(timestamp))
+	body = append(body, byte(len(userID)))
+	return append(body, userID...)
+}
+
+// 按指定头部和密钥封装Token，aad为false时头部不参与认证（v1格式）
+func sealTestToken(t testing.TB, header, key []byte, payload Payload, aad bool) string {
+	t.Helper()
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 12)
+	var additional []byte
+	if aad {
+		additional = header
+	}
+	sealed := aesgcm.Seal(nil, nonce, plaintext, additional)
+	data := append(append(append([]byte{}, header...), nonce...), sealed...)
+	return hex.EncodeToString(data)
+}
+
+func TestDeriveTokenKeyFromMasterSecret(t *testing.T) {
+	key, err := deriveTokenKey([]byte("secret-a"), "alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := deriveTokenKey([]byte("secret-a"), "alice", 1)
+	if !bytes.Equal(key, again) {
+		t.Fatal("相同输入派生的密钥不一致")
+	}
+	others := []struct {
+		name, secret, userID string
+		timestamp            int64
+	}{
+		{"主密钥", "secret-b", "alice", 1},
+		{"用户ID", "secret-a", "bob", 1},
+		{"时间戳", "secret-a", "alice", 2},
+	}
+	for _, in := range others {
+		other, _ := deriveTokenKey([]byte(in.secret), in.userID, in.timestamp)
+		if bytes.Equal(key, other) {
+			t.Fatalf("%s不同时派生出了相同的密钥", in.name)
+		}
+	}
+	md5Key, _ := generateDeterministicKey("alice", 1)
+	if bytes.Equal(key, md5Key) {
+		t.Fatal("HKDF密钥不应等于旧版MD5密钥")
+	}
+
+	// 签发的Token只能用签发时的主密钥打开
+	withKeyring(t, "", map[string]string{"": "secret-a-0123456789abcdef0123456789"})
+	token, _, err := issueToken("alice", "8.8.8.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openToken(token); err != nil {
+		t.Fatalf("打开刚签发的Token失败: %v", err)
+	}
+	withKeyring(t, "", map[string]string{"": "secret-b-0123456789abcdef0123456789"})
+	if _, _, err := openToken(token); err == nil {
+		t.Fatal("更换主密钥后旧Token仍可打开")
+	}
+}
+
+func TestLegacyTokenCutoff(t *testing.T) {
+	old := legacyTokenEnd
+	t.Cleanup(func() { legacyTokenEnd = old })
+
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	key, _ := generateDeterministicKey("alice", timestamp)
+	token := sealTestToken(t, testTokenBody("alice", timestamp), key,
+		Payload{UserID: "alice", IP: "8.8.8.8", Timestamp: timestamp}, false)
+
+	cases := []struct {
+		name string
+		end  time.Time
+		ok   bool
+	}{
+		{"未配置", time.Time{}, false},
+		{"截止前", time.Now().Add(time.Hour), true},
+		{"截止后", time.Now().Add(-time.Hour), false},
+	}
+	for _, tc := range cases {
+		legacyTokenEnd = tc.end
+		_, _, err := openToken(token)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err=%v，期望接受=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestOpenTokenRejectsHeaderMismatch(t *testing.T) {
+	secret := "test-master-secret-0123456789abcdef"
+	header := append([]byte{tokenVersionKeyID, tokenAlgHKDFAESGCM, 0}, testTokenBody("alice", 100)...)
+	key, _ := deriveTokenKey([]byte(secret), "alice", 100)
+
+	cases := map[string]Payload{
+		"用户ID不一致": {UserID: "mallory", IP: "8.8.8.8", Timestamp: 100},
+		"时间戳不一致":  {UserID: "alice", IP: "8.8.8.8", Timestamp: 101},
+	}
+	for name, payload := range cases {
+		token := sealTestToken(t, header, key, payload, true)
+		if _, _, err := openToken(token); err == nil || !strings.Contains(err.Error(), "不一致") {
+			t.Errorf("%s: 期望头部不一致错误，得到 %v", name, err)
+		}
+	}
+
+	// 头部参与认证，篡改头部中的时间戳会导致解密失败
+	token, _, err := issueToken("alice", "8.8.8.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := hex.DecodeString(token)
+	data[3+7] ^= 1
+	if _, _, err := openToken(hex.EncodeToString(data)); err == nil {
+		t.Fatal("篡改头部的Token不应通过")
+	}
+}
+
+// 算法字节来自客户端，伪造或降级的算法必须在派生密钥之前被拒绝
+func TestTokenAlgorithmPinnedToVersion(t *testing.T) {
+	old := legacyTokenEnd
+	t.Cleanup(func() { legacyTokenEnd = old })
+	// 即使开启旧版兼容，v4 Token也不能降级到MD5密钥
+	legacyTokenEnd = time.Now().Add(time.Hour)
+
+	app, store := newTestApp()
+	addTestUser(t, store, "victim", "1.1.1.1", 10)
+	user, _ := store.GetUser("victim")
+	payload := Payload{UserID: "victim", IP: "8.8.8.8", Timestamp: user.Timestamp}
+	md5Key, _ := generateDeterministicKey("victim", user.Timestamp)
+	hkdfKey, _ := deriveTokenKey([]byte("test-master-secret-0123456789abcdef"), "victim", user.Timestamp)
+	body := testTokenBody("victim", user.Timestamp)
+
+	forged := map[string]string{
+		"v4声明MD5算法":  sealTestToken(t, append([]byte{tokenVersionKeyID, tokenAlgLegacyMD5, 0}, body...), md5Key, payload, true),
+		"v4未知算法":     sealTestToken(t, append([]byte{tokenVersionKeyID, 0x02, 0}, body...), hkdfKey, payload, true),
+		"未发布的v2格式":   sealTestToken(t, append([]byte{0x02}, body...), hkdfKey, payload, false),
+		"未发布的v3格式":   sealTestToken(t, append([]byte{0x03, tokenAlgHKDFAESGCM}, body...), hkdfKey, payload, true),
+		"未发布的v3降级格式": sealTestToken(t, append([]byte{0x03, tokenAlgLegacyMD5}, body...), md5Key, payload, true),
+	}
+	for name, token := range forged {
+		if _, _, err := openToken(token); err == nil {
+			t.Errorf("%s: openToken 接受了伪造的Token", name)
+		}
+		if _, _, _, err := app.decryptAndValidateToken(token, "8.8.8.8"); err == nil {
+			t.Errorf("%s: decryptAndValidateToken 接受了伪造的Token", name)
+		}
+	}
+
+	// 同样的头部使用正确算法时可以打开，说明拒绝来自算法检查
+	valid := sealTestToken(t, append([]byte{tokenVersionKeyID, tokenAlgHKDFAESGCM, 0}, body...), hkdfKey, payload, true)
+	if _, _, err := openToken(valid); err != nil {
+		t.Fatalf("正确算法的Token无法打开: %v", err)
+	}
+}
+
+func TestKeyringLookup(t *testing.T) {
+	keys := map[string]string{
+		"k1": "key-one-0123456789abcdef0123456789",
+		"k2": "key-two-0123456789abcdef0123456789",
+	}
+	withKeyring(t, "k1", keys)
+	token, _, err := issueToken("alice", "8.8.8.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID, ok := tokenKeyID(token); !ok || keyID != "k1" {
+		t.Fatalf("密钥ID为 %q，期望 k1", keyID)
+	}
+
+	// 轮换后旧密钥仍在密钥环中，旧Token可以继续使用
+	withKeyring(t, "k2", keys)
+	if _, _, err := openToken(token); err != nil {
+		t.Fatalf("非当前但仍保留的密钥签发的Token无法打开: %v", err)
+	}
+
+	// 旧密钥退役（从密钥环中移除）后，它签发的Token失效
+	withKeyring(t, "k2", map[string]string{"k2": keys["k2"]})
+	if _, _, err := openToken(token); err == nil || !strings.Contains(err.Error(), "密钥不存在") {
+		t.Fatalf("退役密钥签发的Token应被拒绝，得到 %v", err)
+	}
+
+	// 未知密钥ID（包括未配置 master_secret 时的空ID）直接拒绝
+	payload := Payload{UserID: "alice", IP: "8.8.8.8", Timestamp: 100}
+	for _, keyID := range []string{"nope", ""} {
+		key, _ := deriveTokenKey([]byte(keys["k2"]), "alice", 100)
+		header := append([]byte{tokenVersionKeyID, tokenAlgHKDFAESGCM, byte(len(keyID))}, keyID...)
+		header = append(header, testTokenBody("alice", 100)...)
+		if _, _, err := openToken(sealTestToken(t, header, key, payload, true)); err == nil {
+			t.Errorf("密钥ID %q 不在密钥环中，Token应被拒绝", keyID)
+		}
+	}
+}
+
+func TestReissueMovesTokensToActiveKey(t *testing.T) {
+	keys := map[string]string{
+		"k1": "key-one-0123456789abcdef0123456789",
+		"k2": "key-two-0123456789abcdef0123456789",
+	}
+	withKeyring(t, "k1", keys)
+	app, store := newTestApp()
+	// 非数字用户ID不会触发Telegram通知
+	addTestUser(t, store, "alice", "8.8.8.8", 10)
+	namedToken, timestamp, err := issueToken("alice", "1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	named := &TokenRecord{UserID: "alice", Name: "n1", IP: "1.1.1.1", Token: namedToken, Timestamp: timestamp}
+	if err := store.AddToken(named, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	withKeyring(t, "k2", keys)
+	reissued, skipped, failed, err := app.reissueAllTokens(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reissued != 2 || skipped != 0 || failed != 0 {
+		t.Fatalf("重新签发 %d, 跳过 %d, 失败 %d，期望 2/0/0", reissued, skipped, failed)
+	}
+
+	user, _ := store.GetUser("alice")
+	token, _ := store.GetToken("alice", named.ID)
+	for _, tok := range []string{user.Token, token.Token} {
+		if keyID, _ := tokenKeyID(tok); keyID != "k2" {
+			t.Fatalf("重新签发后密钥ID为 %q，期望 k2", keyID)
+		}
+		if _, _, err := openToken(tok); err != nil {
+			t.Fatalf("重新签发的Token无法打开: %v", err)
+		}
+	}
+
+	// 已使用当前密钥的Token不会重复签发
+	reissued, skipped, _, _ = app.reissueAllTokens(nil)
+	if reissued != 0 || skipped != 2 {
+		t.Fatalf("再次执行: 重新签发 %d, 跳过 %d，期望 0/2", reissued, skipped)
+	}
+}
+
+// 用给定的19位字符生成带校验字符的卡密
+func testKey(body string) string {
+	chars := []byte(body)
+	return formatKey(append(chars, keyCheckChar(chars)))
+}
+
+func TestGenerateKeyFormat(t *testing.T) {
+	pattern := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{4}(-[0-9A-HJKMNP-TV-Z]{4}){4}$`)
+	for i := 0; i < 200; i++ {
+		key, err := generateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pattern.MatchString(key) {
+			t.Fatalf("卡密格式错误: %s", key)
+		}
+		if got, err := normalizeKey(key); err != nil || got != key {
+			t.Fatalf("normalizeKey(%s) = %s, %v", key, got, err)
+		}
+	}
+}
+
+// 校验字符能发现任意位置上的单字符输错
+func TestKeyCheckCharRejectsSingleTypos(t *testing.T) {
+	key := testKey("7K3MQ9XD2HFWRB8NTC4")
+	chars := []byte(strings.ReplaceAll(key, "-", ""))
+	for i := range chars {
+		for j := 0; j < len(keyAlphabet); j++ {
+			typo := append([]byte{}, chars...)
+			if typo[i] == keyAlphabet[j] {
+				continue
+			}
+			typo[i] = keyAlphabet[j]
+			if _, err := normalizeKey(string(typo)); !errors.Is(err, errInvalidKeyFormat) {
+				t.Fatalf("第 %d 位输错为 %c 未被发现: %s", i+1, keyAlphabet[j], typo)
+			}
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	key := testKey("0000111100001111ABC")
+	legacy := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		input, want string
+		ok          bool
+	}{
+		{key, key, true},
+		{strings.ToLower(key), key, true},
+		{strings.ReplaceAll(key, "-", ""), key, true},
+		{" " + strings.ReplaceAll(key, "-", " ") + " ", key, true},
+		// Crockford规则: O 视为 0，I/L 视为 1
+		{"OOOO-IIII-0000-LlLl-ABC" + key[len(key)-1:], key, true},
+		// 旧版卡密原样通过（统一小写）
+		{legacy, legacy, true},
+		{strings.ToUpper(legacy), legacy, true},
+		{key[:len(key)-1], "", false},
+		{key + "0", "", false},
+		{strings.Replace(key, "A", "U", 1), "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeKey(tt.input)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("normalizeKey(%q) = %q, %v，期望 %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+// 多个账户各自停在单用户上限以下时，全局计数只告警，不会锁定其他用户
+func TestGlobalKeyFailuresDoNotLockOthers(t *testing.T) {
+	old := config.Limits
+	t.Cleanup(func() { config.Limits = old })
+	config.Limits.KeyFreeFailures = 5
+	config.Limits.KeyLockoutMinutes = 1
+	config.Limits.KeyAlertFailures = 10
+	config.Limits.KeyGlobalFailures = 20
+
+	app, store := newTestApp()
+	now := time.Now()
+	for user := int64(1); user <= 10; user++ {
+		for i := 0; i < config.Limits.KeyFreeFailures-1; i++ {
+			if app.recordKeyFailure(nil, user, user, 0, now) {
+				t.Fatalf("用户 %d 未达到上限却被锁定", user)
+			}
+		}
+	}
+
+	global, err := store.GetKeyAttempt(keyGlobalScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.Failures != 40 || !global.AlertSent || !global.LockedUntil.IsZero() {
+		t.Fatalf("全局计数 = %+v，期望 40 次、已告警、未锁定", global)
+	}
+	if app.replyIfKeyLocked(nil, 99, 99, 0, now) {
+		t.Fatal("其他用户被全局计数锁定")
+	}
+}
+
+func TestGetRealIP(t *testing.T) {
+	oldHeader, oldProxies := config.Server.ProxyHeader, trustedProxies
+	t.Cleanup(func() { config.Server.ProxyHeader, trustedProxies = oldHeader, oldProxies })
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = nets
+
+	const trusted, untrusted = "10.0.0.1:443", "203.0.113.9:443"
+	tests := []struct {
+		name    string
+		mode    string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{"不可信来源的XFF被忽略", proxyHeaderXFF, untrusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.9"},
+		{"由右向左停在第一个不可信地址", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4, 5.6.7.8, 10.0.0.2"}}, "5.6.7.8"},
+		{"多个XFF头按顺序拼接", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4", "5.6.7.8, 10.0.0.2"}}, "5.6.7.8"},
+		{"IPv6可信代理", proxyHeaderXFF, "[2001:db8::1]:443", map[string][]string{"X-Forwarded-For": {"2001:4860::8888"}}, "2001:4860::8888"},
+		{"全部为可信代理时取最左侧", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"无法解析的条目左侧不可信", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"空条目左侧不可信", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4,, 10.0.0.2"}}, "10.0.0.2"},
+		{"只有无法解析的条目时使用连接地址", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {"garbage"}}, "10.0.0.1"},
+		{"空XFF使用连接地址", proxyHeaderXFF, trusted, map[string][]string{"X-Forwarded-For": {""}}, "10.0.0.1"},
+		{"没有XFF使用连接地址", proxyHeaderXFF, trusted, nil, "10.0.0.1"},
+		{"none模式忽略转发头", proxyHeaderNone, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4"}, "X-Real-Ip": {"1.2.3.4"}}, "10.0.0.1"},
+		{"cloudflare", proxyHeaderCloudflare, trusted, map[string][]string{"Cf-Connecting-Ip": {"1.2.3.4"}}, "1.2.3.4"},
+		{"cloudflare不可信来源", proxyHeaderCloudflare, untrusted, map[string][]string{"Cf-Connecting-Ip": {"1.2.3.4"}}, "203.0.113.9"},
+		{"cloudflare无效地址", proxyHeaderCloudflare, trusted, map[string][]string{"Cf-Connecting-Ip": {"garbage"}}, "10.0.0.1"},
+		{"cloudflare模式忽略XFF", proxyHeaderCloudflare, trusted, map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "10.0.0.1"},
+		{"real-ip", proxyHeaderRealIP, trusted, map[string][]string{"X-Real-Ip": {" 1.2.3.4 "}}, "1.2.3.4"},
+		{"real-ip不可信来源", proxyHeaderRealIP, untrusted, map[string][]string{"X-Real-Ip": {"1.2.3.4"}}, "203.0.113.9"},
+		{"real-ip为空", proxyHeaderRealIP, trusted, map[string][]string{"X-Real-Ip": {""}}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		config.Server.ProxyHeader = tt.mode
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/verify", nil)
+		c.Request.RemoteAddr = tt.peer
+		for name, values := range tt.headers {
+			for _, v := range values {
+				c.Request.Header.Add(name, v)
+			}
+		}
+		if got := getRealIP(c); got != tt.want {
+			t.Errorf("%s: getRealIP = %s，期望 %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 两个进程共用同一数据库时，IP绑定由数据库中的锁行串行化，而不是进程内的锁
+func TestBindLockAcrossStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	open := func() *sqlStore {
+		// 不使用 _txlock=immediate，确保串行化来自 app_locks 而不是 SQLite 的事务模式
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_time_format=sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return newSQLStore(db, "sqlite")
+	}
+	first := open()
+	if err := migrateDatabase(first.db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	stores := []*sqlStore{first, open()}
+
+	const workers = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := []string{"8.8.8.0/24", "8.8.8.8", "8.8.0.0/16", "::ffff:8.8.8.8"}[i%4]
+			err := stores[i%2].AddUser(fmt.Sprintf("bind%d", i), ip, "x", 0, int64(i))
+			if err != nil && !errors.Is(err, errIPOverlap) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Fatalf("两个存储共成功绑定 %d 次，期望 1 次", succeeded)
+	}
+
+	// 绑定写入必须先获取锁行，锁行缺失时直接失败
+	if _, err := first.db.Exec("DELETE FROM app_locks WHERE name = ?", ipBindLockName); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.AddUser("nolock", "9.9.9.9", "x", 0, 100); err == nil || errors.Is(err, errIPOverlap) {
+		t.Fatalf("缺少锁行时 AddUser = %v，期望加锁失败", err)
+	}
+}
+
+// 支付回调按已签名的易支付订单号入账，并在入账前核对金额
+func TestNotifyHandlerMatchesOrderAndAmount(t *testing.T) {
+	saved := config.Payment
+	t.Cleanup(func() { config.Payment = saved })
+	config.Payment.MchID = "mch"
+	config.Payment.Secret = "notify-secret"
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		app := newStoreApp(store)
+		addTestUser(t, store, "payer", "8.8.8.8", 0)
+
+		router := gin.New()
+		router.GET("/notify", app.notifyHandler)
+		notify := func(orderID, param, price, reallyPrice string) int {
+			sign := generateMD5(orderID + param + "1" + price + reallyPrice + config.Payment.Secret)
+			query := fmt.Sprintf("/notify?mchId=mch&orderId=%s&param=%s&type=1&price=%s&reallyPrice=%s&sign=%s",
+				orderID, param, price, reallyPrice, sign)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, query, nil))
+			return w.Code
+		}
+		saveOrder := func(payID, epayOrderID string, count int, price, reallyPrice float64, created time.Time) {
+			t.Helper()
+			order := &Order{PayID: payID, UserID: "payer", Count: count, GoodsName: "次数", Price: price,
+				Status: "pending", CreateTime: created, Product: defaultProductID}
+			if err := store.SaveOrder(order); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UpdateOrderWithEpayInfo(payID, epayOrderID, reallyPrice, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		balance := func() int {
+			t.Helper()
+			balances, err := store.GetUserBalances("payer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return balances[defaultProductID]
+		}
+
+		now := time.Now()
+		saveOrder("ORDER_OLD", "EPAY_OLD", 10, 1, 1.01, now.Add(-time.Minute))
+		saveOrder("ORDER_NEW", "EPAY_NEW", 100, 5, 5, now)
+
+		// 回调对应较早的订单，不能按用户最新的未支付订单入账
+		if code := notify("EPAY_OLD", "payer", "1", "1.01"); code != http.StatusOK {
+			t.Fatalf("回调状态码 = %d", code)
+		}
+		if got := balance(); got != 10 {
+			t.Fatalf("余额 = %d, 期望只增加较早订单的 10 次", got)
+		}
+		if order, err := store.GetOrderByPayID("ORDER_NEW"); err != nil || order.Status != "pending" {
+			t.Fatalf("较新的订单 = %+v, %v, 期望仍未支付", order, err)
+		}
+
+		// 实付金额不足时不入账，订单标记为待退款
+		if code := notify("EPAY_NEW", "payer", "5", "0.01"); code != http.StatusOK {
+			t.Fatalf("回调状态码 = %d", code)
+		}
+		if got := balance(); got != 10 {
+			t.Fatalf("金额不符时余额 = %d, 期望不变", got)
+		}
+		if order, err := store.GetOrderByPayID("ORDER_NEW"); err != nil || order.Status != orderStatusRefundRequired {
+			t.Fatalf("金额不符的订单 = %+v, %v, 期望待退款", order, err)
+		}
+
+		// 回调用户与订单不一致时拒绝
+		saveOrder("ORDER_OTHER", "EPAY_OTHER", 10, 1, 1, now)
+		if code := notify("EPAY_OTHER", "someone", "1", "1"); code != http.StatusBadRequest {
+			t.Fatalf("用户不一致时状态码 = %d, 期望 400", code)
+		}
+		if code := notify("EPAY_MISSING", "payer", "1", "1"); code != http.StatusNotFound {
+			t.Fatalf("未知订单状态码 = %d, 期望 404", code)
+		}
+	})
+}
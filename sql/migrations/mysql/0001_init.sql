@@ -0,0 +1,63 @@
+-- 0001 初始表结构（MySQL）
+
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `ip` varchar(64) NOT NULL,
+  `token` text NOT NULL,
+  `limit_count` int NOT NULL DEFAULT '0',
+  `timestamp` bigint NOT NULL,
+  `created_at` datetime NOT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_id` (`user_id`),
+  UNIQUE KEY `ip` (`ip`),
+  KEY `user_timestamp` (`user_id`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `card_keys` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `key_code` varchar(32) NOT NULL,
+  `add_limit` int NOT NULL,
+  `used` tinyint(1) NOT NULL DEFAULT '0',
+  `used_by` varchar(64) DEFAULT NULL,
+  `created_by` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `key_code` (`key_code`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `orders` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `pay_id` varchar(64) NOT NULL,
+  `order_id` varchar(64) DEFAULT NULL,
+  `user_id` varchar(64) NOT NULL,
+  `count` int NOT NULL DEFAULT '0',
+  `goods_name` varchar(255) NOT NULL,
+  `price` decimal(10,2) NOT NULL,
+  `really_price` decimal(10,2) DEFAULT NULL,
+  `status` varchar(32) NOT NULL,
+  `pay_type` int DEFAULT NULL,
+  `pay_time` datetime DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  `chat_id` bigint DEFAULT NULL,
+  `message_id` int DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `pay_id` (`pay_id`),
+  KEY `user_id` (`user_id`),
+  KEY `status` (`status`),
+  KEY `order_id` (`order_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `revoked_tokens` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `token_timestamp` bigint NOT NULL,
+  `revoked_by` varchar(64) NOT NULL,
+  `reason` varchar(255) DEFAULT NULL,
+  `revoked_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_token` (`user_id`, `token_timestamp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
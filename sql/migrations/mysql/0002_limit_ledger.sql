@@ -0,0 +1,13 @@
+-- 0002 次数变动流水（MySQL）
+
+CREATE TABLE IF NOT EXISTS `limit_ledger` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `delta` int NOT NULL,
+  `balance` int NOT NULL,
+  `source` varchar(32) NOT NULL,
+  `ref` varchar(64) DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,5 @@
+-- 0003 卡密批次（MySQL）
+
+ALTER TABLE `card_keys` ADD COLUMN `batch_id` varchar(32) DEFAULT NULL;
+
+CREATE INDEX `batch_id` ON `card_keys` (`batch_id`);
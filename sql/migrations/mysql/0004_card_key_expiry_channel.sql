@@ -0,0 +1,7 @@
+-- 0004 卡密过期时间、渠道标签和作废标记（MySQL）
+
+ALTER TABLE `card_keys` ADD COLUMN `expires_at` datetime DEFAULT NULL;
+
+ALTER TABLE `card_keys` ADD COLUMN `channel` varchar(64) DEFAULT NULL;
+
+ALTER TABLE `card_keys` ADD COLUMN `disabled` tinyint(1) NOT NULL DEFAULT '0';
@@ -0,0 +1,21 @@
+-- 0005 多次使用卡密和兑换记录（MySQL）
+
+ALTER TABLE `card_keys` ADD COLUMN `max_uses` int NOT NULL DEFAULT '1';
+
+ALTER TABLE `card_keys` ADD COLUMN `uses_count` int NOT NULL DEFAULT '0';
+
+UPDATE `card_keys` SET `uses_count` = 1 WHERE `used` = 1;
+
+CREATE TABLE IF NOT EXISTS `key_redemptions` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `key_code` varchar(32) NOT NULL,
+  `user_id` varchar(64) NOT NULL,
+  `redeemed_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `key_user` (`key_code`, `user_id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO `key_redemptions` (`key_code`, `user_id`, `redeemed_at`)
+  SELECT `key_code`, `used_by`, COALESCE(`used_at`, `created_at`) FROM `card_keys`
+  WHERE `used` = 1 AND `used_by` IS NOT NULL;
@@ -0,0 +1,9 @@
+-- 0006 卡密兑换失败计数（MySQL）
+
+CREATE TABLE IF NOT EXISTS `key_attempts` (
+  `scope` varchar(80) NOT NULL,
+  `failures` int NOT NULL DEFAULT '0',
+  `last_failure` datetime NOT NULL,
+  `locked_until` datetime DEFAULT NULL,
+  PRIMARY KEY (`scope`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,12 @@
+-- 0007 用户IP白名单和购买的IP槽位（MySQL）
+
+ALTER TABLE `users` ADD COLUMN `ip_slots` int NOT NULL DEFAULT '0';
+
+CREATE TABLE IF NOT EXISTS `user_ips` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `ip` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_ip` (`user_id`, `ip`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,18 @@
+-- 0008 每个用户的多个命名Token（MySQL）
+-- 用户的默认Token仍保存在 users 表中，这里只保存额外创建的命名Token
+
+CREATE TABLE IF NOT EXISTS `tokens` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `name` varchar(32) NOT NULL,
+  `ip` varchar(64) NOT NULL,
+  `token` text NOT NULL,
+  `timestamp` bigint NOT NULL,
+  `own_quota` tinyint(1) NOT NULL DEFAULT '0',
+  `limit_count` int NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_name` (`user_id`, `name`),
+  UNIQUE KEY `user_timestamp` (`user_id`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,19 @@
+-- 0009 按产品区分的次数余额（MySQL）
+-- 默认产品的次数仍保存在 users.limit_count 中，这里只保存其他产品的余额
+
+CREATE TABLE IF NOT EXISTS `user_balances` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(64) NOT NULL,
+  `product` varchar(32) NOT NULL,
+  `limit_count` int NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_product` (`user_id`, `product`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `card_keys` ADD COLUMN `product` varchar(32) NOT NULL DEFAULT 'default';
+
+ALTER TABLE `orders` ADD COLUMN `product` varchar(32) NOT NULL DEFAULT 'default';
+
+ALTER TABLE `limit_ledger` ADD COLUMN `product` varchar(32) NOT NULL DEFAULT 'default';
@@ -0,0 +1,4 @@
+-- 0010 按用户ID和时间戳查找Token记录的索引（MySQL）
+-- 早期版本创建的 users 表没有这个索引，新建的表已在 0001 中包含，已存在时跳过
+
+CREATE INDEX `user_timestamp` ON `users` (`user_id`, `timestamp`);
@@ -0,0 +1,3 @@
+-- 0011 卡密失败告警标记（MySQL）
+
+ALTER TABLE `key_attempts` ADD COLUMN `alert_sent` tinyint(1) NOT NULL DEFAULT '0';
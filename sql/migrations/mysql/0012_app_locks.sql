@@ -0,0 +1,10 @@
+-- 0012 数据库锁（MySQL）
+-- 写入IP绑定的事务先更新 ip_bind 行，多个进程共用数据库时同样串行
+
+CREATE TABLE IF NOT EXISTS `app_locks` (
+  `name` varchar(32) NOT NULL,
+  `locked_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO `app_locks` (`name`) VALUES ('ip_bind');
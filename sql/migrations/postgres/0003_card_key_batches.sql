@@ -0,0 +1,5 @@
+-- 0003 卡密批次（PostgreSQL）
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS batch_id VARCHAR(32) DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_card_keys_batch_id ON card_keys (batch_id);
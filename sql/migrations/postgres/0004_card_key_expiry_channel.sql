@@ -0,0 +1,7 @@
+-- 0004 卡密过期时间、渠道标签和作废标记（PostgreSQL）
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ DEFAULT NULL;
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS channel VARCHAR(64) DEFAULT NULL;
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,21 @@
+-- 0005 多次使用卡密和兑换记录（PostgreSQL）
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS max_uses INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS uses_count INTEGER NOT NULL DEFAULT 0;
+
+UPDATE card_keys SET uses_count = 1 WHERE used = TRUE;
+
+CREATE TABLE IF NOT EXISTS key_redemptions (
+  id BIGSERIAL PRIMARY KEY,
+  key_code VARCHAR(32) NOT NULL,
+  user_id VARCHAR(64) NOT NULL,
+  redeemed_at TIMESTAMPTZ NOT NULL,
+  UNIQUE (key_code, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_redemptions_user_id ON key_redemptions (user_id);
+
+INSERT INTO key_redemptions (key_code, user_id, redeemed_at)
+  SELECT key_code, used_by, COALESCE(used_at, created_at) FROM card_keys
+  WHERE used = TRUE AND used_by IS NOT NULL;
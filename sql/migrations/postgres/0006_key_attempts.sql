@@ -0,0 +1,8 @@
+-- 0006 卡密兑换失败计数（PostgreSQL）
+
+CREATE TABLE IF NOT EXISTS key_attempts (
+  scope VARCHAR(80) NOT NULL PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure TIMESTAMPTZ NOT NULL,
+  locked_until TIMESTAMPTZ DEFAULT NULL
+);
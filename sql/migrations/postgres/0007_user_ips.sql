@@ -0,0 +1,11 @@
+-- 0007 用户IP白名单和购买的IP槽位（PostgreSQL）
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ip_slots INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_ips (
+  id BIGSERIAL PRIMARY KEY,
+  user_id VARCHAR(64) NOT NULL,
+  ip VARCHAR(64) NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  UNIQUE (user_id, ip)
+);
@@ -0,0 +1,17 @@
+-- 0008 每个用户的多个命名Token（PostgreSQL）
+-- 用户的默认Token仍保存在 users 表中，这里只保存额外创建的命名Token
+
+CREATE TABLE IF NOT EXISTS tokens (
+  id BIGSERIAL PRIMARY KEY,
+  user_id VARCHAR(64) NOT NULL,
+  name VARCHAR(32) NOT NULL,
+  ip VARCHAR(64) NOT NULL,
+  token TEXT NOT NULL,
+  timestamp BIGINT NOT NULL,
+  own_quota BOOLEAN NOT NULL DEFAULT FALSE,
+  limit_count INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ DEFAULT NULL,
+  UNIQUE (user_id, name),
+  UNIQUE (user_id, timestamp)
+);
@@ -0,0 +1,16 @@
+-- 0009 按产品区分的次数余额（PostgreSQL）
+-- 默认产品的次数仍保存在 users.limit_count 中，这里只保存其他产品的余额
+
+CREATE TABLE IF NOT EXISTS user_balances (
+  id BIGSERIAL PRIMARY KEY,
+  user_id VARCHAR(64) NOT NULL,
+  product VARCHAR(32) NOT NULL,
+  limit_count INTEGER NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ DEFAULT NULL,
+  UNIQUE (user_id, product)
+);
+
+ALTER TABLE card_keys ADD COLUMN IF NOT EXISTS product VARCHAR(32) NOT NULL DEFAULT 'default';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS product VARCHAR(32) NOT NULL DEFAULT 'default';
+ALTER TABLE limit_ledger ADD COLUMN IF NOT EXISTS product VARCHAR(32) NOT NULL DEFAULT 'default';
@@ -0,0 +1,4 @@
+-- 0010 按用户ID和时间戳查找Token记录的索引（PostgreSQL）
+-- 早期版本创建的 users 表没有这个索引，新建的表已在 0001 中包含
+
+CREATE INDEX IF NOT EXISTS idx_users_user_timestamp ON users (user_id, timestamp);
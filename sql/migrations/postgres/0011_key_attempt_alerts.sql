@@ -0,0 +1,3 @@
+-- 0011 卡密失败告警标记（PostgreSQL）
+
+ALTER TABLE key_attempts ADD COLUMN IF NOT EXISTS alert_sent BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,9 @@
+-- 0012 数据库锁（PostgreSQL）
+-- 写入IP绑定的事务先更新 ip_bind 行，多个进程共用数据库时同样串行
+
+CREATE TABLE IF NOT EXISTS app_locks (
+  name VARCHAR(32) NOT NULL PRIMARY KEY,
+  locked_at TIMESTAMPTZ DEFAULT NULL
+);
+
+INSERT INTO app_locks (name) VALUES ('ip_bind') ON CONFLICT DO NOTHING;
@@ -0,0 +1,57 @@
+-- 0001 初始表结构（SQLite）
+
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id VARCHAR(64) NOT NULL UNIQUE,
+  ip VARCHAR(64) NOT NULL UNIQUE,
+  token TEXT NOT NULL,
+  limit_count INTEGER NOT NULL DEFAULT 0,
+  timestamp BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_user_timestamp ON users (user_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS card_keys (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  key_code VARCHAR(32) NOT NULL UNIQUE,
+  add_limit INTEGER NOT NULL,
+  used BOOLEAN NOT NULL DEFAULT 0,
+  used_by VARCHAR(64) DEFAULT NULL,
+  created_by VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  used_at DATETIME DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  pay_id VARCHAR(64) NOT NULL UNIQUE,
+  order_id VARCHAR(64) DEFAULT NULL,
+  user_id VARCHAR(64) NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  goods_name VARCHAR(255) NOT NULL,
+  price DECIMAL(10,2) NOT NULL,
+  really_price DECIMAL(10,2) DEFAULT NULL,
+  status VARCHAR(32) NOT NULL,
+  pay_type INTEGER DEFAULT NULL,
+  pay_time DATETIME DEFAULT NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME DEFAULT NULL,
+  chat_id BIGINT DEFAULT NULL,
+  message_id INTEGER DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS idx_orders_order_id ON orders (order_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id VARCHAR(64) NOT NULL,
+  token_timestamp BIGINT NOT NULL,
+  revoked_by VARCHAR(64) NOT NULL,
+  reason VARCHAR(255) DEFAULT NULL,
+  revoked_at DATETIME NOT NULL,
+  UNIQUE (user_id, token_timestamp)
+);
@@ -0,0 +1,13 @@
+-- 0002 次数变动流水（SQLite）
+
+CREATE TABLE IF NOT EXISTS limit_ledger (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id VARCHAR(64) NOT NULL,
+  delta INTEGER NOT NULL,
+  balance INTEGER NOT NULL,
+  source VARCHAR(32) NOT NULL,
+  ref VARCHAR(64) DEFAULT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_limit_ledger_user_id ON limit_ledger (user_id);
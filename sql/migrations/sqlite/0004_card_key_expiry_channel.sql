@@ -0,0 +1,7 @@
+-- 0004 卡密过期时间、渠道标签和作废标记（SQLite）
+
+ALTER TABLE card_keys ADD COLUMN expires_at DATETIME DEFAULT NULL;
+
+ALTER TABLE card_keys ADD COLUMN channel VARCHAR(64) DEFAULT NULL;
+
+ALTER TABLE card_keys ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,21 @@
+-- 0005 多次使用卡密和兑换记录（SQLite）
+
+ALTER TABLE card_keys ADD COLUMN max_uses INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE card_keys ADD COLUMN uses_count INTEGER NOT NULL DEFAULT 0;
+
+UPDATE card_keys SET uses_count = 1 WHERE used = 1;
+
+CREATE TABLE IF NOT EXISTS key_redemptions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  key_code VARCHAR(32) NOT NULL,
+  user_id VARCHAR(64) NOT NULL,
+  redeemed_at DATETIME NOT NULL,
+  UNIQUE (key_code, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_redemptions_user_id ON key_redemptions (user_id);
+
+INSERT INTO key_redemptions (key_code, user_id, redeemed_at)
+  SELECT key_code, used_by, COALESCE(used_at, created_at) FROM card_keys
+  WHERE used = 1 AND used_by IS NOT NULL;
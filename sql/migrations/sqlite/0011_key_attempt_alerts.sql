@@ -0,0 +1,3 @@
+-- 0011 卡密失败告警标记（SQLite）
+
+ALTER TABLE key_attempts ADD COLUMN alert_sent BOOLEAN NOT NULL DEFAULT 0;
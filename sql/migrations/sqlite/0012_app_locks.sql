@@ -0,0 +1,9 @@
+-- 0012 数据库锁（SQLite）
+-- 写入IP绑定的事务先更新 ip_bind 行，多个进程共用数据库时同样串行
+
+CREATE TABLE IF NOT EXISTS app_locks (
+  name VARCHAR(32) NOT NULL PRIMARY KEY,
+  locked_at DATETIME DEFAULT NULL
+);
+
+INSERT OR IGNORE INTO app_locks (name) VALUES ('ip_bind');